@@ -218,6 +218,9 @@ type MasterNodeVout struct {
 }
 
 type CoinBaseTransaction struct {
+	// extranonce sizes in bytes, EXTRANONCE1_SIZE and EXTRANONCE2_SIZE if zero
+	ExtraNonce1Size          int
+	ExtraNonce2Size          int
 	BlockTime                uint32
 	BlockHeight              uint32
 	RewardValue              int64
@@ -229,6 +232,22 @@ type CoinBaseTransaction struct {
 	CoinBaseTx1              []byte
 	CoinBaseTx2              []byte
 	DefaultWitnessCommitment []byte
+	// outputs after the reward output, such as the pool fee of solo blocks;
+	// RewardValue is what remains for the reward output
+	ExtraVouts []MasterNodeVout
+	// merged mining commitment, pushed after the extra nonces
+	AuxCommitment []byte
+}
+
+func (t *CoinBaseTransaction) extraNonceSizes() (int, int) {
+	size1, size2 := t.ExtraNonce1Size, t.ExtraNonce2Size
+	if size1 == 0 {
+		size1 = EXTRANONCE1_SIZE
+	}
+	if size2 == 0 {
+		size2 = EXTRANONCE2_SIZE
+	}
+	return size1, size2
 }
 
 func (t *CoinBaseTransaction) _generateCoinB() error {
@@ -260,7 +279,8 @@ func (t *CoinBaseTransaction) _generateCoinB() error {
 		return err
 	}
 
-	vinScriptLen := len(t.VinScript1) + EXTRANONCE1_SIZE + EXTRANONCE2_SIZE + len(t.VinScript2)
+	size1, size2 := t.extraNonceSizes()
+	vinScriptLen := len(t.VinScript1) + size1 + size2 + len(t.VinScript2)
 	err = serialize.PackCompactSize(writer, uint64(vinScriptLen))
 	if err != nil {
 		return err
@@ -288,10 +308,10 @@ func (t *CoinBaseTransaction) _generateCoinB() error {
 		return err
 	}
 
-	// vout count: 1 or 2
-	voutCount := 1
+	// vout count: the reward, the extra outputs and the witness commitment
+	voutCount := 1 + len(t.ExtraVouts)
 	if len(t.DefaultWitnessCommitment) != 0 {
-		voutCount = 2
+		voutCount++
 	}
 
 	err = serialize.PackCompactSize(writer, uint64(voutCount))
@@ -312,6 +332,19 @@ func (t *CoinBaseTransaction) _generateCoinB() error {
 		return err
 	}
 
+	for _, vout := range t.ExtraVouts {
+		err = serialize.PackInt64(writer, vout.Amount)
+		if err != nil {
+			return err
+		}
+		var extraScript script.Script
+		extraScript.SetScriptBytes(vout.VoutScript)
+		err = extraScript.Pack(writer)
+		if err != nil {
+			return err
+		}
+	}
+
 	// pack DefaultWitnessCommitment
 	if len(t.DefaultWitnessCommitment) != 0 {
 		err = serialize.PackInt64(writer, 0)
@@ -350,17 +383,29 @@ func (t *CoinBaseTransaction) Initialize(cbWallet string, bTime uint32, height u
 	}
 	t.CBAuxFlag = cbFlag
 
+	size1, size2 := t.extraNonceSizes()
+	// the extra nonces are a single push, a script sig is at most 100 bytes
+	if size1 < 0 || size2 < 0 || size1+size2 > 0x4b {
+		return errors.New("invalid extra nonce size")
+	}
+
 	bytes1 := PackNumber(int64(t.BlockHeight))
 	bytes2 := t.CBAuxFlag
 	bytes3 := PackNumber(time.Now().Unix())
-	bytes4 := []byte{EXTRANONCE1_SIZE + EXTRANONCE2_SIZE}
+	bytes4 := []byte{byte(size1 + size2)}
 	t.VinScript1 = append(append(append(append([]byte{}, bytes1...), bytes2...), bytes3...), bytes4...)
 
 	script2, err := PackString(t.CBExtras)
 	if err != nil {
 		return errors.New("pack string CBExtras error")
 	}
+	if len(t.AuxCommitment) > 0 {
+		script2 = append(append([]byte{byte(len(t.AuxCommitment))}, t.AuxCommitment...), script2...)
+	}
 	t.VinScript2 = script2
+	if len(t.VinScript1)+size1+size2+len(t.VinScript2) > 100 {
+		return errors.New("coinbase script sig too long")
+	}
 
 	t.VoutScript, err = GetCoinBaseScript(cbWallet)
 	if err != nil {
@@ -397,11 +442,12 @@ func (t *CoinBaseTransaction) RecoverToRawTransaction(extraNonce1Hex string, ext
 		return transaction.Transaction{}, errors.New("decode hex extraNonce2Hex error")
 	}
 
-	if len(extraNonce1) != EXTRANONCE1_SIZE {
+	size1, size2 := t.extraNonceSizes()
+	if len(extraNonce1) != size1 {
 		return transaction.Transaction{}, errors.New("invalid extraNonce1 length")
 	}
 
-	if len(extraNonce2) != EXTRANONCE2_SIZE {
+	if len(extraNonce2) != size2 {
 		return transaction.Transaction{}, errors.New("invalid extraNonce2 length")
 	}
 
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/mutalisk999/bitcoin-lib/src/transaction"
@@ -93,3 +94,80 @@ func TestGetCoinBaseScriptByAddress(t *testing.T) {
 	scriptHex, _ := GetCoinBaseScriptByAddress("bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03")
 	fmt.Println("coinbaser script:", scriptHex)
 }
+
+func TestRecoverToRawTransactionExtraNonceSizes(t *testing.T) {
+	cbtx := CoinBaseTransaction{ExtraNonce1Size: 4, ExtraNonce2Size: 8}
+	err := cbtx.Initialize("bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03", 1607055201, 1827, 18492529212, "",
+		"btcpool", "6a24aa21a9ed2607916dfc80dc54aefa568f2161355625d23e063e38445c6887c01cfa995b95")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, err := cbtx.RecoverToRawTransaction("00010002", "0102030405060708")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptSig := trx.Vin[0].ScriptSig.GetScriptBytes()
+	if !bytes.Contains(scriptSig, []byte{12, 0x00, 0x01, 0x00, 0x02, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}) {
+		t.Errorf("Extra nonces must be a single push in the script sig: %x", scriptSig)
+	}
+
+	if _, err = cbtx.RecoverToRawTransaction("00010002", "01020304"); err == nil {
+		t.Error("Must reject extraNonce2 of the wrong size")
+	}
+
+	cbtx = CoinBaseTransaction{ExtraNonce1Size: 40, ExtraNonce2Size: 40}
+	err = cbtx.Initialize("bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03", 1607055201, 1827, 18492529212, "", "btcpool", "")
+	if err == nil {
+		t.Error("Must reject extra nonces larger than a single push")
+	}
+}
+
+func TestInitializeExtraVouts(t *testing.T) {
+	feeScript, err := GetCoinBaseScript("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbtx := CoinBaseTransaction{ExtraVouts: []MasterNodeVout{{Amount: 1000, VoutScript: feeScript}}}
+	err = cbtx.Initialize("bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03", 1607055201, 1827, 18492528212, "",
+		"btcpool", "6a24aa21a9ed2607916dfc80dc54aefa568f2161355625d23e063e38445c6887c01cfa995b95")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trx, err := cbtx.RecoverToRawTransaction("00010002", "01020304")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trx.Vout) != 3 || trx.Vout[0].Value != 18492528212 || trx.Vout[1].Value != 1000 || trx.Vout[2].Value != 0 {
+		t.Fatalf("Expected reward, fee and witness commitment outputs, got %+v", trx.Vout)
+	}
+	if !bytes.Equal(trx.Vout[1].ScriptPubKey.GetScriptBytes(), feeScript) {
+		t.Error("Extra output must pay its script")
+	}
+}
+
+func TestInitializeAuxCommitment(t *testing.T) {
+	commitment, _ := hex.DecodeString("fabe6d6d" + strings.Repeat("11", 32) + "0100000000000000")
+	cbtx := CoinBaseTransaction{AuxCommitment: commitment}
+	err := cbtx.Initialize("bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03", 1607055201, 1827, 18492528212, "",
+		"btcpool", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trx, err := cbtx.RecoverToRawTransaction("00010002", "01020304")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptSig := trx.Vin[0].ScriptSig.GetScriptBytes()
+	pushed := append([]byte{byte(len(commitment))}, commitment...)
+	if !bytes.Contains(scriptSig, append([]byte{0x01, 0x02, 0x03, 0x04}, pushed...)) {
+		t.Errorf("Commitment must be pushed after the extra nonces, got %x", scriptSig)
+	}
+
+	cbtx = CoinBaseTransaction{AuxCommitment: commitment}
+	err = cbtx.Initialize("bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03", 1607055201, 1827, 18492528212, "",
+		strings.Repeat("x", 40), "")
+	if err == nil {
+		t.Error("Script sig over 100 bytes must be refused")
+	}
+}
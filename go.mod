@@ -3,6 +3,7 @@ module github.com/PowPool/btcpool
 go 1.22
 
 require (
+	github.com/btcsuite/btcd/btcec/v2 v2.3.2
 	github.com/ethereum/go-ethereum v1.12.1
 	github.com/gorilla/mux v1.8.0
 	github.com/mutalisk999/bitcoin-lib v0.0.0-20201203080325-81caed73682f
@@ -12,6 +13,9 @@ require (
 )
 
 require (
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.0.1 // indirect
+	github.com/decred/dcrd/crypto/blake256 v1.0.0 // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
 	github.com/garyburd/redigo v1.6.2 // indirect
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.34.2 // indirect
@@ -11,6 +11,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
@@ -36,9 +37,13 @@ var (
 var cfg proxy.Config
 var backend *storage.RedisClient
 
-func startProxy() {
+// stratum recording to replay instead of running the pool
+var replayFile string
+
+func startProxy() *proxy.ProxyServer {
 	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
+	go s.Start()
+	return s
 }
 
 func startApi() {
@@ -69,8 +74,8 @@ func startBlockUnlocker() {
 
 func readConfig(cfg *proxy.Config) {
 	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+	if flag.NArg() > 0 {
+		configFileName = flag.Arg(0)
 	}
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
@@ -165,6 +170,7 @@ func initPeerName(cfg *proxy.Config) error {
 func OptionParse() {
 	var showVer bool
 	flag.BoolVar(&showVer, "v", false, "show build version")
+	flag.StringVar(&replayFile, "replay", "", "replay a stratum recording and exit")
 
 	flag.Parse()
 
@@ -190,6 +196,15 @@ func main() {
 	bLogFile := "logs/block.log"
 	InitLog(iLogFile, eLogFile, sLogFile, bLogFile, cfg.Log.LogSetLevel)
 
+	if len(replayFile) > 0 {
+		// replayed shares are kept apart from the pool stats
+		backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin+"-replay")
+		if err := proxy.Replay(&cfg, backend, replayFile, os.Stdout); err != nil {
+			Error.Fatal("Replay error: ", err.Error())
+		}
+		return
+	}
+
 	err := initPeerName(&cfg)
 	if err != nil {
 		Error.Fatal("initPeerName error: ", err.Error())
@@ -229,8 +244,9 @@ func main() {
 		}
 	}()
 
+	var proxyServer *proxy.ProxyServer
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		proxyServer = startProxy()
 	}
 	if cfg.Api.Enabled {
 		go startApi()
@@ -241,6 +257,18 @@ func main() {
 	//if cfg.Payouts.Enabled {
 	//	go startPayoutsProcessor()
 	//}
-	quit := make(chan bool)
-	<-quit
+
+	// SIGTERM and SIGINT drain the stratum miners to another node and exit,
+	// SIGUSR1 only drains, to take the node out of rotation
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	for sig := range sigs {
+		Info.Printf("Received %v, draining", sig)
+		if proxyServer != nil {
+			proxyServer.Drain()
+		}
+		if sig != syscall.SIGUSR1 {
+			return
+		}
+	}
 }
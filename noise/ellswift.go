@@ -0,0 +1,209 @@
+package noise
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// ElligatorSwift encoding of secp256k1 public keys as specified in BIP324.
+// Only a handful of field operations are needed per handshake, so plain
+// big.Int arithmetic is used instead of the constant-time field type.
+
+const EllSwiftSize = 64
+
+var (
+	fieldP     = btcec.S256().P
+	fieldSeven = big.NewInt(7)
+	// sqrt(-3) as computed by (-3)^((p+1)/4), the root chosen by the BIP324 reference code
+	minus3Sqrt = feSqrt(feNeg(big.NewInt(3)))
+
+	errEllSwiftLength = errors.New("noise: invalid ellswift encoding length")
+)
+
+func feMod(a *big.Int) *big.Int {
+	return a.Mod(a, fieldP)
+}
+
+func feAdd(a, b *big.Int) *big.Int {
+	return feMod(new(big.Int).Add(a, b))
+}
+
+func feSub(a, b *big.Int) *big.Int {
+	return feMod(new(big.Int).Sub(a, b))
+}
+
+func feMul(a, b *big.Int) *big.Int {
+	return feMod(new(big.Int).Mul(a, b))
+}
+
+func feNeg(a *big.Int) *big.Int {
+	return feMod(new(big.Int).Neg(a))
+}
+
+func feInv(a *big.Int) *big.Int {
+	return new(big.Int).ModInverse(a, fieldP)
+}
+
+func feDiv(a, b *big.Int) *big.Int {
+	return feMul(a, feInv(b))
+}
+
+// feSqrt returns a square root of a, or nil if a is not a quadratic residue.
+func feSqrt(a *big.Int) *big.Int {
+	e := new(big.Int).Add(fieldP, big.NewInt(1))
+	e.Rsh(e, 2)
+	r := new(big.Int).Exp(a, e, fieldP)
+	if feMul(r, r).Cmp(feMod(new(big.Int).Set(a))) != 0 {
+		return nil
+	}
+	return r
+}
+
+// curveRHS returns x^3 + 7.
+func curveRHS(x *big.Int) *big.Int {
+	return feAdd(feMul(feMul(x, x), x), fieldSeven)
+}
+
+func isValidX(x *big.Int) bool {
+	return feSqrt(curveRHS(x)) != nil
+}
+
+// xSwiftEC decodes the field elements (u, t) to an X coordinate on the curve.
+func xSwiftEC(u, t *big.Int) *big.Int {
+	u = feMod(new(big.Int).Set(u))
+	t = feMod(new(big.Int).Set(t))
+	if u.Sign() == 0 {
+		u.SetInt64(1)
+	}
+	if t.Sign() == 0 {
+		t.SetInt64(1)
+	}
+	if feAdd(curveRHS(u), feMul(t, t)).Sign() == 0 {
+		t = feAdd(t, t)
+	}
+	x := feDiv(feSub(curveRHS(u), feMul(t, t)), feAdd(t, t))
+	y := feDiv(feAdd(x, t), feMul(minus3Sqrt, u))
+
+	candidates := []*big.Int{
+		feAdd(u, feMul(big.NewInt(4), feMul(y, y))),
+		feDiv(feSub(feNeg(feDiv(x, y)), u), big.NewInt(2)),
+		feDiv(feSub(feDiv(x, y), u), big.NewInt(2)),
+	}
+	for _, c := range candidates {
+		if isValidX(c) {
+			return c
+		}
+	}
+	// unreachable: one of the three candidates is always on the curve
+	return nil
+}
+
+// xSwiftECInv finds t such that xSwiftEC(u, t) = x, or returns nil.
+// c selects which of the up to 8 preimages is returned.
+func xSwiftECInv(x, u *big.Int, c int) *big.Int {
+	var s, v *big.Int
+	if c&2 == 0 {
+		if isValidX(feSub(feNeg(x), u)) {
+			return nil
+		}
+		v = x
+		s = feDiv(feNeg(curveRHS(u)), feAdd(feAdd(feMul(u, u), feMul(u, v)), feMul(v, v)))
+	} else {
+		s = feSub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		uu := feMul(u, u)
+		r := feSqrt(feMul(feNeg(s), feAdd(feMul(big.NewInt(4), curveRHS(u)), feMul(big.NewInt(3), feMul(s, uu)))))
+		if r == nil {
+			return nil
+		}
+		if c&1 != 0 && r.Sign() == 0 {
+			return nil
+		}
+		v = feDiv(feAdd(feNeg(u), feDiv(r, s)), big.NewInt(2))
+	}
+	w := feSqrt(s)
+	if w == nil {
+		return nil
+	}
+	if c&5 == 0 || c&5 == 5 {
+		w = feNeg(w)
+	}
+	half := feInv(big.NewInt(2))
+	if c&1 == 0 {
+		return feMul(w, feAdd(feMul(u, feMul(feSub(big.NewInt(1), minus3Sqrt), half)), v))
+	}
+	return feMul(w, feAdd(feMul(u, feMul(feAdd(big.NewInt(1), minus3Sqrt), half)), v))
+}
+
+func putFieldBytes(dst []byte, a *big.Int) {
+	b := a.Bytes()
+	copy(dst[32-len(b):32], b)
+}
+
+// EllSwiftEncode returns a random 64 byte ElligatorSwift encoding of pub.
+func EllSwiftEncode(pub *btcec.PublicKey) ([]byte, error) {
+	x := new(big.Int).SetBytes(pub.SerializeCompressed()[1:])
+	var buf [33]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, err
+		}
+		u := feMod(new(big.Int).SetBytes(buf[:32]))
+		if u.Sign() == 0 {
+			continue
+		}
+		t := xSwiftECInv(x, u, int(buf[32]&7))
+		// the decoder is the source of truth, never hand out an encoding it rejects
+		if t == nil || xSwiftEC(u, t).Cmp(x) != 0 {
+			continue
+		}
+		enc := make([]byte, EllSwiftSize)
+		putFieldBytes(enc[:32], u)
+		putFieldBytes(enc[32:], t)
+		return enc, nil
+	}
+}
+
+// EllSwiftDecode returns the public key with even Y for the X coordinate encoded in enc.
+func EllSwiftDecode(enc []byte) (*btcec.PublicKey, error) {
+	if len(enc) != EllSwiftSize {
+		return nil, errEllSwiftLength
+	}
+	u := new(big.Int).SetBytes(enc[:32])
+	t := new(big.Int).SetBytes(enc[32:])
+	x := xSwiftEC(u, t)
+
+	compressed := make([]byte, 33)
+	compressed[0] = 0x02
+	putFieldBytes(compressed[1:], x)
+	return btcec.ParsePubKey(compressed)
+}
+
+// EllSwiftXDH computes the BIP324 x-only ECDH shared secret. ellA is the
+// encoding of the initiator's key and ellB the responder's, ellTheirs is
+// whichever of the two belongs to the remote party.
+func EllSwiftXDH(priv *btcec.PrivateKey, ellA, ellB, ellTheirs []byte) ([]byte, error) {
+	theirs, err := EllSwiftDecode(ellTheirs)
+	if err != nil {
+		return nil, err
+	}
+	x := btcec.GenerateSharedSecret(priv, theirs)
+	return taggedHash("bip324_ellswift_xonly_ecdh", ellA, ellB, x), nil
+}
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
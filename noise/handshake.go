@@ -0,0 +1,375 @@
+package noise
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Noise NX handshake used by the Stratum V2 transport:
+//
+//	-> e
+//	<- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+
+const (
+	ProtocolName = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+
+	MacSize = chacha20poly1305.Overhead
+
+	SignatureNoiseMessageSize = 2 + 4 + 4 + 64
+
+	// Act1Size is the size of the initiator's first message
+	Act1Size = EllSwiftSize
+	// Act2Size is the size of the responder's reply
+	Act2Size = EllSwiftSize + EllSwiftSize + MacSize + SignatureNoiseMessageSize + MacSize
+)
+
+var (
+	ErrInvalidMessageSize = errors.New("noise: invalid handshake message size")
+	ErrInvalidCertificate = errors.New("noise: invalid server certificate")
+	ErrNonceExhausted     = errors.New("noise: nonce exhausted")
+)
+
+// CipherState encrypts or decrypts one direction of the transport.
+type CipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(k []byte) *CipherState {
+	aead, err := chacha20poly1305.New(k)
+	if err != nil {
+		// k is always the 32 byte output of HKDF
+		panic(err)
+	}
+	return &CipherState{aead: aead}
+}
+
+func (c *CipherState) nonce() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	return nonce[:]
+}
+
+func (c *CipherState) Encrypt(ad, plaintext []byte) ([]byte, error) {
+	if c.n == ^uint64(0) {
+		return nil, ErrNonceExhausted
+	}
+	ciphertext := c.aead.Seal(nil, c.nonce(), plaintext, ad)
+	c.n++
+	return ciphertext, nil
+}
+
+func (c *CipherState) Decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if c.n == ^uint64(0) {
+		return nil, ErrNonceExhausted
+	}
+	plaintext, err := c.aead.Open(nil, c.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	c.n++
+	return plaintext, nil
+}
+
+type symmetricState struct {
+	ck []byte
+	h  []byte
+	cs *CipherState
+}
+
+func newSymmetricState() *symmetricState {
+	h := sha256.Sum256([]byte(ProtocolName))
+	ss := &symmetricState{ck: h[:], h: h[:]}
+	// empty prologue
+	ss.mixHash(nil)
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	var k []byte
+	ss.ck, k = hkdf2(ss.ck, ikm)
+	ss.cs = newCipherState(k)
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	if ss.cs == nil {
+		ss.mixHash(plaintext)
+		return plaintext, nil
+	}
+	ciphertext, err := ss.cs.Encrypt(ss.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if ss.cs == nil {
+		ss.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	plaintext, err := ss.cs.Decrypt(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the initiator->responder and responder->initiator cipher states.
+func (ss *symmetricState) split() (*CipherState, *CipherState) {
+	k1, k2 := hkdf2(ss.ck, nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+func hkdf2(ck, ikm []byte) ([]byte, []byte) {
+	tempKey := hmacSha256(ck, ikm)
+	out1 := hmacSha256(tempKey, []byte{0x01})
+	out2 := hmacSha256(tempKey, append(append([]byte{}, out1...), 0x02))
+	return out1, out2
+}
+
+func hmacSha256(key, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// Certificate is the SIGNATURE_NOISE_MESSAGE binding the server static key to the pool authority.
+type Certificate struct {
+	Version       uint16
+	ValidFrom     uint32
+	NotValidAfter uint32
+	Signature     [64]byte
+}
+
+func (c *Certificate) digest(staticKey *btcec.PublicKey) []byte {
+	buf := make([]byte, 10, 42)
+	binary.LittleEndian.PutUint16(buf[0:], c.Version)
+	binary.LittleEndian.PutUint32(buf[2:], c.ValidFrom)
+	binary.LittleEndian.PutUint32(buf[6:], c.NotValidAfter)
+	buf = append(buf, schnorr.SerializePubKey(staticKey)...)
+	h := sha256.Sum256(buf)
+	return h[:]
+}
+
+// NewCertificate signs staticKey with the authority key, valid from now on for validity.
+func NewCertificate(authority *btcec.PrivateKey, staticKey *btcec.PublicKey, validity time.Duration) (*Certificate, error) {
+	now := time.Now()
+	c := &Certificate{
+		Version:       0,
+		ValidFrom:     uint32(now.Unix()),
+		NotValidAfter: uint32(now.Add(validity).Unix()),
+	}
+	sig, err := schnorr.Sign(authority, c.digest(staticKey))
+	if err != nil {
+		return nil, err
+	}
+	copy(c.Signature[:], sig.Serialize())
+	return c, nil
+}
+
+func (c *Certificate) Verify(authority, staticKey *btcec.PublicKey, now time.Time) bool {
+	ts := uint32(now.Unix())
+	if ts < c.ValidFrom || ts > c.NotValidAfter {
+		return false
+	}
+	sig, err := schnorr.ParseSignature(c.Signature[:])
+	if err != nil {
+		return false
+	}
+	return sig.Verify(c.digest(staticKey), authority)
+}
+
+func (c *Certificate) Bytes() []byte {
+	buf := make([]byte, SignatureNoiseMessageSize)
+	binary.LittleEndian.PutUint16(buf[0:], c.Version)
+	binary.LittleEndian.PutUint32(buf[2:], c.ValidFrom)
+	binary.LittleEndian.PutUint32(buf[6:], c.NotValidAfter)
+	copy(buf[10:], c.Signature[:])
+	return buf
+}
+
+func ParseCertificate(b []byte) (*Certificate, error) {
+	if len(b) != SignatureNoiseMessageSize {
+		return nil, ErrInvalidCertificate
+	}
+	c := &Certificate{
+		Version:       binary.LittleEndian.Uint16(b[0:]),
+		ValidFrom:     binary.LittleEndian.Uint32(b[2:]),
+		NotValidAfter: binary.LittleEndian.Uint32(b[6:]),
+	}
+	copy(c.Signature[:], b[10:])
+	return c, nil
+}
+
+// Responder is the server side of the handshake.
+type Responder struct {
+	staticKey *btcec.PrivateKey
+	cert      *Certificate
+}
+
+func NewResponder(staticKey *btcec.PrivateKey, cert *Certificate) *Responder {
+	return &Responder{staticKey: staticKey, cert: cert}
+}
+
+// Respond consumes the initiator's act 1 and returns act 2 together with the
+// cipher states used to receive from and send to the initiator.
+func (r *Responder) Respond(act1 []byte) ([]byte, *CipherState, *CipherState, error) {
+	if len(act1) != Act1Size {
+		return nil, nil, nil, ErrInvalidMessageSize
+	}
+	ss := newSymmetricState()
+
+	// -> e
+	re := act1[:EllSwiftSize]
+	ss.mixHash(re)
+	if _, err := ss.decryptAndHash(nil); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// <- e
+	e, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ePub, err := EllSwiftEncode(e.PubKey())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	out := append([]byte{}, ePub...)
+	ss.mixHash(ePub)
+
+	// ee
+	ee, err := EllSwiftXDH(e, re, ePub, re)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ss.mixKey(ee)
+
+	// s
+	sPub, err := EllSwiftEncode(r.staticKey.PubKey())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c, err := ss.encryptAndHash(sPub)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	out = append(out, c...)
+
+	// es
+	es, err := EllSwiftXDH(r.staticKey, re, sPub, re)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ss.mixKey(es)
+
+	// SIGNATURE_NOISE_MESSAGE
+	c, err = ss.encryptAndHash(r.cert.Bytes())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	out = append(out, c...)
+
+	recv, send := ss.split()
+	return out, recv, send, nil
+}
+
+// Initiator is the client side of the handshake.
+type Initiator struct {
+	authority *btcec.PublicKey
+	ss        *symmetricState
+	e         *btcec.PrivateKey
+	ePub      []byte
+}
+
+// NewInitiator creates an initiator verifying the server certificate against
+// authority. A nil authority skips certificate verification.
+func NewInitiator(authority *btcec.PublicKey) *Initiator {
+	return &Initiator{authority: authority}
+}
+
+func (i *Initiator) Act1() ([]byte, error) {
+	var err error
+	i.ss = newSymmetricState()
+	i.e, err = btcec.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	i.ePub, err = EllSwiftEncode(i.e.PubKey())
+	if err != nil {
+		return nil, err
+	}
+	i.ss.mixHash(i.ePub)
+	if _, err = i.ss.encryptAndHash(nil); err != nil {
+		return nil, err
+	}
+	return i.ePub, nil
+}
+
+// Act2 consumes the responder's reply and returns the cipher states used to
+// send to and receive from the responder.
+func (i *Initiator) Act2(act2 []byte) (*CipherState, *CipherState, error) {
+	if len(act2) != Act2Size {
+		return nil, nil, ErrInvalidMessageSize
+	}
+	re := act2[:EllSwiftSize]
+	i.ss.mixHash(re)
+
+	ee, err := EllSwiftXDH(i.e, i.ePub, re, re)
+	if err != nil {
+		return nil, nil, err
+	}
+	i.ss.mixKey(ee)
+
+	off := EllSwiftSize
+	rs, err := i.ss.decryptAndHash(act2[off : off+EllSwiftSize+MacSize])
+	if err != nil {
+		return nil, nil, err
+	}
+	off += EllSwiftSize + MacSize
+
+	es, err := EllSwiftXDH(i.e, i.ePub, rs, rs)
+	if err != nil {
+		return nil, nil, err
+	}
+	i.ss.mixKey(es)
+
+	certBytes, err := i.ss.decryptAndHash(act2[off:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if i.authority != nil {
+		cert, err := ParseCertificate(certBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		staticKey, err := EllSwiftDecode(rs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !cert.Verify(i.authority, staticKey, time.Now()) {
+			return nil, nil, ErrInvalidCertificate
+		}
+	}
+
+	send, recv := i.ss.split()
+	return send, recv, nil
+}
@@ -0,0 +1,89 @@
+package noise
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestEllSwiftRoundTrip(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		priv, _ := btcec.NewPrivateKey()
+		enc, err := EllSwiftEncode(priv.PubKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := EllSwiftDecode(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pub.SerializeCompressed()[1:], priv.PubKey().SerializeCompressed()[1:]) {
+			t.Fatal("Decoded X coordinate must match the encoded key")
+		}
+	}
+}
+
+func TestXSwiftECAlwaysOnCurve(t *testing.T) {
+	for _, v := range [][2]int64{{0, 0}, {1, 1}, {0, 7}, {12345, 0}} {
+		x := xSwiftEC(big.NewInt(v[0]), big.NewInt(v[1]))
+		if x == nil || !isValidX(x) {
+			t.Errorf("xSwiftEC(%v, %v) must decode to a point on the curve", v[0], v[1])
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	authority, _ := btcec.NewPrivateKey()
+	static, _ := btcec.NewPrivateKey()
+	cert, err := NewCertificate(authority, static.PubKey(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiator := NewInitiator(authority.PubKey())
+	responder := NewResponder(static, cert)
+
+	act1, err := initiator.Act1()
+	if err != nil {
+		t.Fatal(err)
+	}
+	act2, rRecv, rSend, err := responder.Respond(act1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(act2) != Act2Size {
+		t.Fatalf("Act2 must be %v bytes, got %v", Act2Size, len(act2))
+	}
+	iSend, iRecv, err := initiator.Act2(act2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := iSend.Encrypt(nil, []byte("ping"))
+	p, err := rRecv.Decrypt(nil, c)
+	if err != nil || string(p) != "ping" {
+		t.Fatal("Responder must decrypt initiator message")
+	}
+	c, _ = rSend.Encrypt(nil, []byte("pong"))
+	p, err = iRecv.Decrypt(nil, c)
+	if err != nil || string(p) != "pong" {
+		t.Fatal("Initiator must decrypt responder message")
+	}
+}
+
+func TestHandshakeRejectsForeignAuthority(t *testing.T) {
+	authority, _ := btcec.NewPrivateKey()
+	other, _ := btcec.NewPrivateKey()
+	static, _ := btcec.NewPrivateKey()
+	cert, _ := NewCertificate(authority, static.PubKey(), time.Hour)
+
+	initiator := NewInitiator(other.PubKey())
+	act1, _ := initiator.Act1()
+	act2, _, _, _ := NewResponder(static, cert).Respond(act1)
+	if _, _, err := initiator.Act2(act2); err != ErrInvalidCertificate {
+		t.Errorf("Must reject certificate signed by another authority, got %v", err)
+	}
+}
@@ -108,8 +108,7 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 			return nil, err
 		}
 
-		blockNonceHex := fmt.Sprintf("%08x", block.Nonce)
-		if len(candidate.Nonce) > 0 && strings.EqualFold(candidate.Nonce, blockNonceHex) {
+		if candidateMatches(candidate, block) {
 			result.blocks++
 
 			err = u.handleBlock(block, candidate)
@@ -130,6 +129,17 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 	return result, nil
 }
 
+// candidateMatches tells whether block is the candidate. Candidates known by
+// hash, immature blocks and aux blocks, are matched by hash: the header nonce of
+// an aux block is not the one of the share that found it.
+func candidateMatches(candidate *storage.BlockData, block *rpc.GetBlockReply) bool {
+	if len(candidate.Hash) > 0 && candidate.Hash != "0x0" {
+		return strings.EqualFold(candidate.Hash, block.Hash)
+	}
+	blockNonceHex := fmt.Sprintf("%08x", block.Nonce)
+	return len(candidate.Nonce) > 0 && strings.EqualFold(candidate.Nonce, blockNonceHex)
+}
+
 func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) error {
 	reward := new(big.Int).Set(candidate.CoinBaseValue)
 	// Add TX fees
@@ -334,6 +344,10 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
 	revenue := new(big.Rat).SetInt(block.Reward)
+	if len(block.Solo) > 0 {
+		revenue, minersProfit, poolProfit, rewards := calculateSoloRewards(block)
+		return revenue, minersProfit, poolProfit, rewards, nil
+	}
 	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
 
 	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
@@ -365,6 +379,19 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 	return revenue, minersProfit, poolProfit, rewards, nil
 }
 
+// calculateSoloRewards attributes the reward of a solo block to its finder,
+// the pool only earns the fee output of the coinbase.
+func calculateSoloRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64) {
+	revenue := new(big.Rat).SetInt(block.Reward)
+	if block.ExtraReward != nil {
+		revenue.Add(revenue, new(big.Rat).SetInt(block.ExtraReward))
+	}
+	poolProfit := new(big.Rat).SetInt64(block.SoloFee)
+	minersProfit := new(big.Rat).Sub(revenue, poolProfit)
+	value, _ := strconv.ParseInt(minersProfit.FloatString(0), 10, 64)
+	return revenue, minersProfit, poolProfit, map[string]int64{block.Solo: value}
+}
+
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
 	rewards := make(map[string]int64)
 
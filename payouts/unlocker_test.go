@@ -4,6 +4,9 @@ import (
 	"math/big"
 	"os"
 	"testing"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
 )
 
 func TestMain(m *testing.M) {
@@ -49,3 +52,32 @@ func TestChargeFee(t *testing.T) {
 		t.Error("Must charge fee")
 	}
 }
+
+func TestCalculateSoloRewards(t *testing.T) {
+	block := &storage.BlockData{Solo: "finder", SoloFee: 1000, Reward: big.NewInt(625001000), ExtraReward: big.NewInt(500)}
+	revenue, minersProfit, poolProfit, rewards := calculateSoloRewards(block)
+
+	if revenue.Cmp(big.NewRat(625001500, 1)) != 0 || poolProfit.Cmp(big.NewRat(1000, 1)) != 0 || minersProfit.Cmp(big.NewRat(625000500, 1)) != 0 {
+		t.Errorf("Unexpected revenue %v, miners profit %v, pool profit %v", revenue, minersProfit, poolProfit)
+	}
+	if len(rewards) != 1 || rewards["finder"] != 625000500 {
+		t.Errorf("Solo block must be attributed to the finder only, got %v", rewards)
+	}
+}
+
+func TestCandidateMatches(t *testing.T) {
+	block := &rpc.GetBlockReply{Hash: "00000000000000000001aa", Nonce: 0x1a2b3c4d}
+	if !candidateMatches(&storage.BlockData{Nonce: "1a2b3c4d"}, block) {
+		t.Error("Candidate must match the block of its nonce")
+	}
+	if candidateMatches(&storage.BlockData{Nonce: "00000001"}, block) {
+		t.Error("Candidate must not match the block of another nonce")
+	}
+	// aux blocks keep the nonce of the share, not the one of their header
+	if !candidateMatches(&storage.BlockData{Nonce: "00000001", Hash: "00000000000000000001AA"}, block) {
+		t.Error("Candidate known by hash must match its block")
+	}
+	if candidateMatches(&storage.BlockData{Nonce: "1a2b3c4d", Hash: "00000000000000000001bb"}, block) {
+		t.Error("Candidate known by hash must not match another block")
+	}
+}
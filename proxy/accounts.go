@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Accounts let miners log in with a name instead of a payout address. The
+// account is kept in redis with its password hash and payout addresses, and
+// the session is credited to the payout address, so an address change only
+// takes a change of the account. The account password is the first word of
+// the mining.authorize password that is not an option, e.g. "secret,d=65536".
+// Stratum v2 channels carry no password, accounts with one only log in over v1.
+
+const defaultAccountCacheTTL = time.Minute
+
+// wrong passwords remembered per account, so that retries skip the hashing
+const maxRejectedPasswords = 16
+
+var accountPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,64}$")
+
+var (
+	errUnknownAccount = &ErrorReply{Code: -1, Message: "Unknown account"}
+	errWrongPassword  = &ErrorReply{Code: -1, Message: "Wrong password"}
+	errNoPassword     = &ErrorReply{Code: -1, Message: "Account has no password"}
+	// an empty password is refused without hashing, sv2 logins never have one
+	errPasswordRequired = &ErrorReply{Code: -1, Message: "Password required"}
+)
+
+type accounts struct {
+	backend         *storage.RedisClient
+	enforce         bool
+	allowNoPassword bool
+	ttl             time.Duration
+
+	mu sync.Mutex
+	// accounts looked up lately, password hashing is too slow to repeat for
+	// every miner of a farm that reconnects
+	cache map[string]*cachedAccount
+}
+
+type cachedAccount struct {
+	// nil for a name without account
+	account *storage.Account
+	// sha256 of the password last verified and of wrong ones
+	verified  [sha256.Size]byte
+	hasVerify bool
+	rejected  map[[sha256.Size]byte]bool
+	expires   time.Time
+}
+
+func newAccounts(cfg *Accounts, backend *storage.RedisClient) *accounts {
+	a := &accounts{backend: backend, enforce: cfg.Enforce, allowNoPassword: cfg.AllowNoPassword, ttl: defaultAccountCacheTTL,
+		cache: make(map[string]*cachedAccount)}
+	if len(cfg.CacheTTL) > 0 {
+		a.ttl = MustParseDuration(cfg.CacheTTL)
+	}
+	Info.Printf("Account logins enabled, enforced: %v", cfg.Enforce)
+	return a
+}
+
+// lookup returns the cache entry of name, nil if there is no such account.
+// Unknown names are cached too.
+func (a *accounts) lookup(name string) (*cachedAccount, error) {
+	a.mu.Lock()
+	c, ok := a.cache[name]
+	a.mu.Unlock()
+	if !ok || !time.Now().Before(c.expires) {
+		account, err := a.backend.GetAccount(name)
+		if err != nil {
+			return nil, err
+		}
+		c = &cachedAccount{account: account, expires: time.Now().Add(a.ttl)}
+		a.mu.Lock()
+		a.cache[name] = c
+		a.mu.Unlock()
+	}
+	if c.account == nil {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// authorize checks password and returns the payout address of account name,
+// payout if the miner chose one of the account addresses.
+func (a *accounts) authorize(name, password, payout string) (string, *ErrorReply) {
+	if !accountPattern.MatchString(name) {
+		return "", &ErrorReply{Code: -1, Message: "Invalid authorize"}
+	}
+	c, err := a.lookup(name)
+	if err != nil {
+		Error.Printf("Failed to fetch account %v from backend: %v", name, err)
+		return "", &ErrorReply{Code: 20, Message: "Other/Unknown"}
+	}
+	if c == nil {
+		return "", errUnknownAccount
+	}
+
+	account := c.account
+	if len(account.PasswordHash) == 0 {
+		if !a.allowNoPassword {
+			Error.Printf("Account %v has no password", name)
+			return "", errNoPassword
+		}
+	} else if errReply := a.verify(c, password); errReply != nil {
+		return "", errReply
+	}
+
+	if len(account.Addresses) == 0 {
+		Error.Printf("Account %v has no payout address", name)
+		return "", &ErrorReply{Code: -1, Message: "Account has no payout address"}
+	}
+	if len(payout) == 0 {
+		return account.Addresses[0], nil
+	}
+	for _, address := range account.Addresses {
+		if address == payout {
+			return payout, nil
+		}
+	}
+	return "", &ErrorReply{Code: -1, Message: "Invalid payout address"}
+}
+
+// verify checks password against the hash of c. Verified and wrong passwords
+// are remembered until c expires, hashing is only repeated for new ones.
+func (a *accounts) verify(c *cachedAccount, password string) *ErrorReply {
+	if len(password) == 0 {
+		return errPasswordRequired
+	}
+	sum := sha256.Sum256([]byte(password))
+	a.mu.Lock()
+	verified, rejected := c.hasVerify && c.verified == sum, c.rejected[sum]
+	a.mu.Unlock()
+	if verified {
+		return nil
+	}
+	if rejected {
+		return errWrongPassword
+	}
+
+	ok := verifyPassword(c.account.PasswordHash, password)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !ok {
+		if c.rejected == nil || len(c.rejected) >= maxRejectedPasswords {
+			c.rejected = make(map[[sha256.Size]byte]bool)
+		}
+		c.rejected[sum] = true
+		return errWrongPassword
+	}
+	c.verified, c.hasVerify = sum, true
+	return nil
+}
+
+// payoutAddress returns the payout address of account name for a session that
+// was credited to address, the first address if the account dropped it.
+func (a *accounts) payoutAddress(name, address string) (string, bool) {
+	c, err := a.lookup(name)
+	if err != nil {
+		Error.Printf("Failed to fetch account %v from backend: %v", name, err)
+		return "", false
+	}
+	if c == nil || len(c.account.Addresses) == 0 {
+		return "", false
+	}
+	for _, v := range c.account.Addresses {
+		if v == address {
+			return address, true
+		}
+	}
+	return c.account.Addresses[0], true
+}
+
+// forget drops name from the cache after its account changed.
+func (a *accounts) forget(name string) {
+	a.mu.Lock()
+	delete(a.cache, name)
+	a.mu.Unlock()
+}
+
+// minerPassword returns the first word of the mining.authorize password that is not an option.
+func minerPassword(password string) string {
+	for _, field := range strings.FieldsFunc(password, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t'
+	}) {
+		if !strings.Contains(field, "=") {
+			return field
+		}
+	}
+	return ""
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// verifyPassword checks password against a bcrypt hash or an argon2id hash in
+// the PHC format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+func verifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/PowPool/btcpool/storage"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argonHash := "$argon2id$v=19$m=1024,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32))
+
+	for _, hash := range []string{bcryptHash, argonHash} {
+		if !verifyPassword(hash, "secret") {
+			t.Errorf("Password must match %v", hash)
+		}
+		if verifyPassword(hash, "wrong") {
+			t.Errorf("Wrong password must not match %v", hash)
+		}
+	}
+	if verifyPassword("plain", "plain") || verifyPassword("$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA", "secret") {
+		t.Error("Unknown hash formats must not match")
+	}
+}
+
+func TestAccountAuthorize(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr1, addr2 := "bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03", "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+	a := &accounts{ttl: time.Minute, cache: map[string]*cachedAccount{
+		"farm": {account: &storage.Account{Name: "farm", PasswordHash: hash, Addresses: []string{addr1, addr2}}, expires: time.Now().Add(time.Minute)},
+	}}
+
+	if address, errReply := a.authorize("farm", "secret", ""); errReply != nil || address != addr1 {
+		t.Errorf("Account must pay out to its first address, got %v %v", address, errReply)
+	}
+	if address, errReply := a.authorize("farm", "secret", addr2); errReply != nil || address != addr2 {
+		t.Errorf("Miner may choose an address of the account, got %v %v", address, errReply)
+	}
+	if _, errReply := a.authorize("farm", "secret", "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"); errReply == nil {
+		t.Error("Payout address outside the account must be refused")
+	}
+	if _, errReply := a.authorize("farm", "wrong", ""); errReply != errWrongPassword {
+		t.Errorf("Wrong password must be refused, got %v", errReply)
+	}
+	if _, errReply := a.authorize("farm.w", "secret", ""); errReply == nil {
+		t.Error("Malformed account name must be refused")
+	}
+	if !a.cache["farm"].rejected[sha256.Sum256([]byte("wrong"))] {
+		t.Error("Wrong password must be remembered")
+	}
+	if _, errReply := a.authorize("farm", "", ""); errReply != errPasswordRequired {
+		t.Errorf("Empty password must be refused, got %v", errReply)
+	}
+
+	// unknown names are cached, the backend is not asked again
+	a.cache["ghost"] = &cachedAccount{expires: time.Now().Add(time.Minute)}
+	if _, errReply := a.authorize("ghost", "secret", ""); errReply != errUnknownAccount {
+		t.Errorf("Unknown account must be refused, got %v", errReply)
+	}
+
+	a.cache["open"] = &cachedAccount{account: &storage.Account{Name: "open", Addresses: []string{addr1}}, expires: time.Now().Add(time.Minute)}
+	if _, errReply := a.authorize("open", "", ""); errReply != errNoPassword {
+		t.Errorf("Account without password must be refused, got %v", errReply)
+	}
+	a.allowNoPassword = true
+	if address, errReply := a.authorize("open", "", ""); errReply != nil || address != addr1 {
+		t.Errorf("Account without password must be allowed by config, got %v %v", address, errReply)
+	}
+
+	// resumed sessions follow address changes of the account
+	s := &ProxyServer{accounts: a}
+	if address, ok := s.resumeAccount("farm", addr2); !ok || address != addr2 {
+		t.Errorf("Resumed session must keep an address of the account, got %v %v", address, ok)
+	}
+	a.cache["farm"].account.Addresses = []string{addr2}
+	if address, ok := s.resumeAccount("farm", addr1); !ok || address != addr2 {
+		t.Errorf("Resumed session must move to the new address, got %v %v", address, ok)
+	}
+	if _, ok := s.resumeAccount("", addr1); ok {
+		t.Error("Session without account must authorize again")
+	}
+
+	if password := minerPassword("d=65536, secret ,x"); password != "secret" {
+		t.Errorf("Unexpected password %q", password)
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// The admin interface calls the miners of a session or of a login, and
+// writes the accounts miners log in with:
+//
+//	GET  /admin/sessions?login=...                  connected sessions with their versions
+//	POST /admin/sessions/{sid}/{message|version|ping}
+//	POST /admin/logins/{login}/{message|version|ping}
+//	PUT  /admin/accounts/{name}                     {"password":"...","addresses":["..."]}
+//
+// message takes {"message":"..."} as body. Versions and ping round trips are
+// reported by the session list once the miners replied.
+
+const adminMaxMessageSize = 512
+
+type adminSession struct {
+	Sid     string `json:"sid"`
+	Login   string `json:"login"`
+	Account string `json:"account,omitempty"`
+	Id      string `json:"id"`
+	Ip      string `json:"ip"`
+	Port    string `json:"port,omitempty"`
+	Version string `json:"version,omitempty"`
+	// milliseconds, zero until the miner answered a ping
+	PingRTT float64 `json:"pingRtt,omitempty"`
+}
+
+func (s *ProxyServer) ListenAdmin() {
+	cfg := &s.config.Proxy.Admin
+	Info.Printf("Starting admin interface on %v", cfg.Listen)
+	err := http.ListenAndServe(cfg.Listen, s.adminRouter())
+	if err != nil {
+		Error.Fatalf("Failed to start admin interface: %v", err)
+	}
+}
+
+func (s *ProxyServer) adminRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/sessions", s.adminSessions).Methods("GET")
+	r.HandleFunc("/admin/{by:sessions|logins}/{key}/{call:message|version|ping}", s.adminCall).Methods("POST")
+	r.HandleFunc("/admin/accounts/{name}", s.adminWriteAccount).Methods("PUT")
+	return s.adminAuth(r)
+}
+
+func (s *ProxyServer) adminAuth(next http.Handler) http.Handler {
+	token := s.config.Proxy.Admin.Token
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(token) == 0 || !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *ProxyServer) adminSessions(w http.ResponseWriter, r *http.Request) {
+	login := r.URL.Query().Get("login")
+	reply := make([]adminSession, 0)
+	for _, cs := range s.sessionList() {
+		cs.Lock()
+		if len(login) == 0 || cs.login == login {
+			v := adminSession{Sid: cs.sid, Login: cs.login, Account: cs.account, Id: cs.id, Ip: cs.ip, Version: cs.version}
+			if cs.port != nil && cs.port.cfg != nil {
+				v.Port = cs.port.cfg.Listen
+			}
+			if cs.pingSupported {
+				v.PingRTT = float64(cs.pingRTT) / float64(time.Millisecond)
+			}
+			reply = append(reply, v)
+		}
+		cs.Unlock()
+	}
+	writeAdminReply(w, http.StatusOK, reply)
+}
+
+func (s *ProxyServer) adminCall(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var message string
+	if vars["call"] == "message" {
+		var body struct {
+			Message string `json:"message"`
+		}
+		err := json.NewDecoder(io.LimitReader(r.Body, 4*adminMaxMessageSize)).Decode(&body)
+		if err != nil || len(body.Message) == 0 || len(body.Message) > adminMaxMessageSize {
+			writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "message required, at most 512 bytes"})
+			return
+		}
+		message = body.Message
+	}
+
+	var sessions []*Session
+	for _, cs := range s.sessionList() {
+		cs.Lock()
+		match := cs.isAuth && (vars["by"] == "sessions" && cs.sid == vars["key"] || vars["by"] == "logins" && cs.login == vars["key"])
+		cs.Unlock()
+		if match {
+			sessions = append(sessions, cs)
+		}
+	}
+	if len(sessions) == 0 {
+		writeAdminReply(w, http.StatusNotFound, map[string]string{"error": "no session"})
+		return
+	}
+
+	called := 0
+	for _, cs := range sessions {
+		var err error
+		switch vars["call"] {
+		case "message":
+			err = cs.showMessage(message)
+		case "version":
+			err = cs.getVersion()
+		case "ping":
+			err = s.ping(cs, s.pingTimeout)
+		}
+		if err != nil {
+			Error.Printf("Admin %v call to %v.%v@%v failed: %v", vars["call"], cs.login, cs.id, cs.ip, err)
+			continue
+		}
+		called++
+	}
+	Info.Printf("Admin %v call to %v %v reached %v of %v sessions", vars["call"], vars["by"], vars["key"], called, len(sessions))
+	writeAdminReply(w, http.StatusOK, map[string]int{"sessions": called})
+}
+
+// adminWriteAccount creates or replaces an account, the password is stored as a bcrypt hash.
+func (s *ProxyServer) adminWriteAccount(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var body struct {
+		Password  string   `json:"password"`
+		Addresses []string `json:"addresses"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "malformed account"})
+		return
+	}
+	if !accountPattern.MatchString(name) || len(body.Addresses) == 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "account name and addresses required"})
+		return
+	}
+	for _, address := range body.Addresses {
+		if !IsValidBTCAddress(address) {
+			writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "invalid address " + address})
+			return
+		}
+	}
+
+	account := &storage.Account{Name: name, Addresses: body.Addresses}
+	if len(body.Password) > 0 {
+		hash, err := hashPassword(body.Password)
+		if err != nil {
+			writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		account.PasswordHash = hash
+	}
+	if err := s.backend.WriteAccount(account); err != nil {
+		Error.Printf("Failed to write account %v to backend: %v", name, err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": "backend error"})
+		return
+	}
+	if s.accounts != nil {
+		s.accounts.forget(name)
+	}
+	Info.Printf("Admin wrote account %v paying out to %v", name, body.Addresses)
+	writeAdminReply(w, http.StatusOK, map[string]string{"account": name})
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(reply)
+}
@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Merged mining: the coinbase of the pool jobs commits to the blocks of the aux
+// chains with the merkle root of their hashes. The slot of each chain in the
+// tree follows from its chain id and the nonce of the commitment. A share whose
+// hash meets the target of an aux block proves the work on it with an AuxPoW:
+// the coinbase, its merkle branch, the branch of the aux block to the root and
+// the share header.
+
+const (
+	defaultAuxRefreshInterval = time.Second
+	defaultAuxBlockTimeout    = time.Minute
+	// the aux merkle tree has at most 2^auxMaxTreeHeight slots
+	auxMaxTreeHeight = 8
+	// nonces tried per tree size to give every chain a slot of its own
+	auxMaxNonce = 1024
+)
+
+var auxMagic = []byte{0xfa, 0xbe, 0x6d, 0x6d}
+
+type auxChain struct {
+	cfg *AuxChain
+	rpc *rpc.RPCClient
+	// records the blocks of the chain under its coin
+	backend *storage.RedisClient
+	// how long the last block is kept while the chain fails
+	blockTimeout time.Duration
+
+	mu      sync.Mutex
+	last    *auxBlock
+	fetched time.Time
+}
+
+// auxBlock is a block of an aux chain to be mined.
+type auxBlock struct {
+	chain         *auxChain
+	hash          string
+	chainId       uint32
+	height        int64
+	coinBaseValue int64
+	difficulty    *big.Int
+	// slot of the block in the aux merkle tree and its branch to the root
+	index  uint32
+	branch [][]byte
+}
+
+// auxWork is the set of aux blocks the coinbase of a job commits to.
+type auxWork struct {
+	blocks []*auxBlock
+	// magic, merkle root, tree size and nonce
+	commitment []byte
+}
+
+func (s *ProxyServer) initMergedMining(cfg *MergedMining) {
+	blockTimeout := defaultAuxBlockTimeout
+	if len(cfg.BlockTimeout) > 0 {
+		blockTimeout = MustParseDuration(cfg.BlockTimeout)
+	}
+	for i := range cfg.Chains {
+		c := &cfg.Chains[i]
+		if len(c.Coin) == 0 || c.Coin == s.config.Coin {
+			Error.Fatalf("Aux chain %v needs a coin of its own", c.Url)
+		}
+		chain := &auxChain{cfg: c, rpc: rpc.NewRPCClient(c.Coin, c.Url, c.Timeout), backend: storage.NewRedisClient(&s.config.Redis, c.Coin),
+			blockTimeout: blockTimeout}
+		s.auxChains = append(s.auxChains, chain)
+		Info.Printf("Aux chain: %s => %s", c.Coin, c.Url)
+	}
+}
+
+func (s *ProxyServer) currentAuxWork() *auxWork {
+	if w := s.auxWork.Load(); w != nil {
+		return w.(*auxWork)
+	}
+	return nil
+}
+
+// fetchAuxBlocks fetches the blocks of the aux chains, jobs are refreshed when one changed.
+func (s *ProxyServer) fetchAuxBlocks() {
+	var blocks []*auxBlock
+	now := time.Now()
+	for _, c := range s.auxChains {
+		reply, err := c.rpc.CreateAuxBlock(c.cfg.Address)
+		if err == nil && reply == nil {
+			err = errors.New("empty reply")
+		}
+		if b := c.block(reply, err, now); b != nil {
+			blocks = append(blocks, b)
+		}
+	}
+
+	if w := s.currentAuxWork(); w != nil && w.sameBlocks(blocks) {
+		return
+	}
+	work, err := newAuxWork(blocks)
+	if err != nil {
+		Error.Printf("Error while building aux merkle tree: %v", err)
+		return
+	}
+	s.auxWork.Store(work)
+	for _, b := range blocks {
+		Info.Printf("NEW aux block on %s at height %d / %s", b.chain.cfg.Coin, b.height, b.hash)
+	}
+	if s.currentBlockTemplate() != nil {
+		s.fetchBlockTemplate()
+	}
+}
+
+// block returns the block to mine on c from a createauxblock reply. A chain
+// that fails keeps its last block until that is found or times out, so that
+// transient errors don't rebuild the jobs twice.
+func (c *auxChain) block(reply *rpc.AuxBlockReply, err error, now time.Time) *auxBlock {
+	var diff *big.Int
+	if err != nil {
+		Error.Printf("Error while fetching aux block on %s: %v", c.cfg.Coin, err)
+	} else if diff, err = compactToDiff(reply.Bits); err != nil {
+		Error.Printf("Invalid aux block bits %v on %s: %v", reply.Bits, c.cfg.Coin, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.last = &auxBlock{chain: c, hash: reply.Hash, chainId: reply.ChainId, height: reply.Height,
+			coinBaseValue: reply.CoinBaseValue, difficulty: diff}
+		c.fetched = now
+	} else if c.last != nil && now.Sub(c.fetched) > c.blockTimeout {
+		Error.Printf("Dropping aux block on %s at height %d, no new block for %v", c.cfg.Coin, c.last.height, now.Sub(c.fetched))
+		c.last = nil
+	}
+	if c.last == nil {
+		return nil
+	}
+	// the work places its blocks in the tree, the last one stays untouched
+	b := *c.last
+	return &b
+}
+
+// found drops the last block of c once hash is mined, it is stale.
+func (c *auxChain) found(hash string) {
+	c.mu.Lock()
+	if c.last != nil && c.last.hash == hash {
+		c.last = nil
+	}
+	c.mu.Unlock()
+}
+
+func (w *auxWork) sameBlocks(blocks []*auxBlock) bool {
+	if len(w.blocks) != len(blocks) {
+		return false
+	}
+	for i, b := range blocks {
+		if w.blocks[i].chain != b.chain || w.blocks[i].hash != b.hash {
+			return false
+		}
+	}
+	return true
+}
+
+// coinBaseCommitment returns the commitment of w, nil without aux blocks.
+func (w *auxWork) coinBaseCommitment() []byte {
+	if w == nil {
+		return nil
+	}
+	return w.commitment
+}
+
+// auxSlot is the slot of chainId in a tree of height h, as aux chains expect it.
+func auxSlot(nonce, chainId uint32, h uint) uint32 {
+	rand := nonce*1103515245 + 12345
+	rand += chainId
+	rand = rand*1103515245 + 12345
+	return rand % (1 << h)
+}
+
+// newAuxWork places blocks in the smallest aux merkle tree that has a slot for
+// each of them and computes the commitment to its root.
+func newAuxWork(blocks []*auxBlock) (*auxWork, error) {
+	w := &auxWork{blocks: blocks}
+	if len(blocks) == 0 {
+		return w, nil
+	}
+	for i, b := range blocks {
+		for _, o := range blocks[:i] {
+			if o.chainId == b.chainId {
+				return nil, fmt.Errorf("aux chains %s and %s share chain id %d", o.chain.cfg.Coin, b.chain.cfg.Coin, b.chainId)
+			}
+		}
+	}
+
+	for h := uint(0); h <= auxMaxTreeHeight; h++ {
+		size := 1 << h
+		if size < len(blocks) {
+			continue
+		}
+		for nonce := uint32(0); nonce < auxMaxNonce; nonce++ {
+			slots := make(map[uint32]bool)
+			for _, b := range blocks {
+				b.index = auxSlot(nonce, b.chainId, h)
+				slots[b.index] = true
+			}
+			if len(slots) == len(blocks) {
+				root, err := w.buildTree(size)
+				if err != nil {
+					return nil, err
+				}
+				// the root is committed in display byte order
+				w.commitment = append(append([]byte{}, auxMagic...), reverseBytes(root)...)
+				w.commitment = binary.LittleEndian.AppendUint32(w.commitment, uint32(size))
+				w.commitment = binary.LittleEndian.AppendUint32(w.commitment, nonce)
+				return w, nil
+			}
+		}
+	}
+	return nil, errors.New("no aux merkle tree gives every chain a slot")
+}
+
+// buildTree hashes the aux merkle tree of size slots, it sets the branch of
+// each block and returns the root.
+func (w *auxWork) buildTree(size int) ([]byte, error) {
+	level := make([][]byte, size)
+	for i := range level {
+		level[i] = make([]byte, 32)
+	}
+	for _, b := range w.blocks {
+		var hash bigint.Uint256
+		if err := hash.SetHex(b.hash); err != nil {
+			return nil, fmt.Errorf("invalid aux block hash %s: %v", b.hash, err)
+		}
+		level[b.index] = hash.GetData()
+		b.branch = nil
+	}
+	for len(level) > 1 {
+		for _, b := range w.blocks {
+			pos := b.index >> uint(len(b.branch))
+			b.branch = append(b.branch, level[pos^1])
+		}
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = utility.Sha256(utility.Sha256(append(append([]byte{}, level[2*i]...), level[2*i+1]...)))
+		}
+		level = next
+	}
+	return level[0], nil
+}
+
+// auxPow serializes the proof of work of b: the parent coinbase with its merkle
+// branch, the branch of b in the aux merkle tree and the parent header.
+func (b *auxBlock) auxPow(coinBaseTx []byte, merkleBranch []string, header []byte) (string, error) {
+	bytesBuf := bytes.NewBuffer([]byte{})
+	writer := io.Writer(bytesBuf)
+
+	_, _ = writer.Write(coinBaseTx)
+	_, _ = writer.Write(utility.Sha256(utility.Sha256(header)))
+	if err := serialize.PackCompactSize(writer, uint64(len(merkleBranch))); err != nil {
+		return "", err
+	}
+	for _, h := range merkleBranch {
+		var hash bigint.Uint256
+		if err := hash.SetHex(h); err != nil {
+			return "", err
+		}
+		_, _ = writer.Write(hash.GetData())
+	}
+	// the coinbase is the first transaction
+	if err := serialize.PackInt32(writer, 0); err != nil {
+		return "", err
+	}
+
+	if err := serialize.PackCompactSize(writer, uint64(len(b.branch))); err != nil {
+		return "", err
+	}
+	for _, h := range b.branch {
+		_, _ = writer.Write(h)
+	}
+	if err := serialize.PackInt32(writer, int32(b.index)); err != nil {
+		return "", err
+	}
+
+	_, _ = writer.Write(header)
+	return hex.EncodeToString(bytesBuf.Bytes()), nil
+}
+
+// submitAuxBlocks submits the aux blocks of work whose target the share meets.
+// Their round is the pool round, the finder credited with the share.
+func (s *ProxyServer) submitAuxBlocks(work *auxWork, share *Block, h *BlockTemplateJob, login, id, ip string, shareDiff int64, params []string) {
+	var coinBaseTx, header []byte
+	found := false
+	for _, b := range work.blocks {
+		if header == nil {
+			var err error
+			coinBaseTx, header, err = packBlockHeader(share)
+			if err != nil {
+				Error.Printf("Failed to pack share header of %v.%v@%v for aux blocks: %v", login, id, ip, err)
+				return
+			}
+		}
+		if headerHashDiff(header).Cmp(b.difficulty) <= 0 {
+			continue
+		}
+		found = true
+		coin := b.chain.cfg.Coin
+
+		auxPow, err := b.auxPow(coinBaseTx, h.MerkleBranch, header)
+		if err != nil {
+			Error.Printf("Failed to build AuxPoW for %s block %v: %v", coin, b.height, err)
+			continue
+		}
+		accepted, err := b.chain.rpc.SubmitAuxBlock(b.hash, auxPow)
+		if err == nil && !accepted {
+			err = errors.New("rejected")
+		}
+		if err != nil {
+			Error.Printf("Aux block submission failure on %s at height %v for %v: %v", coin, b.height, b.hash, err)
+			BlockLog.Printf("Aux block submission failure on %s at height %v for %v: %v", coin, b.height, b.hash, err)
+			continue
+		}
+		b.chain.found(b.hash)
+
+		shares, err := s.backend.GetCurrentRoundShares()
+		if err != nil {
+			Error.Printf("Failed to get round shares for %s block %v: %v", coin, b.height, err)
+			shares = make(map[string]int64)
+		}
+		shares[login] += shareDiff
+		exist, err := b.chain.backend.WriteAuxBlock(login, params, b.difficulty.Int64(), uint64(b.height), b.coinBaseValue, b.hash, shares)
+		if exist {
+			continue
+		}
+		if err != nil {
+			Error.Printf("Failed to insert %s block candidate into backend: %v", coin, err)
+			BlockLog.Printf("Failed to insert %s block candidate into backend: %v", coin, err)
+		} else {
+			Info.Printf("Inserted %s block %v to backend", coin, b.height)
+			BlockLog.Printf("Inserted %s block %v to backend", coin, b.height)
+		}
+		Info.Printf("Aux block found on %s by miner %v@%v at height %d", coin, login, ip, b.height)
+		BlockLog.Printf("Aux block found on %s by miner %v@%v at height %d", coin, login, ip, b.height)
+	}
+	if found {
+		go s.fetchAuxBlocks()
+	}
+}
+
+// compactToDiff returns the difficulty of the compact target bits in hex.
+func compactToDiff(bits string) (*big.Int, error) {
+	n, err := strconv.ParseUint(bits, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	exponent := uint(n >> 24)
+	target := big.NewInt(int64(n & 0x007fffff))
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if target.Sign() == 0 {
+		return nil, errors.New("zero target")
+	}
+	return TargetHexToDiff(hexutil.Encode(target.Bytes())), nil
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[i] = b[len(b)-1-i]
+	}
+	return r
+}
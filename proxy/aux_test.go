@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+
+	"github.com/PowPool/btcpool/rpc"
+	. "github.com/PowPool/btcpool/util"
+)
+
+func TestAuxWork(t *testing.T) {
+	single := &auxBlock{chain: &auxChain{cfg: &AuxChain{Coin: "fb"}}, hash: "00000000000000000002c4b4a45b4f6ffa3fc2dc36d8b1dc9e1d1b2c5b3e1a10", chainId: 8228}
+	w, err := newAuxWork([]*auxBlock{single})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single chain is the root of a tree of one slot
+	expected, _ := hex.DecodeString("fabe6d6d" + single.hash + "01000000" + "00000000")
+	if !bytes.Equal(w.coinBaseCommitment(), expected) || len(single.branch) != 0 {
+		t.Errorf("Unexpected commitment %x", w.coinBaseCommitment())
+	}
+
+	blocks := []*auxBlock{
+		{chain: &auxChain{cfg: &AuxChain{Coin: "fb"}}, hash: single.hash, chainId: 8228},
+		{chain: &auxChain{cfg: &AuxChain{Coin: "nmc"}}, hash: "000000000000000000a1b2c3d4e5f60718293a4b5c6d7e8f9011223344556677", chainId: 1},
+		{chain: &auxChain{cfg: &AuxChain{Coin: "syscoin"}}, hash: "0000000000000000000f0e0d0c0b0a09080706050403020100ffeeddccbbaa99", chainId: 57},
+	}
+	w, err = newAuxWork(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment := w.coinBaseCommitment()
+	if len(commitment) != 44 || !bytes.Equal(commitment[:4], auxMagic) {
+		t.Fatalf("Unexpected commitment %x", commitment)
+	}
+	size := uint32(commitment[36]) | uint32(commitment[37])<<8
+	nonce := uint32(commitment[40]) | uint32(commitment[41])<<8
+	for _, b := range blocks {
+		if 1<<uint(len(b.branch)) != size || b.index != auxSlot(nonce, b.chainId, uint(len(b.branch))) {
+			t.Errorf("Block of chain %v is not in its slot", b.chainId)
+		}
+		var hash bigint.Uint256
+		_ = hash.SetHex(b.hash)
+		root := hash.GetData()
+		for i, sibling := range b.branch {
+			if b.index>>uint(i)&1 == 1 {
+				root = utility.Sha256(utility.Sha256(append(append([]byte{}, sibling...), root...)))
+			} else {
+				root = utility.Sha256(utility.Sha256(append(append([]byte{}, root...), sibling...)))
+			}
+		}
+		if !bytes.Equal(reverseBytes(root), commitment[4:36]) {
+			t.Errorf("Branch of chain %v does not lead to the committed root", b.chainId)
+		}
+	}
+
+	if _, err := newAuxWork([]*auxBlock{blocks[0], {chain: blocks[1].chain, hash: blocks[1].hash, chainId: 8228}}); err == nil {
+		t.Error("Chains sharing a chain id must be refused")
+	}
+}
+
+func TestAuxChainKeepsLastBlock(t *testing.T) {
+	c := &auxChain{cfg: &AuxChain{Coin: "nmc"}, blockTimeout: time.Minute}
+	now := time.Unix(1700000000, 0)
+	reply := &rpc.AuxBlockReply{Hash: "000000000000000000a1b2c3d4e5f60718293a4b5c6d7e8f9011223344556677", ChainId: 1, Bits: "1d00ffff"}
+	failure := errors.New("connection refused")
+
+	if b := c.block(nil, failure, now); b != nil {
+		t.Error("Chain without a block must be left out")
+	}
+	first := c.block(reply, nil, now)
+	if first == nil || first.hash != reply.Hash {
+		t.Fatalf("Fetched block must be mined, got %+v", first)
+	}
+	if b := c.block(nil, failure, now.Add(30*time.Second)); b == nil || b.hash != reply.Hash || b == first {
+		t.Error("Failing chain must keep a copy of its last block")
+	}
+	if b := c.block(nil, failure, now.Add(2*time.Minute)); b != nil {
+		t.Error("Last block must be dropped once it times out")
+	}
+
+	c.block(reply, nil, now)
+	c.found(reply.Hash)
+	if b := c.block(nil, failure, now); b != nil {
+		t.Error("Found block must not be mined again")
+	}
+}
+
+func TestAuxPow(t *testing.T) {
+	b := &auxBlock{hash: "00000000000000000002c4b4a45b4f6ffa3fc2dc36d8b1dc9e1d1b2c5b3e1a10", index: 1, branch: [][]byte{make([]byte, 32)}}
+	coinBaseTx := bytes.Repeat([]byte{0x01}, 120)
+	header := bytes.Repeat([]byte{0x02}, 80)
+	merkleBranch := []string{
+		"1111111111111111111111111111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222222222222222222222222222",
+	}
+	auxPowHex, err := b.auxPow(coinBaseTx, merkleBranch, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auxPow, _ := hex.DecodeString(auxPowHex)
+	if len(auxPow) != 120+32+1+2*32+4+1+32+4+80 {
+		t.Fatalf("Unexpected AuxPoW size %v", len(auxPow))
+	}
+	if !bytes.Equal(auxPow[:120], coinBaseTx) || !bytes.Equal(auxPow[120:152], utility.Sha256(utility.Sha256(header))) {
+		t.Error("AuxPoW must start with the coinbase and the parent hash")
+	}
+	if auxPow[152] != 2 || !bytes.Equal(auxPow[len(auxPow)-84:len(auxPow)-80], []byte{1, 0, 0, 0}) {
+		t.Error("AuxPoW must hold the coinbase branch and the chain index")
+	}
+	if !bytes.Equal(auxPow[len(auxPow)-80:], header) {
+		t.Error("AuxPoW must end with the parent header")
+	}
+}
+
+func TestCompactToDiff(t *testing.T) {
+	diff, err := compactToDiff("1d00ffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := TargetHexToDiff("00000000ffff0000000000000000000000000000000000000000000000000000"); diff.Cmp(expected) != 0 {
+		t.Errorf("Expected %v, got %v", expected, diff)
+	}
+	if _, err := compactToDiff("1d000000"); err == nil {
+		t.Error("Zero target must be refused")
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+
+	. "github.com/PowPool/btcpool/util"
+	"github.com/PowPool/btcpool/zmq"
+)
+
+const (
+	zmqHashBlock = "hashblock"
+	zmqRawBlock  = "rawblock"
+
+	defaultZmqRetryInterval = 5 * time.Second
+)
+
+// blockNotifier subscribes to the new blocks published by the node of an upstream.
+type blockNotifier struct {
+	upstream int32
+	addr     string
+	topic    string
+	timeout  time.Duration
+	// set while subscribed
+	connected int32
+}
+
+func (s *ProxyServer) initBlockNotifiers(upstreams []Upstream) {
+	s.blockNotify = make(chan struct{}, 1)
+	for i, u := range upstreams {
+		for topic, addr := range map[string]string{zmqHashBlock: u.ZmqHashBlock, zmqRawBlock: u.ZmqRawBlock} {
+			if len(addr) == 0 {
+				continue
+			}
+			n := &blockNotifier{upstream: int32(i), addr: addr, topic: topic, timeout: MustParseDuration(u.Timeout)}
+			s.blockNotifiers = append(s.blockNotifiers, n)
+			Info.Printf("Upstream %s notifies %s at %s", u.Name, topic, addr)
+			go s.subscribeBlocks(n)
+		}
+	}
+}
+
+// blockNotified tells whether the current upstream notifies new blocks.
+func (s *ProxyServer) blockNotified() bool {
+	upstream := atomic.LoadInt32(&s.upstream)
+	for _, n := range s.blockNotifiers {
+		if n.upstream == upstream && atomic.LoadInt32(&n.connected) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// blockTemplateExpired tells whether the block template is due for a refresh.
+func (s *ProxyServer) blockTemplateExpired(blkTplIntv time.Duration) bool {
+	t := s.currentBlockTemplate()
+	return t == nil || MakeTimestamp()/1000-t.updateTime >= int64(blkTplIntv.Seconds())
+}
+
+// subscribeBlocks keeps a subscription to the node of n, resubscribing after failures.
+func (s *ProxyServer) subscribeBlocks(n *blockNotifier) {
+	for {
+		sub, err := zmq.Dial(n.addr, n.timeout, n.topic)
+		if err != nil {
+			Error.Printf("Failed to subscribe to %s at %s: %v", n.topic, n.addr, err)
+			time.Sleep(defaultZmqRetryInterval)
+			continue
+		}
+		atomic.StoreInt32(&n.connected, 1)
+		Info.Printf("Subscribed to %s at %s", n.topic, n.addr)
+
+		for {
+			msg, err := sub.ReadMessage()
+			if err != nil {
+				Error.Printf("Lost %s subscription at %s: %v", n.topic, n.addr, err)
+				break
+			}
+			hash, ok := notifiedBlockHash(msg)
+			if !ok || string(msg[0]) != n.topic || n.upstream != atomic.LoadInt32(&s.upstream) {
+				continue
+			}
+			Info.Printf("New block %s notified at %s", hash, n.addr)
+			// a pending notification covers this one
+			select {
+			case s.blockNotify <- struct{}{}:
+			default:
+			}
+		}
+		atomic.StoreInt32(&n.connected, 0)
+		_ = sub.Close()
+		time.Sleep(defaultZmqRetryInterval)
+	}
+}
+
+// notifiedBlockHash returns the hash of the block of a hashblock or rawblock message.
+func notifiedBlockHash(msg [][]byte) (string, bool) {
+	if len(msg) < 2 {
+		return "", false
+	}
+	switch string(msg[0]) {
+	case zmqHashBlock:
+		if len(msg[1]) != 32 {
+			return "", false
+		}
+		// published in display byte order
+		return hex.EncodeToString(msg[1]), true
+	case zmqRawBlock:
+		if len(msg[1]) < 80 {
+			return "", false
+		}
+		return hex.EncodeToString(reverseBytes(utility.Sha256(utility.Sha256(msg[1][:80])))), true
+	}
+	return "", false
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PowPool/btcpool/zmq"
+)
+
+func TestNotifiedBlockHash(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+	if h, ok := notifiedBlockHash([][]byte{[]byte("hashblock"), hash, {1, 0, 0, 0}}); !ok || h != "abababababababababababababababababababababababababababababababab" {
+		t.Errorf("Unexpected hashblock hash %v", h)
+	}
+	// genesis header
+	header, _ := hex.DecodeString("0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c")
+	if h, ok := notifiedBlockHash([][]byte{[]byte("rawblock"), append(header, 0x01)}); !ok || h != "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f" {
+		t.Errorf("Unexpected rawblock hash %v", h)
+	}
+	if _, ok := notifiedBlockHash([][]byte{[]byte("rawtx"), header}); ok {
+		t.Error("Only block messages must be accepted")
+	}
+}
+
+func TestBlockNotify(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pubs := make(chan *zmq.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		pub, err := zmq.NewConn(conn, "PUB")
+		if err != nil {
+			return
+		}
+		// wait for the subscription
+		if _, err := pub.ReadMessage(); err == nil {
+			pubs <- pub
+		}
+	}()
+
+	s := &ProxyServer{}
+	s.initBlockNotifiers([]Upstream{{Name: "main", Timeout: "1s", ZmqHashBlock: "tcp://" + ln.Addr().String()}})
+	var pub *zmq.Conn
+	select {
+	case pub = <-pubs:
+	case <-time.After(time.Second):
+		t.Fatal("No subscription")
+	}
+	defer pub.Close()
+	for i := 0; i < 100 && !s.blockNotified(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.blockNotified() {
+		t.Fatal("Subscribed upstream must notify blocks")
+	}
+
+	if err := pub.WriteMessage([]byte("hashblock"), bytes.Repeat([]byte{0x01}, 32), []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.blockNotify:
+	case <-time.After(time.Second):
+		t.Fatal("New block must trigger a block template refresh")
+	}
+
+	// only the current upstream refreshes the block template
+	atomic.StoreInt32(&s.upstream, 1)
+	if s.blockNotified() {
+		t.Error("Backup upstream subscription must not count")
+	}
+	_ = pub.WriteMessage([]byte("hashblock"), bytes.Repeat([]byte{0x02}, 32), []byte{1, 0, 0, 0})
+	select {
+	case <-s.blockNotify:
+		t.Error("Blocks of a backup upstream must be ignored")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
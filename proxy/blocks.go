@@ -3,6 +3,8 @@ package proxy
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/PowPool/btcpool/rpc"
 	. "github.com/PowPool/btcpool/util"
@@ -13,21 +15,38 @@ import (
 	"io"
 	"math/big"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type BlockTemplateJob struct {
 	BlkTplJobId              string
 	BlkTplJobTime            uint32
+	MinTime                  uint32 // mintime of the template
+	MaxTime                  uint32 // maxtime of the template, zero if not given
 	TxIdList                 []string
 	MerkleBranch             []string
 	CoinBase1                string
 	CoinBase2                string
+	CoinBase1BySize          map[int]string // coinbase1 of non default extra nonce sizes
 	CoinBaseValue            int64
+	CoinBaseAuxFlags         string // coinbaseaux flags, solo coinbases are built with them
 	JobTxsFeeTotal           int64
 	DefaultWitnessCommitment string
+	// aux blocks the coinbase commits to, nil without merged mining
+	AuxWork *auxWork
+	// EmptyDeadline ends the window a coinbase-only job may find blocks in, zero for template jobs
+	EmptyDeadline time.Time
 }
 
+// The next block may change difficulty or subsidy at these heights, the empty
+// job would have to guess them.
+const (
+	retargetInterval = 2016
+	halvingInterval  = 210000
+)
+
 type BlockTemplate struct {
 	sync.RWMutex
 	Version        uint32
@@ -41,6 +60,8 @@ type BlockTemplate struct {
 	updateTime     int64
 	newBlkTpl      bool
 	lastBlkTplId   string
+	// longpollid of the template the last job was built from
+	longPollId string
 }
 
 type Block struct {
@@ -68,8 +89,17 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	// No need to update, we have had fresh job
 	blkTplIntv := MustParseDuration(s.config.Proxy.BlockTemplateInterval)
 	t := s.currentBlockTemplate()
+	if t != nil && t.PrevHash != prevBlockHash && s.emptyJobWindow > 0 {
+		// miners leave the stale tip before getblocktemplate returns
+		s.pushEmptyJob(rpcClient, t, prevBlockHash)
+		t = s.currentBlockTemplate()
+	}
+	auxWork := s.currentAuxWork()
 	if t != nil && t.PrevHash == prevBlockHash && (MakeTimestamp()/1000-t.updateTime < int64(blkTplIntv.Seconds())) {
-		return
+		// jobs are rebuilt for new aux blocks and to replace the empty job
+		if job := t.BlockTplJobMap[t.lastBlkTplId]; job.AuxWork == auxWork && !job.empty() {
+			return
+		}
 	}
 
 	blkTplReply, err := s.fetchPendingBlock()
@@ -77,7 +107,13 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		Error.Printf("Error while refreshing pending block on %s: %s", rpcClient.Name, err)
 		return
 	}
+	s.updateBlockTemplate(rpcClient, blkTplReply)
+}
 
+// updateBlockTemplate builds the job of the template blkTplReply and broadcasts it.
+func (s *ProxyServer) updateBlockTemplate(rpcClient *rpc.RPCClient, blkTplReply *rpc.GetBlockTemplateReplyPart) {
+	t := s.currentBlockTemplate()
+	auxWork := s.currentAuxWork()
 	var newTpl BlockTemplate
 	if t == nil || t.PrevHash != blkTplReply.PreviousBlockHash {
 		nBits, err := strconv.ParseInt(blkTplReply.Bits, 16, 32)
@@ -108,55 +144,165 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		newTpl.newBlkTpl = false
 	}
 
+	newTplJob, err := s.newTplJob(newTpl.Height, blkTplReply, auxWork)
+	if err != nil {
+		Error.Printf("Error while building job on %s: %s", rpcClient.Name, err)
+		return
+	}
+
+	newTpl.lastBlkTplId = newTplJob.BlkTplJobId
+	newTpl.longPollId = blkTplReply.LongPollId
+	newTpl.BlockTplJobMap[newTplJob.BlkTplJobId] = newTplJob
+	for _, tx := range blkTplReply.Transactions {
+		newTpl.TxDetailMap[tx.TxId] = tx.Data
+	}
+
+	s.blockTemplate.Store(&newTpl)
+	Info.Printf("NEW pending block on %s at height %d / %s", rpcClient.Name, newTpl.Height, newTplJob.BlkTplJobId)
+
+	// Stratum
+	if len(s.ports) > 0 {
+		go s.broadcastNewJobs()
+	}
+	if s.config.Proxy.StratumV2.Enabled {
+		go s.broadcastSv2Jobs()
+	}
+}
+
+// pushEmptyJob sends miners a coinbase-only job on the new tip prevBlockHash
+// while the block template with transactions is built. The job takes the
+// difficulty, version and subsidy of t, so it is only pushed if the new tip
+// extends the tip of t and the next block cannot change them.
+func (s *ProxyServer) pushEmptyJob(rpcClient *rpc.RPCClient, t *BlockTemplate, prevBlockHash string) {
+	last, ok := t.BlockTplJobMap[t.lastBlkTplId]
+	if !ok {
+		return
+	}
+	header, err := rpcClient.GetBlockHeader(prevBlockHash)
+	if err != nil || header == nil {
+		Error.Printf("Error while fetching header of new tip %s on %s: %v", prevBlockHash, rpcClient.Name, err)
+		return
+	}
+	height := header.Height + 1
+	if header.Height != t.Height || header.Bits != fmt.Sprintf("%08x", t.NBits) ||
+		height%retargetInterval == 0 || height%halvingInterval == 0 {
+		return
+	}
+
+	curTime := uint32(s.now().Unix())
+	if curTime <= header.MedianTime {
+		curTime = header.MedianTime + 1
+	}
+	reply := &rpc.GetBlockTemplateReplyPart{
+		CurTime:       curTime,
+		MinTime:       header.MedianTime + 1,
+		CoinBaseAux:   rpc.CoinBaseAux{Flags: last.CoinBaseAuxFlags},
+		CoinBaseValue: last.CoinBaseValue - last.JobTxsFeeTotal,
+	}
+	job, err := s.newTplJob(height, reply, s.currentAuxWork())
+	if err != nil {
+		Error.Printf("Error while building empty job on %s: %s", rpcClient.Name, err)
+		return
+	}
+	job.EmptyDeadline = s.now().Add(s.emptyJobWindow)
+
+	newTpl := BlockTemplate{
+		Version:        t.Version,
+		Height:         height,
+		PrevHash:       prevBlockHash,
+		NBits:          t.NBits,
+		Target:         t.Target,
+		Difficulty:     t.Difficulty,
+		BlockTplJobMap: map[string]BlockTemplateJob{job.BlkTplJobId: job},
+		TxDetailMap:    make(map[string]string),
+		updateTime:     MakeTimestamp() / 1000,
+		newBlkTpl:      true,
+		lastBlkTplId:   job.BlkTplJobId,
+	}
+	s.blockTemplate.Store(&newTpl)
+	Info.Printf("NEW empty job on %s at height %d / %s", rpcClient.Name, height, job.BlkTplJobId)
+
+	// queued before the job with transactions can replace it
+	if len(s.ports) > 0 {
+		s.broadcastNewJobs()
+	}
+	if s.config.Proxy.StratumV2.Enabled {
+		s.broadcastSv2Jobs()
+	}
+}
+
+// empty tells whether j only carries the coinbase.
+func (j *BlockTemplateJob) empty() bool {
+	return !j.EmptyDeadline.IsZero()
+}
+
+// newTplJob builds the job of a block template at height, its coinbase pays the pool.
+func (s *ProxyServer) newTplJob(height uint32, blkTplReply *rpc.GetBlockTemplateReplyPart, auxWork *auxWork) (BlockTemplateJob, error) {
 	var newTplJob BlockTemplateJob
 	newTplJob.BlkTplJobTime = blkTplReply.CurTime
+	newTplJob.MinTime = blkTplReply.MinTime
+	newTplJob.MaxTime = blkTplReply.MaxTime
 	for _, tx := range blkTplReply.Transactions {
 		newTplJob.TxIdList = append(newTplJob.TxIdList, tx.TxId)
 	}
+	var err error
 	newTplJob.MerkleBranch, err = txid_merkle_tree.GetMerkleBranchHexFromTxIdsWithoutCoinBase(newTplJob.TxIdList)
 	if err != nil {
-		Error.Printf("Error while get merkle branch on %s: %s", rpcClient.Name, err)
-		return
+		return newTplJob, fmt.Errorf("get merkle branch: %v", err)
 	}
 
 	coinBaseReward := blkTplReply.CoinBaseValue
 
 	if coinBaseReward <= 0 {
-		Error.Printf("Invalid block template, coinBaseReward <= 0")
-		return
+		return newTplJob, errors.New("invalid block template, coinBaseReward <= 0")
 	}
 
-	var coinBaseTx bitcoin.CoinBaseTransaction
-	err = coinBaseTx.Initialize(s.config.UpstreamCoinBase, newTplJob.BlkTplJobTime, newTpl.Height, coinBaseReward,
+	coinBaseTx := bitcoin.CoinBaseTransaction{AuxCommitment: auxWork.coinBaseCommitment()}
+	err = coinBaseTx.Initialize(s.config.UpstreamCoinBase, newTplJob.BlkTplJobTime, height, coinBaseReward,
 		blkTplReply.CoinBaseAux.Flags, s.config.CoinBaseExtraData, blkTplReply.DefaultWitnessCommitment)
 	if err != nil {
-		Error.Printf("Error while initialize coinbase transaction on %s: %s", rpcClient.Name, err)
-		return
+		return newTplJob, fmt.Errorf("initialize coinbase transaction: %v", err)
 	}
 	newTplJob.CoinBase1 = hex.EncodeToString(coinBaseTx.CoinBaseTx1)
 	newTplJob.CoinBase2 = hex.EncodeToString(coinBaseTx.CoinBaseTx2)
+	newTplJob.CoinBase1BySize = make(map[int]string)
+	for _, size := range s.extraNonceSizes() {
+		if size == bitcoin.EXTRANONCE1_SIZE+bitcoin.EXTRANONCE2_SIZE {
+			continue
+		}
+		// only the length of the extra nonce push in coinbase1 differs
+		sizedTx := bitcoin.CoinBaseTransaction{ExtraNonce1Size: bitcoin.EXTRANONCE1_SIZE, ExtraNonce2Size: size - bitcoin.EXTRANONCE1_SIZE,
+			AuxCommitment: auxWork.coinBaseCommitment()}
+		err = sizedTx.Initialize(s.config.UpstreamCoinBase, newTplJob.BlkTplJobTime, height, coinBaseReward,
+			blkTplReply.CoinBaseAux.Flags, s.config.CoinBaseExtraData, blkTplReply.DefaultWitnessCommitment)
+		if err != nil {
+			return newTplJob, fmt.Errorf("initialize coinbase transaction: %v", err)
+		}
+		newTplJob.CoinBase1BySize[size] = hex.EncodeToString(sizedTx.CoinBaseTx1)
+	}
 	newTplJob.CoinBaseValue = coinBaseReward
+	newTplJob.CoinBaseAuxFlags = blkTplReply.CoinBaseAux.Flags
 	newTplJob.JobTxsFeeTotal = 0
 	for _, tx := range blkTplReply.Transactions {
 		newTplJob.JobTxsFeeTotal += tx.Fee
 	}
-	newTplJob.BlkTplJobId = hex.EncodeToString(utility.Sha256(coinBaseTx.CoinBaseTx1))[0:16]
+	// the empty job and the job with transactions may share coinbase1
+	jobData := append(append([]byte{}, coinBaseTx.CoinBaseTx1...), coinBaseTx.CoinBaseTx2...)
+	jobData = append(jobData, strings.Join(newTplJob.MerkleBranch, "")...)
+	newTplJob.BlkTplJobId = hex.EncodeToString(utility.Sha256(jobData))[0:16]
 
 	newTplJob.DefaultWitnessCommitment = blkTplReply.DefaultWitnessCommitment
+	newTplJob.AuxWork = auxWork
+	return newTplJob, nil
+}
 
-	newTpl.lastBlkTplId = newTplJob.BlkTplJobId
-	newTpl.BlockTplJobMap[newTplJob.BlkTplJobId] = newTplJob
-	for _, tx := range blkTplReply.Transactions {
-		newTpl.TxDetailMap[tx.TxId] = tx.Data
-	}
-
-	s.blockTemplate.Store(&newTpl)
-	Info.Printf("NEW pending block on %s at height %d / %s", rpcClient.Name, newTpl.Height, newTplJob.BlkTplJobId)
-
-	// Stratum
-	if s.config.Proxy.Stratum.Enabled {
-		go s.broadcastNewJobs()
+// coinBase1 returns the coinbase1 for extra nonces of size bytes in total.
+func (j *BlockTemplateJob) coinBase1(size int) (string, bool) {
+	if size == bitcoin.EXTRANONCE1_SIZE+bitcoin.EXTRANONCE2_SIZE {
+		return j.CoinBase1, true
 	}
+	coinBase1, ok := j.CoinBase1BySize[size]
+	return coinBase1, ok
 }
 
 func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockTemplateReplyPart, error) {
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PowPool/btcpool/rpc"
+)
+
+const emptyJobTip = "00000000000000000001c1b0cd3a5a37a1e1bfb9a0a5e5bc1ec6c1f6e0c5b1a1"
+
+func TestEmptyJobOnNewTip(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string `json:"method"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		calls = append(calls, req.Method)
+		mu.Unlock()
+		var result interface{}
+		switch req.Method {
+		case "getbestblockhash":
+			result = emptyJobTip
+		case "getblockheader":
+			result = map[string]interface{}{"hash": emptyJobTip, "height": 800000, "time": 1690168629, "mediantime": 1690166000, "bits": "17053894"}
+		case "getblocktemplate":
+			result = map[string]interface{}{"version": 0x20000000, "previousblockhash": emptyJobTip, "coinbasevalue": 312505000,
+				"curtime": 1690168700, "mintime": 1690166001, "bits": "17053894", "height": 800001,
+				"target":       "0000000000000000000538940000000000000000000000000000000000000000",
+				"transactions": []map[string]interface{}{{"data": "00", "txid": strings.Repeat("ab", 32), "fee": 5000}}}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": result})
+	}))
+	defer node.Close()
+
+	oldTip := func() *BlockTemplate {
+		return &BlockTemplate{Version: 0x20000000, Height: 800000, PrevHash: "prev", NBits: 0x17053894,
+			Target: "0000000000000000000538940000000000000000000000000000000000000000", lastBlkTplId: "j1",
+			BlockTplJobMap: map[string]BlockTemplateJob{"j1": {BlkTplJobId: "j1", CoinBaseValue: 312510000, JobTxsFeeTotal: 10000}}}
+	}
+	newServer := func(window time.Duration) *ProxyServer {
+		s := &ProxyServer{config: &Config{Proxy: Proxy{BlockTemplateInterval: "10s"}, UpstreamCoinBase: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"},
+			upstreams: []*rpc.RPCClient{rpc.NewRPCClient("node", node.URL, "5s")}, emptyJobWindow: window}
+		s.blockTemplate.Store(oldTip())
+		return s
+	}
+
+	s := newServer(30 * time.Second)
+	s.fetchBlockTemplate()
+	tpl := s.currentBlockTemplate()
+	if tpl.Height != 800001 || len(tpl.BlockTplJobMap) != 2 {
+		t.Fatalf("Expected the empty and the template job at height 800001, got %v jobs at %v", len(tpl.BlockTplJobMap), tpl.Height)
+	}
+	var empty *BlockTemplateJob
+	for id := range tpl.BlockTplJobMap {
+		if job := tpl.BlockTplJobMap[id]; job.empty() {
+			empty = &job
+		}
+	}
+	if empty == nil || len(empty.MerkleBranch) != 0 || empty.CoinBaseValue != 312500000 || empty.MinTime != 1690166001 {
+		t.Fatalf("Empty job must only pay the subsidy, got %+v", empty)
+	}
+	if last := tpl.BlockTplJobMap[tpl.lastBlkTplId]; last.empty() || len(last.TxIdList) != 1 {
+		t.Errorf("Template job must replace the empty job, got %+v", last)
+	}
+	if strings.Join(calls, ",") != "getbestblockhash,getblockheader,getblocktemplate" {
+		t.Errorf("Empty job must be pushed before the template is fetched, got %v", calls)
+	}
+
+	// no guessing over a reorg
+	s = newServer(30 * time.Second)
+	tip := oldTip()
+	tip.Height = 799999
+	s.blockTemplate.Store(tip)
+	s.fetchBlockTemplate()
+	if tpl := s.currentBlockTemplate(); len(tpl.BlockTplJobMap) != 1 {
+		t.Error("No empty job must be pushed if the new tip does not extend the template")
+	}
+
+	s = newServer(0)
+	s.fetchBlockTemplate()
+	if tpl := s.currentBlockTemplate(); len(tpl.BlockTplJobMap) != 1 {
+		t.Error("No empty job must be pushed without a window")
+	}
+}
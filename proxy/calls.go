@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Calls of the pool to the miner: client.show_message, client.get_version and
+// mining.ping. Replies are matched to the calls by id.
+
+const defaultPingTimeout = 10 * time.Second
+
+// pendingCall is a call waiting for the reply of the miner.
+type pendingCall struct {
+	method string
+	sent   time.Time
+}
+
+// call sends method to the miner and remembers it until the reply arrives.
+func (cs *Session) call(method string, params []interface{}) (uint64, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.lastCallId++
+	id := cs.lastCallId
+	if cs.calls == nil {
+		cs.calls = make(map[uint64]pendingCall)
+	}
+	cs.calls[id] = pendingCall{method: method, sent: time.Now()}
+	message := JSONPushMessage{Id: json.RawMessage(strconv.FormatUint(id, 10)), Method: method, Params: params}
+	if err := cs.send(&message); err != nil {
+		delete(cs.calls, id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// showMessage shows message to the operator of the miner, no reply is expected.
+func (cs *Session) showMessage(message string) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	push := JSONPushMessage{Id: nil, Method: "client.show_message", Params: []string{message}}
+	return cs.send(&push)
+}
+
+func (cs *Session) getVersion() error {
+	_, err := cs.call("client.get_version", []interface{}{})
+	return err
+}
+
+// ping sends mining.ping. Sessions that answered a ping before are closed if
+// they do not answer within timeout, others may not support it.
+func (s *ProxyServer) ping(cs *Session, timeout time.Duration) error {
+	id, err := cs.call("mining.ping", []interface{}{})
+	if err != nil {
+		return err
+	}
+	time.AfterFunc(timeout, func() {
+		cs.Lock()
+		_, pending := cs.calls[id]
+		delete(cs.calls, id)
+		zombie := pending && cs.pingSupported
+		cs.Unlock()
+		if zombie {
+			Error.Printf("No mining.ping reply from %v.%v@%v within %v, closing", cs.login, cs.id, cs.ip, timeout)
+			// the reader fails on the closed connection and removes the session
+			_ = cs.conn.Close()
+		}
+	})
+	return nil
+}
+
+// handleCallReply handles the reply of the miner to a call of the pool.
+func (cs *Session) handleCallReply(req *StratumReq) {
+	id, err := strconv.ParseUint(string(req.Id), 10, 64)
+	cs.Lock()
+	defer cs.Unlock()
+	call, ok := cs.calls[id]
+	if err != nil || !ok {
+		Debug.Printf("Unexpected reply %s from %v", string(req.Id), cs.ip)
+		return
+	}
+	delete(cs.calls, id)
+
+	if len(req.Error) > 0 && string(req.Error) != "null" {
+		Info.Printf("%v error from %v.%v@%v: %s", call.method, cs.login, cs.id, cs.ip, string(req.Error))
+		return
+	}
+	switch call.method {
+	case "client.get_version":
+		var version string
+		if json.Unmarshal(req.Result, &version) == nil {
+			if len(version) > 256 {
+				version = version[:256]
+			}
+			cs.version = version
+			Info.Printf("Miner version of %v.%v@%v: %v", cs.login, cs.id, cs.ip, version)
+		}
+	case "mining.ping":
+		cs.pingSupported = true
+		cs.pingRTT = time.Since(call.sent)
+	}
+}
+
+// pingSessions pings the authorized sessions to find dead connections before their deadline.
+func (s *ProxyServer) pingSessions(timeout time.Duration) {
+	for _, cs := range s.sessionList() {
+		if !cs.isAuth {
+			continue
+		}
+		if err := s.ping(cs, timeout); err != nil {
+			Error.Printf("mining.ping error to %v@%v: %v", cs.login, cs.ip, err)
+			_ = cs.conn.Close()
+		}
+	}
+}
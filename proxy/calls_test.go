@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallReplies(t *testing.T) {
+	s := &ProxyServer{config: &Config{}, sessions: make(map[*Session]struct{})}
+	server, client := net.Pipe()
+	defer client.Close()
+	cs := &Session{conn: server, out: newSessionWriter(server, time.Second), port: &stratumPort{timeout: time.Minute}, isAuth: true}
+	s.registerSession(cs)
+	dec := json.NewDecoder(client)
+
+	if err := cs.getVersion(); err != nil {
+		t.Fatal(err)
+	}
+	var call JSONPushMessage
+	if err := dec.Decode(&call); err != nil || call.Method != "client.get_version" {
+		t.Fatalf("Expected client.get_version, got %+v %v", call, err)
+	}
+	reply := StratumReq{JSONRpcReq: JSONRpcReq{Id: call.Id}, Result: json.RawMessage(`"bmminer/2.0.0"`), Error: json.RawMessage(`null`)}
+	if err := cs.handleTCPMessage(s, &reply); err != nil {
+		t.Fatal("Replies to calls of the pool must not close the session")
+	}
+	if cs.version != "bmminer/2.0.0" || len(cs.calls) != 0 {
+		t.Errorf("Version must be stored on the session, got %q", cs.version)
+	}
+
+	if err := s.ping(cs, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&call); err != nil || call.Method != "mining.ping" {
+		t.Fatalf("Expected mining.ping, got %+v %v", call, err)
+	}
+	reply = StratumReq{JSONRpcReq: JSONRpcReq{Id: call.Id}, Result: json.RawMessage(`"pong"`)}
+	_ = cs.handleTCPMessage(s, &reply)
+	if !cs.pingSupported {
+		t.Fatal("Ping reply must mark the session as supporting mining.ping")
+	}
+
+	// a session that answered pings before is closed when it misses one
+	if err := s.ping(cs, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&call); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := server.Write([]byte("\n")); err == nil {
+		t.Error("Session missing a ping must be closed")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	s := &ProxyServer{config: &Config{Proxy: Proxy{Admin: Admin{Token: "secret"}}}, sessions: make(map[*Session]struct{}), pingTimeout: time.Second}
+	server, client := net.Pipe()
+	defer client.Close()
+	cs := &Session{conn: server, out: newSessionWriter(server, time.Second), sid: "0001", login: "x", id: "w", ip: "10.0.0.1", isAuth: true, version: "cgminer/4.12"}
+	s.registerSession(cs)
+	h := s.adminRouter()
+
+	req := httptest.NewRequest("POST", "/admin/logins/x/message", strings.NewReader(`{"message":"maintenance at 12:00"}`))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Requests without the token must be refused, got %v", w.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		done <- w.Code
+	}()
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg JSONPushMessage
+	if err := json.Unmarshal(line, &msg); err != nil || msg.Method != "client.show_message" || string(msg.Id) != "null" {
+		t.Errorf("Expected client.show_message notification, got %s", line)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Message call failed with %v", code)
+	}
+
+	req = httptest.NewRequest("POST", "/admin/sessions/0002/version", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unknown session must not be found, got %v", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/sessions?login=x", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var sessions []adminSession
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil || len(sessions) != 1 || sessions[0].Version != "cgminer/4.12" {
+		t.Errorf("Unexpected session list %s", w.Body.String())
+	}
+
+	s.config.Proxy.Admin.Token = ""
+	req = httptest.NewRequest("GET", "/admin/sessions", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w = httptest.NewRecorder()
+	s.adminRouter().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Admin interface without a token must refuse all requests, got %v", w.Code)
+	}
+}
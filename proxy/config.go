@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"bytes"
+	"encoding/json"
+
 	"github.com/PowPool/btcpool/api"
 	"github.com/PowPool/btcpool/payouts"
 	"github.com/PowPool/btcpool/policy"
@@ -53,27 +56,208 @@ type Proxy struct {
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
 
-	Stratum    Stratum    `json:"stratum"`
-	DiffAdjust DiffAdjust `json:"diffAdjust"`
+	// Stratum listeners, each with its own difficulty profile
+	Stratum    StratumPorts `json:"stratum"`
+	StratumV2  StratumV2    `json:"stratumV2"`
+	DiffAdjust DiffAdjust   `json:"diffAdjust"`
+	Drain      Drain        `json:"drain"`
+	Record     Record       `json:"record"`
+	Ping       Ping         `json:"ping"`
+	Admin      Admin        `json:"admin"`
+	Accounts   Accounts     `json:"accounts"`
+	Solo       Solo         `json:"solo"`
+	// MergedMining mines aux chains with the shares of the pool
+	MergedMining MergedMining `json:"mergedMining"`
+	// EmptyJobWindow is how long the coinbase-only job pushed on a new tip may
+	// find blocks, no empty job is pushed if not set
+	EmptyJobWindow string `json:"emptyJobWindow"`
+	// LongPoll refreshes jobs as soon as the node has a new block template
+	LongPoll LongPoll `json:"longPoll"`
+	// NTimeRollWindow is how far ahead of the current time shares may roll nTime, 10m if not set
+	NTimeRollWindow string `json:"nTimeRollWindow"`
+	// VersionMask is the BIP310 version rolling mask in hex, 1fffe000 if not set
+	VersionMask string `json:"versionMask"`
+}
+
+// StratumPorts is a list of stratum listeners. A single object as in configs
+// from before multiple listeners is read as a list of one.
+type StratumPorts []Stratum
+
+func (p *StratumPorts) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		var cfg Stratum
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return err
+		}
+		*p = StratumPorts{cfg}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]Stratum)(p))
 }
 
 type Stratum struct {
+	Enabled bool       `json:"enabled"`
+	Listen  string     `json:"listen"`
+	Timeout string     `json:"timeout"`
+	MaxConn int        `json:"maxConn"`
+	TLS     StratumTLS `json:"tls"`
+	// ProxyProtocol takes the miner address from the PROXY protocol header of a load balancer
+	ProxyProtocol StratumProxyProtocol `json:"proxyProtocol"`
+	// Solo makes every session of the port mine solo
+	Solo bool `json:"solo"`
+	// Tenant tags the workers of the port in their stats
+	Tenant string `json:"tenant"`
+	// Difficulty is the start difficulty of the port, proxy difficulty if not set
+	Difficulty int64 `json:"difficulty"`
+	// Bounds of vardiff and of difficulties chosen by miners, zero means unbounded.
+	// They override the diffAdjust bounds.
+	MinDiff int64 `json:"minDiff"`
+	MaxDiff int64 `json:"maxDiff"`
+	// SessionExpiry is how long a disconnected session can be resumed, empty disables resumption
+	SessionExpiry string `json:"sessionExpiry"`
+	// Extra nonce sizes in bytes, 4 if not set. Extranonce1 holds the node id
+	// in its first two bytes and the session tag in the others. Ports with the
+	// same total size must use the same extraNonce1Size.
+	ExtraNonce1Size int `json:"extraNonce1Size"`
+	ExtraNonce2Size int `json:"extraNonce2Size"`
+}
+
+type StratumProxyProtocol struct {
+	Enabled bool `json:"enabled"`
+	// TrustedProxies are the CIDRs of the load balancers, connections from them must send a v1 or v2 header
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// Record selects the stratum connections whose traffic is written to File.
+type Record struct {
+	Enabled bool     `json:"enabled"`
+	Logins  []string `json:"logins"`
+	IPs     []string `json:"ips"`
+	File    string   `json:"file"`
+	// MaxSize is the size in MB at which the file is rotated, 100 if not set
+	MaxSize int64 `json:"maxSize"`
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int `json:"maxFiles"`
+}
+
+type Drain struct {
+	// Timeout bounds how long miners get to reconnect and submits to finish, 30s if not set
+	Timeout string `json:"timeout"`
+	// ReconnectTo is the cluster node name miners are sent to, empty lets them reconnect to the same address
+	ReconnectTo string `json:"reconnectTo"`
+	// Wait is the number of seconds miners wait before reconnecting
+	Wait int `json:"wait"`
+}
+
+// LongPoll keeps a BIP22 longpoll getblocktemplate request pending on the
+// current upstream.
+type LongPoll struct {
+	Enabled bool `json:"enabled"`
+	// Timeout of a longpoll request, 10m if not set
+	Timeout string `json:"timeout"`
+}
+
+// Ping sends mining.ping to the authorized sessions to find dead
+// connections before the stratum timeout.
+type Ping struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// Timeout closes sessions that answered pings before and miss one, 10s if not set
+	Timeout string `json:"timeout"`
+}
+
+// Solo mining pays blocks to the miner in the coinbase. Ports mine solo with
+// their solo flag, other ports for logins with the solo prefix if enabled.
+type Solo struct {
+	Enabled bool `json:"enabled"`
+	// Prefix of solo logins, "solo:" if not set
+	Prefix string `json:"prefix"`
+	// Fee in percent of the coinbase value paid to FeeAddress by solo blocks
+	Fee        float64 `json:"fee"`
+	FeeAddress string  `json:"feeAddress"`
+}
+
+// MergedMining embeds the blocks of aux chains in the coinbase of the pool
+// jobs. Shares meeting the target of an aux chain submit an AuxPoW proof of its
+// block, recorded under the coin of the chain for its own unlocker.
+type MergedMining struct {
+	Enabled bool `json:"enabled"`
+	// RefreshInterval is how often aux blocks are fetched, 1s if not set
+	RefreshInterval string `json:"refreshInterval"`
+	// BlockTimeout is how long the last block of a failing chain is mined, 1m if not set
+	BlockTimeout string     `json:"blockTimeout"`
+	Chains       []AuxChain `json:"chains"`
+}
+
+type AuxChain struct {
+	// Coin is the redis prefix the blocks of the chain are recorded under
+	Coin    string `json:"coin"`
+	Url     string `json:"url"`
+	Timeout string `json:"timeout"`
+	// Address the aux blocks pay to, passed to createauxblock
+	Address string `json:"address"`
+}
+
+// Accounts lets miners log in with account names kept in redis.
+type Accounts struct {
+	Enabled bool `json:"enabled"`
+	// Enforce refuses logins that are not accounts, addresses included
+	Enforce bool `json:"enforce"`
+	// AllowNoPassword lets accounts without a password hash log in with any password
+	AllowNoPassword bool `json:"allowNoPassword"`
+	// CacheTTL is how long accounts, unknown names and checked passwords are cached, 1m if not set
+	CacheTTL string `json:"cacheTTL"`
+}
+
+// Admin serves the HTTP interface operators call miners through.
+type Admin struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	// Token is required as a bearer token, the interface refuses to start without one
+	Token string `json:"token"`
+}
+
+// StratumTLS serves the stratum protocol of a port over TLS (stratum+ssl).
+// Certificates are reloaded on SIGHUP.
+type StratumTLS struct {
+	Enabled  bool   `json:"enabled"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile enables verification of client certificates
+	ClientCAFile      string `json:"clientCAFile"`
+	RequireClientCert bool   `json:"requireClientCert"`
+}
+
+type StratumV2 struct {
 	Enabled bool   `json:"enabled"`
 	Listen  string `json:"listen"`
 	Timeout string `json:"timeout"`
-	MaxConn int    `json:"maxConn"`
+	// MaxConn limits the number of open mining channels
+	MaxConn            int    `json:"maxConn"`
+	AuthoritySecretKey string `json:"authoritySecretKey"`
+	CertValidity       string `json:"certValidity"`
 }
 
 type DiffAdjust struct {
-	Enabled          bool   `json:"enabled"`
-	AdjustInv        string `json:"adjustInv"`
-	ExpectShareCount int64  `json:"expectShareCount"`
+	Enabled bool `json:"enabled"`
+	// AdjustInv is how often sessions that stopped submitting shares are checked
+	AdjustInv string `json:"adjustInv"`
+	MinDiff   int64  `json:"minDiff"`
+	MaxDiff   int64  `json:"maxDiff"`
+	// TargetTime is the expected interval between two shares of a session
+	TargetTime      string  `json:"targetTime"`
+	RetargetTime    string  `json:"retargetTime"`
+	VariancePercent float64 `json:"variancePercent"`
 }
 
 type Upstream struct {
 	Name    string `json:"name"`
 	Url     string `json:"url"`
 	Timeout string `json:"timeout"`
+	// ZMQ endpoints of the node, as in -zmqpubhashblock and -zmqpubrawblock,
+	// new blocks are then notified instead of polled for
+	ZmqHashBlock string `json:"zmqHashBlock"`
+	ZmqRawBlock  string `json:"zmqRawBlock"`
 }
 
 type ClusterNode struct {
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// BIP310 mining.configure extensions besides version-rolling.
+
+// negotiateMinimumDifficulty keeps the session difficulty at or above minimum-difficulty.value.
+func (s *ProxyServer) negotiateMinimumDifficulty(cs *Session, options map[string]interface{}) map[string]interface{} {
+	value, ok := options["minimum-difficulty.value"].(float64)
+	if !ok || value < 0 {
+		return map[string]interface{}{"minimum-difficulty": false}
+	}
+	diff, err := fromStratumDiff(value)
+	if err != nil {
+		return map[string]interface{}{"minimum-difficulty": false}
+	}
+	diff = cs.port.clamp(diff)
+
+	cs.minimumDiff = diff
+	if cs.vardiff != nil {
+		cs.vardiff.Limit(diff, 0)
+	}
+	return map[string]interface{}{"minimum-difficulty": true}
+}
+
+// negotiateSubscribeExtranonce is mining.extranonce.subscribe negotiated with mining.configure.
+func (s *ProxyServer) negotiateSubscribeExtranonce(cs *Session) map[string]interface{} {
+	cs.extranonceSubscribed = true
+	return map[string]interface{}{"subscribe-extranonce": true}
+}
+
+// negotiateInfo keeps what the miner reports about itself for the worker stats.
+func (s *ProxyServer) negotiateInfo(cs *Session, options map[string]interface{}) map[string]interface{} {
+	str := func(key string) string {
+		v, _ := options[key].(string)
+		if len(v) > 256 {
+			v = v[:256]
+		}
+		return v
+	}
+	cs.workerInfo = &storage.WorkerInfo{
+		ConnectionUrl: str("info.connection-url"),
+		HwVersion:     str("info.hw-version"),
+		SwVersion:     str("info.sw-version"),
+		HwId:          str("info.hw-id"),
+	}
+	Info.Printf("Miner info from %v: %+v", cs.ip, *cs.workerInfo)
+	return map[string]interface{}{"info": true}
+}
+
+// saveWorkerInfo stores the mining.configure results and the port tenant of an authorized session.
+func (s *ProxyServer) saveWorkerInfo(cs *Session) {
+	if !cs.isAuth || (cs.workerInfo == nil && cs.minimumDiff == 0 && len(cs.port.tenant) == 0) {
+		return
+	}
+	info := storage.WorkerInfo{}
+	if cs.workerInfo != nil {
+		info = *cs.workerInfo
+	}
+	info.MinDiff = cs.minimumDiff
+	info.Tenant = cs.port.tenant
+	if err := s.backend.WriteWorkerInfo(cs.login, cs.id, &info, s.hashrateExpiration); err != nil {
+		Error.Printf("Failed to store worker info of %v.%v: %v", cs.login, cs.id, err)
+	}
+}
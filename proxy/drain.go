@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Draining takes a node out of rotation without dropping miners hard: the
+// listeners are closed, connected miners are sent to another node with
+// client.reconnect and in-flight submits are finished before shutdown.
+
+const defaultDrainTimeout = 30 * time.Second
+
+func (s *ProxyServer) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// addListener registers a listener to close on drain, it returns false if draining already started.
+func (s *ProxyServer) addListener(l net.Listener) bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.isDraining() {
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	return true
+}
+
+func (s *ProxyServer) closeListeners() {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	s.listeners = nil
+}
+
+// drainHost returns the address of the node miners are sent to, empty for the same address.
+func (s *ProxyServer) drainHost() string {
+	name := s.config.Proxy.Drain.ReconnectTo
+	if len(name) == 0 {
+		return ""
+	}
+	for _, c := range s.config.Cluster {
+		if c.NodeName == name {
+			return c.NodeIp
+		}
+	}
+	Error.Printf("Drain reconnect node %v is not in the cluster, miners reconnect to the same address", name)
+	return ""
+}
+
+// Drain stops accepting miners, sends the connected ones elsewhere and waits
+// until they left and their in-flight submits are done, or the drain timeout passed.
+func (s *ProxyServer) Drain() {
+	s.listenersMu.Lock()
+	started := atomic.CompareAndSwapInt32(&s.draining, 0, 1)
+	s.listenersMu.Unlock()
+	if !started {
+		return
+	}
+	timeout := defaultDrainTimeout
+	if len(s.config.Proxy.Drain.Timeout) > 0 {
+		timeout = MustParseDuration(s.config.Proxy.Drain.Timeout)
+	}
+	deadline := time.Now().Add(timeout)
+
+	s.closeListeners()
+	host := s.drainHost()
+	wait := s.config.Proxy.Drain.Wait
+	Info.Printf("Draining stratum sessions to %q within %v", host, timeout)
+
+	for _, cs := range s.sessionList() {
+		if !cs.isAuth {
+			s.removeSession(cs)
+			_ = cs.conn.Close()
+			continue
+		}
+		if err := cs.reconnect(host, wait); err != nil {
+			Error.Printf("client.reconnect error to %v@%v: %v", cs.login, cs.ip, err)
+			s.removeSession(cs)
+			_ = cs.conn.Close()
+		}
+	}
+	for _, sc := range s.sv2ConnList() {
+		if err := sc.reconnect(host); err != nil {
+			Error.Printf("Stratum V2 reconnect error to %v: %v", sc.ip, err)
+			_ = sc.conn.Close()
+		}
+	}
+
+	for time.Now().Before(deadline) && (len(s.sessionList()) > 0 || len(s.sv2ConnList()) > 0 || atomic.LoadInt64(&s.inflightSubmits) > 0) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// miners ignoring the reconnect are disconnected, their last submits still finish
+	for _, cs := range s.sessionList() {
+		s.removeSession(cs)
+		cs.close()
+	}
+	for _, sc := range s.sv2ConnList() {
+		sc.close()
+	}
+	for time.Now().Before(deadline) && atomic.LoadInt64(&s.inflightSubmits) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	Info.Printf("Drain finished, %v submits in flight", atomic.LoadInt64(&s.inflightSubmits))
+}
+
+func (s *ProxyServer) sessionList() []*Session {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for cs := range s.sessions {
+		sessions = append(sessions, cs)
+	}
+	return sessions
+}
+
+func (s *ProxyServer) sv2ConnList() []*Sv2Conn {
+	s.sv2Mu.RLock()
+	defer s.sv2Mu.RUnlock()
+	conns := make([]*Sv2Conn, 0, len(s.sv2Conns))
+	for sc := range s.sv2Conns {
+		conns = append(conns, sc)
+	}
+	return conns
+}
+
+// reconnect sends client.reconnect to host, or to the same address if host is empty.
+// The port stays the one the miner connected to.
+func (cs *Session) reconnect(host string, wait int) error {
+	params := []interface{}{}
+	if len(host) > 0 {
+		_, portStr, _ := net.SplitHostPort(cs.conn.LocalAddr().String())
+		port, _ := strconv.Atoi(portStr)
+		params = []interface{}{host, port, wait}
+	}
+	message := JSONPushMessage{Id: nil, Method: "client.reconnect", Params: params}
+	m, _ := json.Marshal(&message)
+	Debug.Printf("client.reconnect, message: %s", string(m))
+
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.send(&message)
+}
+
+// reconnect sends the Reconnect message of the Mining protocol, an empty host keeps the address.
+func (sc *Sv2Conn) reconnect(host string) error {
+	w := &sv2Writer{}
+	w.str0255(host)
+	port := 0
+	if len(host) > 0 {
+		_, portStr, _ := net.SplitHostPort(sc.conn.LocalAddr().String())
+		port, _ = strconv.Atoi(portStr)
+	}
+	w.u16(uint16(port))
+	return sc.writeMessage(Sv2MsgReconnect, w.buf)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	s := &ProxyServer{
+		config: &Config{
+			Cluster: []ClusterNode{{NodeName: "pool1", NodeIp: "10.0.0.1"}, {NodeName: "pool2", NodeIp: "10.0.0.2"}},
+			Proxy:   Proxy{Drain: Drain{Timeout: "500ms", ReconnectTo: "pool2", Wait: 3}},
+		},
+		sessions: make(map[*Session]struct{}),
+	}
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.addListener(server) {
+		t.Fatal("Listener must be registered before draining")
+	}
+	client, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &Session{conn: conn, isAuth: true, out: newSessionWriter(conn, time.Second)}
+	s.registerSession(cs)
+
+	done := make(chan struct{})
+	go func() {
+		s.Drain()
+		close(done)
+	}()
+
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg JSONPushMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(server.Addr().String())
+	params, _ := msg.Params.([]interface{})
+	if msg.Method != "client.reconnect" || len(params) != 3 || params[0] != "10.0.0.2" || strconv.Itoa(int(params[1].(float64))) != port || params[2] != float64(3) {
+		t.Errorf("Unexpected message %s", line)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain must finish within its timeout")
+	}
+	if len(s.sessionList()) != 0 {
+		t.Error("Sessions ignoring the reconnect must be removed")
+	}
+	if _, err := server.Accept(); err == nil {
+		t.Error("Listener must be closed")
+	}
+	if s.addListener(server) {
+		t.Error("No listener may be added while draining")
+	}
+}
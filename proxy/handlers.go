@@ -2,13 +2,15 @@ package proxy
 
 import (
 	"encoding/hex"
-	"fmt"
+	"encoding/json"
+	"math"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/PowPool/btcpool/bitcoin"
-	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"github.com/PowPool/btcpool/storage"
 
 	//"github.com/PowPool/btcpool/rpc"
 	. "github.com/PowPool/btcpool/util"
@@ -18,24 +20,81 @@ var noncePattern = regexp.MustCompile("^[0-9a-f]{8}$")
 var hashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
 var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_\x2e]{1,64}$")
 
+// Share rejections, the miner stays connected unless it is above the invalid share limit.
+// Each has its own code, 24..27 are taken by the other stratum errors.
+var (
+	errInvalidShare   = &ErrorReply{Code: 20, Message: "Invalid share"}
+	errJobNotFound    = &ErrorReply{Code: 21, Message: "Job not found"}
+	errDuplicateShare = &ErrorReply{Code: 22, Message: "Duplicate share"}
+	errLowDifficulty  = &ErrorReply{Code: 23, Message: "Low difficulty share"}
+	errStaleJob       = &ErrorReply{Code: 28, Message: "Stale job"}
+	errInvalidNTime   = &ErrorReply{Code: 29, Message: "Invalid nTime"}
+	// version bits outside the negotiated mask
+	errInvalidVersionBits = &ErrorReply{Code: 30, Message: "Invalid version bits"}
+)
+
+// rejectReasons are the reasons rejected shares are counted under
+var rejectReasons = map[*ErrorReply]storage.RejectReason{
+	errInvalidShare:       storage.RejectMalformed,
+	errJobNotFound:        storage.RejectUnknownJob,
+	errStaleJob:           storage.RejectStale,
+	errDuplicateShare:     storage.RejectDuplicate,
+	errLowDifficulty:      storage.RejectLowDifficulty,
+	errInvalidNTime:       storage.RejectBadNTime,
+	errInvalidVersionBits: storage.RejectBadVersionBits,
+}
+
+var errInvalidShareLimit = &ErrorReply{Code: -1, Message: "High rate of invalid shares"}
+
+func isShareRejection(errReply *ErrorReply) bool {
+	_, ok := rejectReasons[errReply]
+	return ok
+}
+
+// writeRejectedShare counts a rejected share for the worker. Shares that did
+// not meet their difficulty go to the reject stats, all others to the invalid ones.
+func (s *ProxyServer) writeRejectedShare(cs *Session, shareDiff int64, reason storage.RejectReason) {
+	ms := MakeTimestamp()
+	ts := ms / 1000
+
+	var err error
+	if reason == storage.RejectLowDifficulty {
+		err = s.backend.WriteRejectShare(ms, ts, cs.login, cs.id, shareDiff, reason, s.hashrateExpiration)
+	} else {
+		err = s.backend.WriteInvalidShare(ms, ts, cs.login, cs.id, shareDiff, reason, s.hashrateExpiration)
+	}
+	if err != nil {
+		Error.Println("Failed to insert invalid share data into backend:", err)
+	}
+}
+
 // Stratum
-func (s *ProxyServer) handleSubscribeRPC(cs *Session) (interface{}, *ErrorReply) {
-	cs.target = s.target
+func (s *ProxyServer) handleSubscribeRPC(cs *Session, sid string) (interface{}, *ErrorReply) {
+	cs.target = cs.port.target
+	if cs.suggestedDiff > 0 {
+		cs.target = GetTargetHex(cs.suggestedDiff)
+	} else if cs.minimumDiff > 0 && TargetHexToDiff(cs.target).Int64() < cs.minimumDiff {
+		cs.target = GetTargetHex(cs.minimumDiff)
+	}
 	// at first time, target is the same with targetNextJob
-	cs.targetNextJob = s.target
+	cs.targetNextJob = cs.target
+	if cs.port.vardiff != nil {
+		cs.vardiff = newVarDiff(cs.port.vardiff, time.Now())
+		cs.vardiff.Limit(cs.minimumDiff, 0)
+	}
+
+	if !s.resumeSession(cs, sid) {
+		cs.sid = newSessionId()
+		cs.extraNonce1 = s.extraNonce1ForTag(cs.tag, cs.port.extraNonce1Size)
+	}
 	s.registerSession(cs)
+	s.saveSession(cs)
 	Info.Printf("Stratum miner connected from %v", cs.ip)
 
-	//if cs.sid == "" {
-	cs.sid = hex.EncodeToString(utility.Sha256([]byte(strings.Join([]string{cs.ip, strconv.Itoa(int(s.config.Id)), strconv.Itoa(int(cs.tag))}, ","))))[0:32]
-	//}
-
-	cs.extraNonce1 = fmt.Sprintf("%08x", uint32(s.config.Id)<<16|uint32(cs.tag))
-
 	setDiff := []string{"mining.set_difficulty", cs.sid}
 	notify := []string{"mining.notify", cs.sid}
 	l := []interface{}{setDiff, notify}
-	reply := []interface{}{l, cs.extraNonce1, bitcoin.EXTRANONCE2_SIZE}
+	reply := []interface{}{l, cs.extraNonce1, cs.extraNonce2Size}
 
 	return reply, nil
 }
@@ -46,10 +105,15 @@ func (s *ProxyServer) handleAuthorizeRPC(cs *Session, params []string) (bool, *E
 	}
 
 	l := strings.Split(strings.Trim(params[0], " \t\r\n"), ".")
-	if !IsValidBTCAddress(l[0]) {
+	login, solo := s.soloLogin(l[0])
+	solo = solo || cs.port.solo
+	if solo && cs.port == s.sv2Port {
+		return false, &ErrorReply{Code: -1, Message: "Solo mining is not available on this port"}
+	}
+	if s.accounts == nil && !IsValidBTCAddress(login) {
 		return false, &ErrorReply{Code: -1, Message: "Invalid authorize"}
 	}
-	if !s.policy.ApplyLoginPolicy(l[0], cs.ip) {
+	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
 		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
 	}
 
@@ -58,14 +122,67 @@ func (s *ProxyServer) handleAuthorizeRPC(cs *Session, params []string) (bool, *E
 		id = l[1]
 	}
 
-	cs.login = l[0]
+	opts := minerOptions{}
+	if len(params) > 1 {
+		var errReply *ErrorReply
+		if opts, errReply = parseMinerOptions(params[1]); errReply != nil {
+			return false, errReply
+		}
+	}
+
+	// account logins are credited to a payout address of the account
+	account := ""
+	if s.accounts != nil && (s.accounts.enforce || !IsValidBTCAddress(login)) {
+		password := ""
+		if len(params) > 1 {
+			password = minerPassword(params[1])
+		}
+		// failed logins count as malformed requests, guessing passwords gets banned
+		if s.policy.IsBanned(cs.ip) {
+			return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
+		}
+		address, errReply := s.accounts.authorize(login, password, opts.payout)
+		if errReply != nil {
+			Info.Printf("Stratum account %v@%v refused: %v", login, cs.ip, errReply.Message)
+			if errReply == errUnknownAccount || errReply == errWrongPassword {
+				s.policy.ApplyMalformedPolicy(cs.ip)
+			}
+			return false, errReply
+		}
+		account, login, opts.payout = login, address, ""
+		if !s.policy.ApplyLoginPolicy(login, cs.ip) {
+			return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
+		}
+	}
+	if len(opts.payout) > 0 && !s.policy.ApplyLoginPolicy(opts.payout, cs.ip) {
+		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
+	}
+
+	cs.account = account
+	cs.login = login
+	cs.solo = solo
 	cs.id = id
 	cs.isAuth = true
+	s.applyMinerOptions(cs, opts)
+	s.saveSession(cs)
+	s.saveWorkerInfo(cs)
 
-	Info.Printf("Stratum miner connected %v.%v@%v", cs.login, cs.id, cs.ip)
+	if len(account) > 0 {
+		Info.Printf("Stratum miner connected %v.%v@%v with account %v", cs.login, cs.id, cs.ip, account)
+	} else {
+		Info.Printf("Stratum miner connected %v.%v@%v", cs.login, cs.id, cs.ip)
+	}
 	return true, nil
 }
 
+func extraNonce2Valid(eNonce2 string, size int) bool {
+	if len(eNonce2) != 2*size || strings.ToLower(eNonce2) != eNonce2 {
+		return false
+	}
+	_, err := hex.DecodeString(eNonce2)
+	return err == nil
+}
+
 // Stratum
 func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, params []string) (bool, *ErrorReply) {
 	s.sessionsMu.RLock()
@@ -75,50 +192,193 @@ func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, params []string) (bool, *E
 	if !ok {
 		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
 	}
+	if len(params) > 1 {
+		if errReply := s.checkSessionJob(cs, params[1]); errReply != nil {
+			return false, errReply
+		}
+	}
 	return s.handleSubmitRPC(cs, params)
 }
 
+// checkSessionJob rejects shares of jobs the session did not receive or that a
+// clean job replaced. Stratum V2 channels track their jobs themselves.
+func (s *ProxyServer) checkSessionJob(cs *Session, jobId string) *ErrorReply {
+	sent, stale := cs.jobState(jobId)
+	if sent {
+		return nil
+	}
+	errReply := errJobNotFound
+	if stale {
+		errReply = errStaleJob
+	}
+	Error.Printf("%s from %v.%v@%v: %v", errReply.Message, cs.login, cs.id, cs.ip, jobId)
+	ShareLog.Printf("%s from %v.%v@%v: %v", errReply.Message, cs.login, cs.id, cs.ip, jobId)
+	s.writeRejectedShare(cs, TargetHexToDiff(cs.currentTarget()).Int64(), rejectReasons[errReply])
+
+	if !s.policy.ApplySharePolicy(cs.ip, false) {
+		return errInvalidShareLimit
+	}
+	return errReply
+}
+
 func (s *ProxyServer) handleSubmitRPC(cs *Session, params []string) (bool, *ErrorReply) {
+	// a drain waits for submits in flight
+	atomic.AddInt64(&s.inflightSubmits, 1)
+	defer atomic.AddInt64(&s.inflightSubmits, -1)
+
 	if len(params) < 5 {
 		s.policy.ApplyMalformedPolicy(cs.ip)
 		Error.Printf("Malformed params from %s@%s %v", cs.login, cs.ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
-	if !noncePattern.MatchString(params[2]) || !noncePattern.MatchString(params[3]) || !noncePattern.MatchString(params[4]) {
+	if !extraNonce2Valid(params[2], cs.extraNonce2Size) || !noncePattern.MatchString(params[3]) || !noncePattern.MatchString(params[4]) {
 		s.policy.ApplyMalformedPolicy(cs.ip)
 		Error.Printf("Malformed PoW result from %s@%s %v", cs.login, cs.ip, params)
+		s.writeRejectedShare(cs, TargetHexToDiff(cs.currentTarget()).Int64(), storage.RejectMalformed)
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(cs.login, cs.id, cs.extraNonce1, cs.ip, TargetHexToDiff(cs.target).Int64(), t, params)
-	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+	shareDiff := TargetHexToDiff(cs.jobTarget(params[1])).Int64()
+	var errReply *ErrorReply
+	var solo *soloJob
+	if cs.solo {
+		// a solo job is gone once its template job is
+		if solo = cs.soloJob(params[1]); solo == nil {
+			errReply = errStaleJob
+		}
+	}
+	if errReply == nil {
+		errReply = s.processShare(cs.login, cs.id, cs.extraNonce1, cs.ip, shareDiff, cs.versionMask, t, params, solo)
+	}
+	if errReply == errLowDifficulty {
+		// work started before a mining.set_extranonce
+		if eNonce1 := cs.previousExtraNonce1(); len(eNonce1) > 0 {
+			errReply = s.processShare(cs.login, cs.id, eNonce1, cs.ip, shareDiff, cs.versionMask, t, params, solo)
+		}
+	}
+	if errReply != nil {
+		s.writeRejectedShare(cs, shareDiff, rejectReasons[errReply])
+	}
+	ok := s.policy.ApplySharePolicy(cs.ip, errReply == nil)
 
-	if exist {
+	if errReply == errDuplicateShare {
 		Error.Printf("Duplicate share from %s@%s %v", cs.login, cs.ip, params)
 		ShareLog.Printf("Duplicate share from %s@%s %v", cs.login, cs.ip, params)
-		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
+	} else if errReply != nil {
+		Error.Printf("%s from %s.%s@%s", errReply.Message, cs.login, cs.id, cs.ip)
+		ShareLog.Printf("%s from %s.%s@%s", errReply.Message, cs.login, cs.id, cs.ip)
 	}
-
-	if !validShare {
-		Error.Printf("Invalid share from %s.%s@%s", cs.login, cs.id, cs.ip)
-		ShareLog.Printf("Invalid share from %s.%s@%s", cs.login, cs.id, cs.ip)
+	if errReply != nil {
 		// Bad shares limit reached, return error and close
 		if !ok {
-			return false, &ErrorReply{Code: 23, Message: "Invalid share"}
+			return false, errInvalidShareLimit
 		}
-		return false, nil
+		return false, errReply
 	}
 	Info.Printf("Valid share from %s.%s@%s", cs.login, cs.id, cs.ip)
 	ShareLog.Printf("Valid share from %s.%s@%s", cs.login, cs.id, cs.ip)
 
 	if !ok {
-		return true, &ErrorReply{Code: -1, Message: "High rate of invalid shares"}
+		return true, errInvalidShareLimit
 	}
 
 	return true, nil
 }
 
+// parseSuggestedDiff reads the params of mining.suggest_difficulty or mining.suggest_target
+// and returns the suggestion clamped to the port bounds.
+func (s *ProxyServer) parseSuggestedDiff(cs *Session, method string, raw json.RawMessage) (int64, *ErrorReply) {
+	var diff int64
+	if method == "mining.suggest_target" {
+		var params []string
+		if err := json.Unmarshal(raw, &params); err != nil || len(params) == 0 || !hashPattern.MatchString(strings.ToLower(params[0])) {
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			return 0, &ErrorReply{Code: 27, Message: "Illegal params"}
+		}
+		bigDiff := TargetHexToDiff(params[0])
+		if bigDiff.IsInt64() {
+			diff = bigDiff.Int64()
+		} else {
+			diff = math.MaxInt64
+		}
+	} else {
+		var params []float64
+		if err := json.Unmarshal(raw, &params); err != nil || len(params) == 0 || params[0] <= 0 {
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			return 0, &ErrorReply{Code: 27, Message: "Illegal params"}
+		}
+		var err error
+		if diff, err = fromStratumDiff(params[0]); err != nil {
+			return 0, &ErrorReply{Code: 20, Message: "Other/Unknown"}
+		}
+	}
+	return cs.port.clamp(diff), nil
+}
+
+// fromStratumDiff converts a stratum share difficulty to the difficulty in hashes used internally.
+func fromStratumDiff(stratumDiff float64) (int64, error) {
+	genesisWork, err := bitcoin.GetGenesisTargetWork()
+	if err != nil {
+		return 0, err
+	}
+	if stratumDiff*genesisWork >= math.MaxInt64 {
+		return math.MaxInt64, nil
+	}
+	return int64(stratumDiff * genesisWork), nil
+}
+
+// applySuggestedDiff seeds the session difficulty with a suggestion. Before
+// mining.subscribe it is only remembered, afterwards it is sent right away.
+func (s *ProxyServer) applySuggestedDiff(cs *Session, diff int64) {
+	if cs.options.diff > 0 {
+		// the difficulty pinned in the password wins
+		return
+	}
+	diff = cs.clampDiff(diff)
+	cs.suggestedDiff = diff
+	if len(cs.sid) == 0 {
+		return
+	}
+	if cs.vardiff != nil {
+		cs.vardiff.Reset(time.Now())
+	}
+	s.retargetSession(cs, diff)
+}
+
+// changeExtranonce moves a session to a new extraNonce1 and restarts its work. Sessions
+// without mining.extranonce.subscribe can't follow and have to reconnect instead.
+func (s *ProxyServer) changeExtranonce(cs *Session, extraNonce1 string) bool {
+	if !cs.extranonceSubscribed {
+		return false
+	}
+	cs.Lock()
+	if cs.extraNonce1 == extraNonce1 {
+		cs.Unlock()
+		return true
+	}
+	// shares in flight on the current block still use the old extraNonce1
+	cs.prevExtraNonce1 = cs.extraNonce1
+	cs.extraNonce1 = extraNonce1
+	cs.Unlock()
+
+	err := cs.setExtranonce()
+	t := s.currentBlockTemplate()
+	if params := s.jobNotifyParams(t, cs.extraNonceSize(), true); err == nil && params != nil {
+		err = s.pushJob(cs, t, params)
+	}
+	if err != nil {
+		Error.Printf("Extranonce change error to %v@%v: %v", cs.login, cs.ip, err)
+		s.removeSession(cs)
+		cs.close()
+		return false
+	}
+	Info.Printf("Moved %v.%v@%v to extranonce1 %v", cs.login, cs.id, cs.ip, extraNonce1)
+	s.saveSession(cs)
+	s.setDeadline(cs)
+	return true
+}
+
 //func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
 //	t := s.currentBlockTemplate()
 //	var reply *rpc.GetBlockReplyPart
@@ -141,26 +401,40 @@ func (s *ProxyServer) handleConfigureRPC(cs *Session, params []interface{}) (int
 	// response:
 	//		{"id":3,"result":{"version-rolling":true,"version-rolling.mask":"1fffe000"},"error":null}
 	//		{"id":null,"method":"mining.set_version_mask","params":["1fffe000"]}
-	/*
-		if options, ok := params[1].(map[string]interface{}); ok {
-			if obj, ok := options["version-rolling.mask"]; ok {
-				if versionMaskStr, ok := obj.(string); ok {
-					versionMask64, err := strconv.ParseUint(versionMaskStr, 16, 32)
-					if err == nil {
-						cs.versionMask = uint32(versionMask64)
-					}
-				}
+	extensions, ok := params[0].([]interface{})
+	if !ok {
+		return nil, &ErrorReply{Code: 27, Message: "Illegal params"}
+	}
+	options, ok := params[1].(map[string]interface{})
+	if !ok {
+		return nil, &ErrorReply{Code: 27, Message: "Illegal params"}
+	}
+
+	result := map[string]interface{}{}
+	for _, ext := range extensions {
+		var reply map[string]interface{}
+		switch ext {
+		case "version-rolling":
+			var errReply *ErrorReply
+			if reply, errReply = s.negotiateVersionRolling(cs, options); errReply != nil {
+				return nil, errReply
+			}
+		case "minimum-difficulty":
+			reply = s.negotiateMinimumDifficulty(cs, options)
+		case "subscribe-extranonce":
+			reply = s.negotiateSubscribeExtranonce(cs)
+		case "info":
+			reply = s.negotiateInfo(cs, options)
+		default:
+			// unsupported extensions are refused, so that the miner doesn't rely on them
+			if name, ok := ext.(string); ok {
+				reply = map[string]interface{}{name: false}
 			}
 		}
-	*/
-
-	// 这里响应的是虚假的版本掩码。在连接服务器后将通过 mining.set_version_mask
-	// 更新为真实的版本掩码。
-	result := map[string]interface{}{
-		"version-rolling": true,
-		//"version-rolling.mask": fmt.Sprintf("%08x", cs.versionMask)}
-		"version-rolling.mask": Bip320MaskStr}
+		for k, v := range reply {
+			result[k] = v
+		}
+	}
+	s.saveWorkerInfo(cs)
 	return result, nil
-	//}
-	//return nil, nil
 }
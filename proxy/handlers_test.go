@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	. "github.com/PowPool/btcpool/util"
+)
+
+func TestMain(m *testing.M) {
+	dir, _ := os.MkdirTemp("", "proxy")
+	InitLog(filepath.Join(dir, "info.log"), filepath.Join(dir, "error.log"),
+		filepath.Join(dir, "share.log"), filepath.Join(dir, "block.log"), ERROR)
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestParseSuggestedDiff(t *testing.T) {
+	s := &ProxyServer{config: &Config{}}
+	cs := &Session{port: &stratumPort{minDiff: 1 << 20, maxDiff: 1 << 40}}
+	genesisWork, _ := bitcoin.GetGenesisTargetWork()
+
+	diff, errReply := s.parseSuggestedDiff(cs, "mining.suggest_difficulty", json.RawMessage(`[16]`))
+	if errReply != nil || diff != int64(16*genesisWork) {
+		t.Errorf("Unexpected suggested difficulty %v %v", diff, errReply)
+	}
+
+	diff, _ = s.parseSuggestedDiff(cs, "mining.suggest_difficulty", json.RawMessage(`[0.000001]`))
+	if diff != 1<<20 {
+		t.Errorf("Suggestion must be clamped to minDiff, got %v", diff)
+	}
+
+	target := "0000000000000000000000000000000000000000000000000000000000000001"
+	diff, _ = s.parseSuggestedDiff(cs, "mining.suggest_target", json.RawMessage(`["`+target+`"]`))
+	if diff != 1<<40 {
+		t.Errorf("Suggestion must be clamped to maxDiff, got %v", diff)
+	}
+
+	target = "00000000ffff0000000000000000000000000000000000000000000000000000"
+	diff, _ = s.parseSuggestedDiff(cs, "mining.suggest_target", json.RawMessage(`["`+target+`"]`))
+	if diff <= 1<<20 || diff >= 1<<40 {
+		t.Errorf("Unexpected suggested difficulty %v", diff)
+	}
+}
+
+func TestChangeExtranonce(t *testing.T) {
+	s := &ProxyServer{config: &Config{}, sessions: make(map[*Session]struct{})}
+	server, client := net.Pipe()
+	defer client.Close()
+	cs := &Session{conn: server, enc: json.NewEncoder(server), port: &stratumPort{timeout: time.Minute}, extraNonce1: "00010001",
+		jobTargets: map[string]string{"1": "ff"}}
+
+	if s.changeExtranonce(cs, "00010002") {
+		t.Error("Session without mining.extranonce.subscribe can't change extranonce1")
+	}
+
+	cs.extranonceSubscribed = true
+	done := make(chan bool)
+	go func() {
+		done <- s.changeExtranonce(cs, "00010002")
+	}()
+	var msg JSONPushMessage
+	if err := json.NewDecoder(client).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if !<-done || cs.extraNonce1 != "00010002" {
+		t.Error("Subscribed session must be moved to the new extranonce1")
+	}
+	if sent, _ := cs.jobState("1"); !sent || cs.previousExtraNonce1() != "00010001" {
+		t.Error("Work in flight must stay valid with the previous extranonce1")
+	}
+	if msg.Method != "mining.set_extranonce" || len(msg.Params.([]interface{})) != 2 || msg.Params.([]interface{})[0] != "00010002" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+}
+
+func TestSessionJobState(t *testing.T) {
+	cs := &Session{enc: json.NewEncoder(io.Discard)}
+	job := func(id, prevHash string, clean bool) []interface{} {
+		return []interface{}{id, prevHash, "cb1", "cb2", []string{}, "20000000", "1d00ffff", "66da656c", clean}
+	}
+	for _, params := range [][]interface{}{job("1", "a", true), job("2", "a", false), job("3", "b", true), job("4", "b", false)} {
+		if err := cs.pushNewJob(params); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, state := range map[string][2]bool{"3": {true, false}, "4": {true, false}, "1": {false, true}, "2": {false, true}, "5": {false, false}} {
+		if sent, stale := cs.jobState(id); sent != state[0] || stale != state[1] {
+			t.Errorf("Job %v: expected sent %v stale %v, got %v %v", id, state[0], state[1], sent, stale)
+		}
+	}
+	cs.prevExtraNonce1 = "00010001"
+	if err := cs.pushNewJob(job("5", "b", true)); err != nil {
+		t.Fatal(err)
+	}
+	if sent, _ := cs.jobState("3"); !sent || cs.previousExtraNonce1() == "" {
+		t.Error("Clean jobs on the same block must not end earlier jobs")
+	}
+	if err := cs.pushNewJob(job("6", "c", true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, stale := cs.jobState("5"); !stale || cs.previousExtraNonce1() != "" {
+		t.Error("A new block must end earlier jobs and the previous extranonce1")
+	}
+	if !isShareRejection(errStaleJob) || isShareRejection(errInvalidShareLimit) || isShareRejection(&ErrorReply{Code: 28, Message: "Stale job"}) {
+		t.Error("Only the share rejection replies keep the session open")
+	}
+}
+
+func TestRejectCodes(t *testing.T) {
+	codes := make(map[int]bool)
+	for errReply := range rejectReasons {
+		if codes[errReply.Code] {
+			t.Errorf("%v must have its own error code, got %v", errReply.Message, errReply.Code)
+		}
+		codes[errReply.Code] = true
+	}
+}
+
+func TestRetargetKeepsJobs(t *testing.T) {
+	s := &ProxyServer{config: &Config{}}
+	tpl := &BlockTemplate{Version: 0x20000000, PrevHash: strings.Repeat("ab", 32), NBits: 0x1d00ffff, lastBlkTplId: "j1",
+		BlockTplJobMap: map[string]BlockTemplateJob{"j1": {BlkTplJobId: "j1", CoinBase1: "cb1", CoinBase2: "cb2"}}}
+	s.blockTemplate.Store(tpl)
+	server, client := net.Pipe()
+	defer client.Close()
+	cs := &Session{conn: server, enc: json.NewEncoder(io.Discard), port: &stratumPort{timeout: time.Minute},
+		extraNonce1: "00010001", extraNonce2Size: bitcoin.EXTRANONCE2_SIZE, targetNextJob: GetTargetHex(1000)}
+	if err := s.pushJob(cs, tpl, s.jobNotifyParams(tpl, cs.extraNonceSize(), true)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.retargetSession(cs, 100000)
+	if errReply := s.checkSessionJob(cs, "j1"); errReply != nil {
+		t.Fatalf("Share on the job before the retarget must not be rejected, got %v", errReply)
+	}
+	if cs.jobTarget("j1") != GetTargetHex(1000) || cs.currentTarget() != GetTargetHex(100000) {
+		t.Errorf("Job resent by the retarget must keep the easier target, got %v", cs.jobTarget("j1"))
+	}
+}
+
+func TestExtraNonceSizes(t *testing.T) {
+	s := &ProxyServer{config: &Config{Id: 1}}
+	p := s.newStratumPort(&Stratum{Timeout: "60s", ExtraNonce1Size: 5, ExtraNonce2Size: 6, MaxConn: 1024}, 1024)
+	s.ports = []*stratumPort{p}
+
+	if en1 := s.extraNonce1ForTag(0x10203, p.extraNonce1Size); en1 != "0001010203" {
+		t.Errorf("Unexpected extranonce1 %v", en1)
+	}
+	if sizes := s.extraNonceSizes(); len(sizes) != 2 || sizes[1] != 11 {
+		t.Errorf("Unexpected extra nonce sizes %v", sizes)
+	}
+	if !extraNonce2Valid("00112233aabb", 6) {
+		t.Error("Extranonce2 of the configured size must be valid")
+	}
+	for _, eNonce2 := range []string{"00112233", "00112233aabbcc", "00112233AABB", "00112233aabx"} {
+		if extraNonce2Valid(eNonce2, 6) {
+			t.Errorf("Extranonce2 %v must be invalid", eNonce2)
+		}
+	}
+}
+
+func TestAcquireTag(t *testing.T) {
+	s := &ProxyServer{config: &Config{Id: 1}, sessions: make(map[*Session]struct{}), stratumTags: make(chan int, 3)}
+	p := &stratumPort{extraNonce1Size: 4}
+	s.ports = []*stratumPort{p, {sessionExpiry: 90 * time.Second}, {sessionExpiry: time.Minute}}
+	s.stratumTags <- 1
+	s.stratumTags <- 2
+	// a resumed session kept the extranonce1 of tag 0
+	s.registerSession(&Session{tag: 5, extraNonce1: "00010000"})
+
+	if tag := s.acquireTag(p, 0); tag != 1 {
+		t.Errorf("Extranonce1 of a resumed session must not be handed out, got tag %v", tag)
+	}
+	if tag := s.acquireTag(p, 2); tag != 2 {
+		t.Errorf("Free tag must be kept, got %v", tag)
+	}
+	if intv := s.sessionLeaseInterval(); intv != 20*time.Second {
+		t.Errorf("Leases must be renewed well before the shortest expiry, got %v", intv)
+	}
+}
+
+func TestParseMinerOptions(t *testing.T) {
+	genesisWork, err := bitcoin.GetGenesisTargetWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payout := "bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03"
+
+	opts, errReply := parseMinerOptions("x,d=65536;mindiff=1024 maxdiff=131072,payout=" + payout + ",foo=bar")
+	if errReply != nil {
+		t.Fatal(errReply)
+	}
+	if opts.diff != int64(65536*genesisWork) || opts.minDiff != int64(1024*genesisWork) || opts.maxDiff != int64(131072*genesisWork) {
+		t.Errorf("Unexpected difficulties %+v", opts)
+	}
+	if opts.payout != payout {
+		t.Errorf("Unexpected payout %v", opts.payout)
+	}
+
+	for _, password := range []string{"d=abc", "d=-1", "mindiff=2,maxdiff=1", "payout=1abc"} {
+		if _, errReply := parseMinerOptions(password); errReply == nil {
+			t.Errorf("Password %v must be rejected", password)
+		}
+	}
+	if opts, errReply := parseMinerOptions("x"); errReply != nil || opts != (minerOptions{}) {
+		t.Errorf("Plain password must not set options: %+v %v", opts, errReply)
+	}
+}
+
+func TestHandleConfigureRPC(t *testing.T) {
+	genesisWork, err := bitcoin.GetGenesisTargetWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ProxyServer{config: &Config{}}
+	s.initVersionMask(&Proxy{})
+	cs := &Session{port: &stratumPort{}}
+
+	reply, errReply := s.handleConfigureRPC(cs, []interface{}{
+		[]interface{}{"minimum-difficulty", "subscribe-extranonce", "info", "unknown"},
+		map[string]interface{}{
+			"minimum-difficulty.value": float64(2048),
+			"info.connection-url":      "stratum+tcp://pool:3333",
+			"info.hw-version":          "S19",
+		},
+	})
+	if errReply != nil {
+		t.Fatal(errReply)
+	}
+	result := reply.(map[string]interface{})
+	if result["minimum-difficulty"] != true || result["subscribe-extranonce"] != true || result["info"] != true || result["unknown"] != false {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if _, ok := result["version-rolling"]; ok {
+		t.Error("Version rolling must only be answered when requested")
+	}
+	if cs.minimumDiff != int64(2048*genesisWork) || !cs.extranonceSubscribed {
+		t.Errorf("Unexpected session state %+v", cs)
+	}
+	if cs.workerInfo == nil || cs.workerInfo.ConnectionUrl != "stratum+tcp://pool:3333" || cs.workerInfo.HwVersion != "S19" {
+		t.Errorf("Unexpected worker info %+v", cs.workerInfo)
+	}
+	if diff := cs.clampDiff(1); diff != cs.minimumDiff {
+		t.Errorf("Difficulty must not go below the minimum, got %v", diff)
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/PowPool/btcpool/rpc"
+	. "github.com/PowPool/btcpool/util"
+)
+
+const (
+	defaultLongPollTimeout       = 10 * time.Minute
+	defaultLongPollRetryInterval = 5 * time.Second
+)
+
+// initLongPoll creates a client per upstream for longpoll requests, they stay
+// pending far longer than the upstream timeout allows.
+func (s *ProxyServer) initLongPoll(cfg *LongPoll, upstreams []Upstream) {
+	timeout := defaultLongPollTimeout
+	if len(cfg.Timeout) > 0 {
+		timeout = MustParseDuration(cfg.Timeout)
+	}
+	s.longPollReplies = make(chan *rpc.GetBlockTemplateReplyPart, 1)
+	s.longPollClients = make([]*rpc.RPCClient, len(upstreams))
+	for i, u := range upstreams {
+		s.longPollClients[i] = rpc.NewRPCClient(u.Name, u.Url, timeout.String())
+	}
+	Info.Printf("Longpoll block templates with timeout %v", timeout)
+}
+
+// longPoll waits for the templates that replace the current one on the current
+// upstream and hands them to the block refresh.
+func (s *ProxyServer) longPoll() {
+	var longPollId string
+	for {
+		upstream := atomic.LoadInt32(&s.upstream)
+		if len(longPollId) == 0 {
+			if t := s.currentBlockTemplate(); t != nil {
+				longPollId = t.longPollId
+			}
+		}
+		if len(longPollId) == 0 {
+			time.Sleep(defaultLongPollRetryInterval)
+			continue
+		}
+
+		client := s.longPollClients[upstream]
+		reply, err := client.GetPendingBlockLongPoll(longPollId)
+		if err != nil || reply == nil {
+			Error.Printf("Error while longpolling block template on %s: %v", client.Name, err)
+			longPollId = ""
+			time.Sleep(defaultLongPollRetryInterval)
+			continue
+		}
+		if upstream != atomic.LoadInt32(&s.upstream) {
+			longPollId = ""
+			continue
+		}
+		longPollId = reply.LongPollId
+		s.longPollReplies <- reply
+	}
+}
+
+// applyLongPollReply refreshes the jobs with a template returned by a longpoll.
+func (s *ProxyServer) applyLongPollReply(reply *rpc.GetBlockTemplateReplyPart) {
+	t := s.currentBlockTemplate()
+	// polling got the template first, or moved past it
+	if t != nil && (reply.LongPollId == t.longPollId || reply.Height < t.Height) {
+		return
+	}
+	s.updateBlockTemplate(s.rpc(), reply)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PowPool/btcpool/rpc"
+)
+
+func TestLongPoll(t *testing.T) {
+	txs := []map[string]interface{}{{"data": "00", "txid": strings.Repeat("ab", 32), "fee": 5000}}
+	template := func(longPollId string) map[string]interface{} {
+		return map[string]interface{}{"version": 0x20000000, "previousblockhash": emptyJobTip, "coinbasevalue": 312500000 + 5000*len(txs),
+			"curtime": 1690168700, "mintime": 1690166001, "bits": "17053894", "height": 800001, "longpollid": longPollId,
+			"target": "0000000000000000000538940000000000000000000000000000000000000000", "transactions": txs}
+	}
+	longPolls := make(chan string, 1)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string                   `json:"method"`
+			Params []map[string]interface{} `json:"params"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var result interface{}
+		switch req.Method {
+		case "getbestblockhash":
+			result = emptyJobTip
+		case "getblocktemplate":
+			id, _ := req.Params[0]["longpollid"].(string)
+			switch id {
+			case "":
+				result = template(emptyJobTip + "1")
+			case emptyJobTip + "1":
+				longPolls <- id
+				// a high fee transaction enters the mempool
+				txs = append(txs, map[string]interface{}{"data": "01", "txid": strings.Repeat("cd", 32), "fee": 90000})
+				result = template(emptyJobTip + "2")
+			default:
+				http.Error(w, "no new template", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": result})
+	}))
+	defer node.Close()
+
+	s := &ProxyServer{config: &Config{Proxy: Proxy{BlockTemplateInterval: "10m"}, UpstreamCoinBase: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"},
+		upstreams: []*rpc.RPCClient{rpc.NewRPCClient("node", node.URL, "5s")}}
+	s.fetchBlockTemplate()
+	if tpl := s.currentBlockTemplate(); tpl == nil || tpl.longPollId != emptyJobTip+"1" {
+		t.Fatal("Template must keep its longpollid")
+	}
+
+	s.initLongPoll(&LongPoll{Enabled: true}, []Upstream{{Name: "node", Url: node.URL}})
+	go s.longPoll()
+	var reply *rpc.GetBlockTemplateReplyPart
+	select {
+	case reply = <-s.longPollReplies:
+	case <-time.After(time.Second):
+		t.Fatal("Longpoll must return the new template")
+	}
+	if id := <-longPolls; id != emptyJobTip+"1" {
+		t.Errorf("Longpoll must pass the longpollid of the current template, got %v", id)
+	}
+
+	s.applyLongPollReply(reply)
+	tpl := s.currentBlockTemplate()
+	job := tpl.BlockTplJobMap[tpl.lastBlkTplId]
+	if tpl.longPollId != emptyJobTip+"2" || len(job.TxIdList) != 2 || job.JobTxsFeeTotal != 95000 || tpl.newBlkTpl {
+		t.Errorf("Jobs must be refreshed with the longpoll template, got %+v", job)
+	}
+
+	// a template already applied is not applied twice
+	s.applyLongPollReply(reply)
+	if len(s.currentBlockTemplate().BlockTplJobMap) != 2 {
+		t.Error("Longpoll template must only be applied once")
+	}
+}
@@ -3,9 +3,11 @@ package proxy
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"io"
 	"math/big"
 	"strconv"
+	"time"
 
 	. "github.com/PowPool/btcpool/util"
 	"github.com/mutalisk999/bitcoin-lib/src/blob"
@@ -15,8 +17,12 @@ import (
 	"github.com/mutalisk999/txid_merkle_tree"
 )
 
-func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int64, t *BlockTemplate, params []string) (bool, bool) {
+// processShare checks a share and records it, solo is the job of shares of solo sessions.
+func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int64, versionMask uint32, t *BlockTemplate, params []string, solo *soloJob) *ErrorReply {
 	tplJobId := params[1]
+	if solo != nil {
+		tplJobId = solo.tplJobId
+	}
 	eNonce2Hex := params[2]
 	nTimeHex := params[3]
 	nonceHex := params[4]
@@ -26,40 +32,46 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 		var err error
 		versionBits, err = HexStringToUint32(params[5])
 		if err != nil {
-			return false, false
+			return errInvalidVersionBits
 		}
 		// 确保 versionBits 只在 version_mask 允许的位上设置为 1
-		if versionBits & ^Bip320Mask != 0 {
-			return false, false
+		if versionBits & ^versionMask != 0 {
+			return errInvalidVersionBits
 		}
 	}
 
 	h, ok := t.BlockTplJobMap[tplJobId]
 	if !ok {
-		Error.Printf("Stale share from %v.%v@%v", login, id, ip)
-		ShareLog.Printf("Stale share from %v.%v@%v", login, id, ip)
+		return errStaleJob
+	}
 
-		ms := MakeTimestamp()
-		ts := ms / 1000
+	// bitcoind refuses blocks outside these bounds, found blocks would be lost
+	if !s.nTimeValid(&h, nTimeHex, s.now().Unix()) {
+		Error.Printf("Invalid nTime %v from %v.%v@%v", nTimeHex, login, id, ip)
+		return errInvalidNTime
+	}
 
-		err := s.backend.WriteInvalidShare(ms, ts, login, id, shareDiff)
-		if err != nil {
-			Error.Println("Failed to insert invalid share data into backend:", err)
-		}
-		return false, false
+	coinBase1, ok := h.coinBase1(len(eNonce1)/2 + len(eNonce2Hex)/2)
+	coinBase2 := h.CoinBase2
+	if solo != nil {
+		coinBase1, coinBase2, ok = solo.coinBase1, solo.coinBase2, true
+	}
+	if !ok {
+		Error.Printf("No coinbase for the extra nonce size of %v.%v@%v", login, id, ip)
+		return errInvalidShare
 	}
 
 	nVersion := t.Version
-	// 根据矿工提交的versionBits,原始的t.Version,versionMask Bip320Mask,重新计算nVersion
+	// 根据矿工提交的versionBits,原始的t.Version,会话协商的versionMask,重新计算nVersion
 	if versionBits != 0 {
 		//actualVersion = (t.Version & Bip320Mask) | (versionBits & ^Bip320Mask)
-		nVersion = (t.Version & ^Bip320Mask) | (versionBits & Bip320Mask)
+		nVersion = (t.Version & ^versionMask) | (versionBits & versionMask)
 	}
 	// share 和 block 都使用 nVersion
 	share := Block{
 		difficulty:   big.NewInt(shareDiff),
-		coinBase1:    h.CoinBase1,
-		coinBase2:    h.CoinBase2,
+		coinBase1:    coinBase1,
+		coinBase2:    coinBase2,
 		extraNonce1:  eNonce1,
 		extraNonce2:  eNonce2Hex,
 		merkleBranch: h.MerkleBranch,
@@ -72,8 +84,8 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 
 	block := Block{
 		difficulty:   t.Difficulty,
-		coinBase1:    h.CoinBase1,
-		coinBase2:    h.CoinBase2,
+		coinBase1:    coinBase1,
+		coinBase2:    coinBase2,
 		extraNonce1:  eNonce1,
 		extraNonce2:  eNonce2Hex,
 		merkleBranch: h.MerkleBranch,
@@ -85,22 +97,29 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 	}
 
 	if !DoubleSha256HashVerify(&share) {
-		ms := MakeTimestamp()
-		ts := ms / 1000
-
-		err := s.backend.WriteRejectShare(ms, ts, login, id, shareDiff)
-		if err != nil {
-			Error.Println("Failed to insert reject share data into backend:", err)
-		}
-		return false, false
+		return errLowDifficulty
 	}
 
 	paramIn := []string{nonceHex, eNonce1, eNonce2Hex}
-	if DoubleSha256HashVerify(&block) {
+	// solo coinbases carry no merged mining commitment
+	if solo == nil && h.AuxWork != nil && s.replay == nil {
+		s.submitAuxBlocks(h.AuxWork, &share, &h, login, id, ip, shareDiff, paramIn)
+	}
+	isBlock := DoubleSha256HashVerify(&block)
+	if isBlock && h.empty() && s.now().After(h.EmptyDeadline) {
+		Info.Printf("Share of %v.%v@%v meets the network target on an expired empty job, block not submitted", login, id, ip)
+		BlockLog.Printf("Share of %v.%v@%v meets the network target on an expired empty job, block not submitted", login, id, ip)
+		isBlock = false
+	}
+	if isBlock {
+		if s.replay != nil {
+			Info.Printf("Replayed share of %v.%v@%v meets the network target, block not submitted", login, id, ip)
+			return nil
+		}
 		// construct new block
 		rawBlockHex, err := ConstructRawBlockHex(&block, &h, t)
 		if err != nil {
-			return false, false
+			return errInvalidShare
 		}
 		err = s.rpc().SubmitBlock([]interface{}{rawBlockHex})
 		if err != nil {
@@ -108,17 +127,16 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 			BlockLog.Printf("Block submission failure at height %v for %v: %v", t.Height, t.PrevHash, err)
 		} else {
 			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, paramIn, shareDiff, t.Difficulty.Int64(), uint64(t.Height),
-				h.CoinBaseValue, h.JobTxsFeeTotal, s.hashrateExpiration)
+			var exist bool
+			if solo != nil {
+				exist, err = s.backend.WriteSoloBlock(login, id, paramIn, shareDiff, t.Difficulty.Int64(), uint64(t.Height),
+					h.CoinBaseValue, h.JobTxsFeeTotal, solo.fee, s.hashrateExpiration)
+			} else {
+				exist, err = s.backend.WriteBlock(login, id, paramIn, shareDiff, t.Difficulty.Int64(), uint64(t.Height),
+					h.CoinBaseValue, h.JobTxsFeeTotal, s.hashrateExpiration)
+			}
 			if exist {
-				ms := MakeTimestamp()
-				ts := ms / 1000
-
-				err := s.backend.WriteInvalidShare(ms, ts, login, id, shareDiff)
-				if err != nil {
-					Error.Println("Failed to insert invalid share data into backend:", err)
-				}
-				return true, false
+				return errDuplicateShare
 			}
 			if err != nil {
 				Error.Println("Failed to insert block candidate into backend:", err)
@@ -127,48 +145,100 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 				Info.Printf("Inserted block %v to backend", t.Height)
 				BlockLog.Printf("Inserted block %v to backend", t.Height)
 			}
-			Info.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
-			BlockLog.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+			if solo != nil {
+				Info.Printf("Solo block found by miner %v@%v at height %d", login, ip, t.Height)
+				BlockLog.Printf("Solo block found by miner %v@%v at height %d", login, ip, t.Height)
+			} else {
+				Info.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+				BlockLog.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+			}
 		}
 	} else {
-		exist, err := s.backend.WriteShare(login, id, paramIn, shareDiff, uint64(t.Height), s.hashrateExpiration)
+		var exist bool
+		var err error
+		if solo != nil {
+			exist, err = s.backend.WriteSoloShare(login, id, paramIn, shareDiff, uint64(t.Height), s.hashrateExpiration)
+		} else {
+			exist, err = s.backend.WriteShare(login, id, paramIn, shareDiff, uint64(t.Height), s.hashrateExpiration)
+		}
 		if exist {
-			ms := MakeTimestamp()
-			ts := ms / 1000
-
-			err := s.backend.WriteInvalidShare(ms, ts, login, id, shareDiff)
-			if err != nil {
-				Error.Println("Failed to insert invalid share data into backend:", err)
-			}
-			return true, false
+			return errDuplicateShare
 		}
 		if err != nil {
 			Error.Println("Failed to insert share data into backend:", err)
 		}
 	}
-	return false, true
+	return nil
+}
+
+const defaultNTimeRollWindow = 10 * time.Minute
+
+func nTimeRollWindow(cfg *Proxy) time.Duration {
+	if len(cfg.NTimeRollWindow) > 0 {
+		return MustParseDuration(cfg.NTimeRollWindow)
+	}
+	return defaultNTimeRollWindow
+}
+
+// nTimeValid checks nTime against the template bounds. Miners may roll it up to
+// the roll window past the current time or curtime, whichever is later.
+func (s *ProxyServer) nTimeValid(h *BlockTemplateJob, nTimeHex string, now int64) bool {
+	nTime, err := strconv.ParseUint(nTimeHex, 16, 32)
+	if err != nil {
+		return false
+	}
+	minTime := h.MinTime
+	if minTime == 0 {
+		minTime = h.BlkTplJobTime
+	}
+	maxTime := now
+	if int64(h.BlkTplJobTime) > maxTime {
+		maxTime = int64(h.BlkTplJobTime)
+	}
+	maxTime += int64(s.nTimeRollWindow.Seconds())
+	if h.MaxTime > 0 && int64(h.MaxTime) < maxTime {
+		maxTime = int64(h.MaxTime)
+	}
+	return nTime >= uint64(minTime) && int64(nTime) <= maxTime
 }
 
 func DoubleSha256HashVerify(oBlock *Block) bool {
-	bytes1, err := hex.DecodeString(oBlock.coinBase1)
+	_, header, err := packBlockHeader(oBlock)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode coinBase1 error")
+		Error.Println("DoubleSha256HashVerify:", err)
+		return false
+	}
+
+	// calc block header hash (double sha256)
+	hashDiff := headerHashDiff(header)
+
+	Debug.Printf("hashDiff: %v", hashDiff)
+	Debug.Printf("oBlock.difficulty: %v", oBlock.difficulty)
+
+	if hashDiff.Cmp(oBlock.difficulty) > 0 {
+		return true
+	} else {
 		return false
 	}
+}
+
+// packBlockHeader returns the coinbase transaction and the header of oBlock.
+func packBlockHeader(oBlock *Block) ([]byte, []byte, error) {
+	bytes1, err := hex.DecodeString(oBlock.coinBase1)
+	if err != nil {
+		return nil, nil, errors.New("hex decode coinBase1 error")
+	}
 	bytes2, err := hex.DecodeString(oBlock.extraNonce1)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode extraNonce1 error")
-		return false
+		return nil, nil, errors.New("hex decode extraNonce1 error")
 	}
 	bytes3, err := hex.DecodeString(oBlock.extraNonce2)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode extraNonce2 error")
-		return false
+		return nil, nil, errors.New("hex decode extraNonce2 error")
 	}
 	bytes4, err := hex.DecodeString(oBlock.coinBase2)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode coinBase2 error")
-		return false
+		return nil, nil, errors.New("hex decode coinBase2 error")
 	}
 
 	Debug.Printf("block.coinBase1: %s", oBlock.coinBase1)
@@ -183,15 +253,13 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	var cbTrx transaction.Transaction
 	err = cbTrx.UnPack(bufReader)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: unpack coinBase transaction error")
-		return false
+		return nil, nil, errors.New("unpack coinBase transaction error")
 	}
 
 	// get coin base transaction id
 	cbTrxId, err := cbTrx.CalcTrxId()
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: CalcTrxId error")
-		return false
+		return nil, nil, errors.New("CalcTrxId error")
 	}
 
 	Debug.Printf("coinBase trx id: %s", cbTrxId.GetHex())
@@ -200,8 +268,7 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	// get merkle root hash
 	merkleRootHex, err := txid_merkle_tree.GetMerkleRootHexFromCoinBaseAndMerkleBranch(cbTrxId.GetHex(), oBlock.merkleBranch)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
-		return false
+		return nil, nil, errors.New("GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
 	}
 
 	Debug.Printf("merkleRootHex: %s", merkleRootHex)
@@ -211,25 +278,21 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	blockHeader.Version = int32(oBlock.nVersion)
 	err = blockHeader.HashPrevBlock.SetHex(oBlock.prevHash)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: HashPrevBlock SetHex error")
-		return false
+		return nil, nil, errors.New("HashPrevBlock SetHex error")
 	}
 	err = blockHeader.HashMerkleRoot.SetHex(merkleRootHex)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: HashMerkleRoot SetHex error")
-		return false
+		return nil, nil, errors.New("HashMerkleRoot SetHex error")
 	}
 	nTime, err := strconv.ParseUint(oBlock.sTime, 16, 32)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: ParseUint sTime error")
-		return false
+		return nil, nil, errors.New("ParseUint sTime error")
 	}
 	blockHeader.Time = uint32(nTime)
 	blockHeader.Bits = oBlock.nBits
 	nNonce, err := strconv.ParseUint(oBlock.sNonce, 16, 32)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: ParseUint sNonce error")
-		return false
+		return nil, nil, errors.New("ParseUint sNonce error")
 	}
 	blockHeader.Nonce = uint32(nNonce)
 
@@ -237,8 +300,7 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	bufWriter := io.Writer(bytesBuf)
 	err = blockHeader.Pack(bufWriter)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: blockHeader Pack error")
-		return false
+		return nil, nil, errors.New("blockHeader Pack error")
 	}
 
 	Debug.Printf("blockHeader.Version: %d", blockHeader.Version)
@@ -249,22 +311,16 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	Debug.Printf("blockHeader.Nonce: %d", blockHeader.Nonce)
 
 	Debug.Printf("blockHeader Hex: %s", hex.EncodeToString(bytesBuf.Bytes()))
-	//Debug.Printf("oBlock.difficulty: %v", oBlock.difficulty)
 
-	// calc block header hash (double sha256)
-	bytesRes := utility.Sha256(utility.Sha256(bytesBuf.Bytes()))
+	return bytesCoinBaseTx, bytesBuf.Bytes(), nil
+}
+
+// headerHashDiff returns the difficulty the double sha256 hash of header meets.
+func headerHashDiff(header []byte) *big.Int {
+	bytesRes := utility.Sha256(utility.Sha256(header))
 	var res blob.Baseblob
 	res.SetData(bytesRes)
 	resHex := res.GetHex()
 	Debug.Printf("Target Hex: %064s", resHex)
-	hashDiff := TargetHexToDiff(resHex)
-
-	Debug.Printf("hashDiff: %v", hashDiff)
-	Debug.Printf("oBlock.difficulty: %v", oBlock.difficulty)
-
-	if hashDiff.Cmp(oBlock.difficulty) > 0 {
-		return true
-	} else {
-		return false
-	}
+	return TargetHexToDiff(resHex)
 }
@@ -18,3 +18,30 @@ func TestDoubleSha256Hash(t *testing.T) {
 	}
 	fmt.Println("b1r: ", hex.EncodeToString(b1r))
 }
+
+func TestNTimeValid(t *testing.T) {
+	s := &ProxyServer{nTimeRollWindow: defaultNTimeRollWindow}
+	now := int64(1700000600)
+	h := &BlockTemplateJob{BlkTplJobTime: 1700000000, MinTime: 1699999000}
+
+	for nTime, valid := range map[uint32]bool{
+		1699998999: false, // before mintime
+		1699999000: true,
+		1700000000: true,
+		1700001200: true, // now plus the roll window
+		1700001201: false,
+	} {
+		if s.nTimeValid(h, fmt.Sprintf("%08x", nTime), now) != valid {
+			t.Errorf("nTime %v: expected valid %v", nTime, valid)
+		}
+	}
+
+	h.MaxTime = 1700000700
+	if s.nTimeValid(h, fmt.Sprintf("%08x", 1700000701), now) {
+		t.Error("nTime after maxtime must be invalid")
+	}
+	h.MinTime = 0
+	if s.nTimeValid(h, fmt.Sprintf("%08x", 1699999999), now) {
+		t.Error("nTime before curtime must be invalid without mintime")
+	}
+}
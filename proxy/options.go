@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// minerOptions are the options a miner passes in the mining.authorize password,
+// e.g. "d=65536,mindiff=1024,payout=<address>". Difficulties are in hashes.
+type minerOptions struct {
+	// pinned difficulty, vardiff is disabled for the session
+	diff    int64
+	minDiff int64
+	maxDiff int64
+	// address credited instead of the login
+	payout string
+}
+
+// parseMinerOptions reads key=value pairs separated by commas, semicolons or spaces.
+// Other words such as the usual "x" password and unknown keys are ignored.
+func parseMinerOptions(password string) (minerOptions, *ErrorReply) {
+	var opts minerOptions
+	fields := strings.FieldsFunc(password, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t'
+	})
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(kv[0]), kv[1]
+
+		switch key {
+		case "d", "mindiff", "maxdiff":
+			stratumDiff, err := strconv.ParseFloat(value, 64)
+			if err != nil || stratumDiff <= 0 {
+				return opts, &ErrorReply{Code: -1, Message: "Invalid password option " + key}
+			}
+			diff, err := fromStratumDiff(stratumDiff)
+			if err != nil {
+				return opts, &ErrorReply{Code: 20, Message: "Other/Unknown"}
+			}
+			switch key {
+			case "d":
+				opts.diff = diff
+			case "mindiff":
+				opts.minDiff = diff
+			case "maxdiff":
+				opts.maxDiff = diff
+			}
+		case "payout":
+			if !IsValidBTCAddress(value) {
+				return opts, &ErrorReply{Code: -1, Message: "Invalid payout address"}
+			}
+			opts.payout = value
+		}
+	}
+	if opts.minDiff > 0 && opts.maxDiff > 0 && opts.minDiff > opts.maxDiff {
+		return opts, &ErrorReply{Code: -1, Message: "Invalid password option mindiff"}
+	}
+	return opts, nil
+}
+
+func (o *minerOptions) clamp(diff int64) int64 {
+	if o.minDiff > 0 && diff < o.minDiff {
+		diff = o.minDiff
+	}
+	if o.maxDiff > 0 && diff > o.maxDiff {
+		diff = o.maxDiff
+	}
+	return diff
+}
+
+// applyMinerOptions stores the options of an authorized session. The difficulty
+// is only sent with applyMinerDiff, after the authorize response.
+func (s *ProxyServer) applyMinerOptions(cs *Session, opts minerOptions) {
+	cs.options = opts
+	if opts.diff > 0 {
+		cs.options.diff = cs.port.clamp(cs.clampDiff(opts.diff))
+		// the pinned difficulty replaces vardiff
+		cs.vardiff = nil
+	}
+	if cs.vardiff != nil {
+		cs.vardiff.Limit(opts.minDiff, opts.maxDiff)
+	}
+	if len(opts.payout) > 0 {
+		Info.Printf("Stratum miner %v.%v@%v pays out to %v", cs.login, cs.id, cs.ip, opts.payout)
+		cs.login = opts.payout
+	}
+}
+
+// clampDiff applies the bounds the miner asked for, with the password or mining.configure.
+func (cs *Session) clampDiff(diff int64) int64 {
+	diff = cs.options.clamp(diff)
+	if diff < cs.minimumDiff {
+		diff = cs.minimumDiff
+	}
+	return diff
+}
+
+// applyMinerDiff retargets the session if its difficulty doesn't match the miner options
+// or the minimum difficulty from mining.configure.
+func (s *ProxyServer) applyMinerDiff(cs *Session) {
+	if len(cs.sid) == 0 {
+		return
+	}
+	cur := TargetHexToDiff(cs.targetNextJob).Int64()
+	diff := cs.clampDiff(cur)
+	if cs.options.diff > 0 {
+		diff = cs.options.diff
+	}
+	if diff != cur {
+		s.retargetSession(cs, diff)
+	}
+}
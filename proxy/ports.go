@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// stratumPort is the profile of a stratum listener. Its sessions inherit the
+// start difficulty, difficulty bounds and extra nonce sizes of the port
+// instead of the pool wide settings.
+type stratumPort struct {
+	cfg *Stratum
+	// start difficulty
+	target string
+	// bounds of vardiff and of difficulties chosen by miners, zero means unbounded
+	minDiff         int64
+	maxDiff         int64
+	vardiff         *varDiffOptions
+	extraNonce1Size int
+	extraNonce2Size int
+	timeout         time.Duration
+	// zero disables session resumption
+	sessionExpiry time.Duration
+	tenant        string
+	// sessions of the port mine solo
+	solo bool
+	// nil disables the PROXY protocol
+	trustedProxies []*net.IPNet
+}
+
+// newStratumPort builds the profile of cfg, tags is the number of session tags of all ports.
+func (s *ProxyServer) newStratumPort(cfg *Stratum, tags int) *stratumPort {
+	p := &stratumPort{
+		cfg:             cfg,
+		minDiff:         cfg.MinDiff,
+		maxDiff:         cfg.MaxDiff,
+		extraNonce1Size: cfg.ExtraNonce1Size,
+		extraNonce2Size: cfg.ExtraNonce2Size,
+		timeout:         MustParseDuration(cfg.Timeout),
+		tenant:          cfg.Tenant,
+		solo:            cfg.Solo,
+	}
+	if len(cfg.SessionExpiry) > 0 {
+		p.sessionExpiry = MustParseDuration(cfg.SessionExpiry)
+	}
+
+	if p.extraNonce1Size == 0 {
+		p.extraNonce1Size = bitcoin.EXTRANONCE1_SIZE
+	}
+	if p.extraNonce2Size == 0 {
+		p.extraNonce2Size = bitcoin.EXTRANONCE2_SIZE
+	}
+	if p.extraNonce1Size < 3 || p.extraNonce1Size > 8 || p.extraNonce2Size < 2 || p.extraNonce2Size > 16 {
+		Error.Fatalf("Stratum %s: extraNonce1Size must be within 3..8 and extraNonce2Size within 2..16", cfg.Listen)
+	}
+	if maxTags := uint64(1) << (8 * (p.extraNonce1Size - 2)); uint64(tags) > maxTags {
+		Error.Fatalf("Stratum %s: maxConn of all ports must not exceed %d with extraNonce1Size %d", cfg.Listen, maxTags, p.extraNonce1Size)
+	}
+
+	if cfg.ProxyProtocol.Enabled {
+		nets, err := parseTrustedProxies(cfg.ProxyProtocol.TrustedProxies)
+		if err != nil || len(nets) == 0 {
+			Error.Fatalf("Stratum %s: proxyProtocol needs the CIDRs of the trusted proxies: %v", cfg.Listen, err)
+		}
+		p.trustedProxies = nets
+	}
+
+	diff := s.config.Proxy.Difficulty
+	if cfg.Difficulty > 0 {
+		diff = cfg.Difficulty
+	}
+	p.target = GetTargetHex(p.clamp(diff))
+
+	if s.vardiff != nil {
+		o := *s.vardiff
+		if p.minDiff > 0 {
+			o.minDiff = p.minDiff
+		}
+		if p.maxDiff > 0 {
+			o.maxDiff = p.maxDiff
+		}
+		p.vardiff = &o
+	}
+	return p
+}
+
+// clamp limits a difficulty to the port bounds.
+func (p *stratumPort) clamp(diff int64) int64 {
+	if diff < p.minDiff {
+		diff = p.minDiff
+	}
+	if p.maxDiff > 0 && diff > p.maxDiff {
+		diff = p.maxDiff
+	}
+	if diff < 1 {
+		diff = 1
+	}
+	return diff
+}
+
+// listener wraps the listener of the port with the PROXY protocol if enabled.
+func (p *stratumPort) listener(l net.Listener) net.Listener {
+	if p.trustedProxies == nil {
+		return l
+	}
+	return &proxyListener{Listener: l, trusted: p.trustedProxies}
+}
+
+// extraNonceSizes returns the total extra nonce sizes jobs are prepared for.
+func (s *ProxyServer) extraNonceSizes() []int {
+	sizes := []int{bitcoin.EXTRANONCE1_SIZE + bitcoin.EXTRANONCE2_SIZE}
+	for _, p := range s.ports {
+		size := p.extraNonce1Size + p.extraNonce2Size
+		known := false
+		for _, v := range sizes {
+			known = known || v == size
+		}
+		if !known {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+// checkExtraNonceLayouts refuses ports that build the same coinbases but split
+// the extra nonces differently. Tags are shared by all ports, so the tag of one
+// would run on into the extranonce2 of the other: with 4+8 and 5+7 bytes tag 5
+// (ID 0005 + en2) overlaps tag 1280 (ID 000500 + en2).
+func (s *ProxyServer) checkExtraNonceLayouts() {
+	extraNonce1Sizes := make(map[int]int)
+	if s.config.Proxy.StratumV2.Enabled {
+		// v2 channels take their tags from the same range
+		extraNonce1Sizes[bitcoin.EXTRANONCE1_SIZE+bitcoin.EXTRANONCE2_SIZE] = bitcoin.EXTRANONCE1_SIZE
+	}
+	for _, p := range s.ports {
+		size := p.extraNonce1Size + p.extraNonce2Size
+		if extraNonce1Size, ok := extraNonce1Sizes[size]; ok && extraNonce1Size != p.extraNonce1Size {
+			Error.Fatalf("Stratum %s: ports with %d bytes of extra nonces must use the same extraNonce1Size, got %d and %d",
+				p.cfg.Listen, size, extraNonce1Size, p.extraNonce1Size)
+		}
+		extraNonce1Sizes[size] = p.extraNonce1Size
+	}
+}
+
+func (s *ProxyServer) startStratum() {
+	tags := 0
+	for i := range s.config.Proxy.Stratum {
+		if s.config.Proxy.Stratum[i].Enabled {
+			tags += s.config.Proxy.Stratum[i].MaxConn
+		}
+	}
+	for i := range s.config.Proxy.Stratum {
+		if cfg := &s.config.Proxy.Stratum[i]; cfg.Enabled {
+			s.ports = append(s.ports, s.newStratumPort(cfg, tags))
+		}
+	}
+	if len(s.ports) == 0 {
+		return
+	}
+	s.checkExtraNonceLayouts()
+
+	s.sessions = make(map[*Session]struct{})
+	// session tags are shared by all ports
+	s.stratumTags = make(chan int, tags)
+	for i := 0; i < tags; i++ {
+		s.stratumTags <- i
+	}
+	for _, p := range s.ports {
+		if p.cfg.TLS.Enabled {
+			go s.ListenTLS(p)
+		} else {
+			go s.ListenTCP(p)
+		}
+	}
+}
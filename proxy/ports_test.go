@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+func TestStratumPortProfile(t *testing.T) {
+	s := &ProxyServer{config: &Config{Proxy: Proxy{Difficulty: 1 << 30}}}
+	s.vardiff = &varDiffOptions{minDiff: 1 << 20, maxDiff: 1 << 40, targetTime: 10 * time.Second, retargetTime: 90 * time.Second}
+
+	p := s.newStratumPort(&Stratum{Timeout: "60s", MaxConn: 16}, 32)
+	if p.target != GetTargetHex(1<<30) {
+		t.Error("Port without difficulty must start at the proxy difficulty")
+	}
+	if p.vardiff.minDiff != 1<<20 || p.vardiff.maxDiff != 1<<40 {
+		t.Errorf("Port without bounds must keep the diffAdjust bounds, got %v..%v", p.vardiff.minDiff, p.vardiff.maxDiff)
+	}
+
+	rental := s.newStratumPort(&Stratum{Timeout: "60s", MaxConn: 16, Difficulty: 1 << 44, MinDiff: 1 << 36, MaxDiff: 1 << 42, Tenant: "rental"}, 32)
+	if rental.target != GetTargetHex(1<<42) {
+		t.Error("Start difficulty must be clamped to the port bounds")
+	}
+	if rental.vardiff.minDiff != 1<<36 || rental.vardiff.maxDiff != 1<<42 {
+		t.Errorf("Port bounds must override the diffAdjust bounds, got %v..%v", rental.vardiff.minDiff, rental.vardiff.maxDiff)
+	}
+	if s.vardiff.minDiff != 1<<20 {
+		t.Error("Port bounds must not change the shared diffAdjust options")
+	}
+	if rental.clamp(1) != 1<<36 || rental.tenant != "rental" {
+		t.Errorf("Unexpected port profile %+v", rental)
+	}
+}
+
+func TestStratumPortsConfig(t *testing.T) {
+	var cfg Proxy
+	if err := json.Unmarshal([]byte(`{"stratum": {"enabled": true, "listen": "0.0.0.0:8008", "maxConn": 8192}}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Stratum) != 1 || !cfg.Stratum[0].Enabled || cfg.Stratum[0].Listen != "0.0.0.0:8008" {
+		t.Errorf("Single stratum object must be read as one port, got %+v", cfg.Stratum)
+	}
+
+	cfg = Proxy{}
+	if err := json.Unmarshal([]byte(`{"stratum": [{"listen": "0.0.0.0:8008"}, {"listen": "0.0.0.0:8009", "solo": true}]}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Stratum) != 2 || cfg.Stratum[1].Listen != "0.0.0.0:8009" || !cfg.Stratum[1].Solo {
+		t.Errorf("Unexpected stratum ports %+v", cfg.Stratum)
+	}
+	if err := json.Unmarshal([]byte(`{"stratum": "0.0.0.0:8008"}`), &cfg); err == nil {
+		t.Error("Malformed stratum config must be refused")
+	}
+}
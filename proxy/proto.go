@@ -11,6 +11,9 @@ type JSONRpcReq struct {
 type StratumReq struct {
 	JSONRpcReq
 	//Worker string `json:"worker"`
+	// reply to a call of the pool, set on messages without method
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
 }
 
 type JSONPushMessage struct {
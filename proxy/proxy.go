@@ -11,6 +11,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/gorilla/mux"
 
 	"github.com/PowPool/btcpool/policy"
@@ -20,20 +21,63 @@ import (
 )
 
 type ProxyServer struct {
-	config             *Config
-	blockTemplate      atomic.Value
-	upstream           int32
-	upstreams          []*rpc.RPCClient
+	config         *Config
+	blockTemplate  atomic.Value
+	upstream       int32
+	upstreams      []*rpc.RPCClient
+	blockNotifiers []*blockNotifier
+	// signals a new block notified by the current upstream
+	blockNotify chan struct{}
+	// templates returned by longpolls, nil if longpoll is disabled
+	longPollClients    []*rpc.RPCClient
+	longPollReplies    chan *rpc.GetBlockTemplateReplyPart
 	backend            *storage.RedisClient
 	target             string
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
+	nTimeRollWindow    time.Duration
+	emptyJobWindow     time.Duration
 
 	// Stratum
-	sessionsMu sync.RWMutex
-	sessions   map[*Session]struct{}
-	timeout    time.Duration
+	sessionsMu  sync.RWMutex
+	sessions    map[*Session]struct{}
+	stratumTags chan int
+	ports       []*stratumPort
+	vardiff     *varDiffOptions
+	recorder    *recorder
+	// set while replaying a recording
+	replay *replayer
+	// how long a session that answered pings may take to answer one
+	pingTimeout time.Duration
+	// account logins, nil if only addresses are accepted
+	accounts *accounts
+	// logins with soloPrefix mine solo, empty if only solo ports do
+	soloPrefix    string
+	soloFee       float64
+	soloFeeScript []byte
+	// merged mining, auxWork holds the aux blocks new jobs commit to
+	auxChains []*auxChain
+	auxWork   atomic.Value
+	// configured version rolling mask and the pool mask for the current template
+	versionRollingMask uint32
+	versionMask        uint32
+
+	// Drain
+	listenersMu     sync.Mutex
+	listeners       []net.Listener
+	draining        int32
+	inflightSubmits int64
+
+	// Stratum V2
+	sv2Mu           sync.RWMutex
+	sv2Conns        map[*Sv2Conn]struct{}
+	sv2Tags         chan int
+	sv2Timeout      time.Duration
+	sv2Port         *stratumPort
+	sv2Authority    *btcec.PrivateKey
+	sv2StaticKey    *btcec.PrivateKey
+	sv2CertValidity time.Duration
 }
 
 type Session struct {
@@ -42,26 +86,66 @@ type Session struct {
 
 	// Stratum
 	sync.Mutex
-	conn  *net.TCPConn
+	conn  net.Conn
+	out   *sessionWriter
+	port  *stratumPort
 	login string
 	id    string
+	// account the miner logged in with, the login is its payout address
+	account string
+	// solo mining, blocks pay the login in the coinbase
+	solo     bool
+	soloJobs map[string]soloJob
 
 	//lastShareTime int64
 	target string
 
 	targetNextJob string
-	shareCountInv int64
+	// target each job was sent with, shares are credited at the difficulty of their job
+	jobTargets map[string]string
+	// jobs of the previous block, replaced by the first clean job of a new one
+	staleJobs map[string]string
+	// prevhash of the jobs in jobTargets
+	jobPrevHash string
+	vardiff     *VarDiff
+	// difficulty from mining.suggest_difficulty or mining.suggest_target
+	suggestedDiff int64
+	// options from the mining.authorize password
+	options minerOptions
+	// mining.configure minimum-difficulty and info
+	minimumDiff int64
+	workerInfo  *storage.WorkerInfo
 
 	// Session tag
-	tag uint16
+	tag int
 	// Session id
 	sid string
 	// Session extra nonce1
-	extraNonce1 string
+	extraNonce1     string
+	extraNonce2Size int
+	// extraNonce1 before the last mining.set_extranonce, valid for work on the current block
+	prevExtraNonce1 string
+	// mining.extranonce.subscribe received, extraNonce1 may be changed with mining.set_extranonce
+	extranonceSubscribed bool
 	// authorized
 	isAuth bool
 
-	versionMask uint32
+	// negotiated version rolling mask, zero without mining.configure
+	versionMask          uint32
+	requestedVersionMask uint32
+	versionMinBitCount   int
+
+	// traffic recording, nil if the connection is not recorded
+	rec *sessionRecord
+
+	// calls of the pool waiting for their reply, by id
+	calls      map[uint64]pendingCall
+	lastCallId uint64
+	// client.get_version reply
+	version string
+	// mining.ping round trip, the session answered a ping if pingSupported
+	pingRTT       time.Duration
+	pingSupported bool
 }
 
 func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
@@ -79,19 +163,51 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 		Info.Printf("Upstream: %s => %s", v.Name, v.Url)
 	}
 	Info.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
+	proxy.initBlockNotifiers(cfg.Upstream)
 
-	if cfg.Proxy.Stratum.Enabled {
-		proxy.sessions = make(map[*Session]struct{})
-		go proxy.ListenTCP()
+	proxy.initVersionMask(&cfg.Proxy)
+	proxy.initSolo(&cfg.Proxy.Solo)
+	proxy.nTimeRollWindow = nTimeRollWindow(&cfg.Proxy)
+	if len(cfg.Proxy.EmptyJobWindow) > 0 {
+		proxy.emptyJobWindow = MustParseDuration(cfg.Proxy.EmptyJobWindow)
+	}
+	if cfg.Proxy.DiffAdjust.Enabled {
+		proxy.vardiff = newVarDiffOptions(&cfg.Proxy.DiffAdjust)
 	}
 
+	if cfg.Proxy.Accounts.Enabled {
+		proxy.accounts = newAccounts(&cfg.Proxy.Accounts, backend)
+	}
+	proxy.pingTimeout = defaultPingTimeout
+	if len(cfg.Proxy.Ping.Timeout) > 0 {
+		proxy.pingTimeout = MustParseDuration(cfg.Proxy.Ping.Timeout)
+	}
+	if cfg.Proxy.Record.Enabled {
+		proxy.recorder = newRecorder(&cfg.Proxy.Record, proxy.currentBlockTemplate)
+	}
+	proxy.startStratum()
+
+	if cfg.Proxy.StratumV2.Enabled {
+		proxy.sv2Conns = make(map[*Sv2Conn]struct{})
+		go proxy.ListenSv2()
+	}
+
+	if cfg.Proxy.MergedMining.Enabled {
+		proxy.initMergedMining(&cfg.Proxy.MergedMining)
+		proxy.fetchAuxBlocks()
+	}
 	proxy.fetchBlockTemplate()
+	if cfg.Proxy.LongPoll.Enabled {
+		proxy.initLongPoll(&cfg.Proxy.LongPoll, cfg.Upstream)
+		go proxy.longPoll()
+	}
 
 	proxy.hashrateExpiration = MustParseDuration(cfg.Proxy.HashrateExpiration)
 
 	refreshIntv := MustParseDuration(cfg.Proxy.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	Info.Printf("Set block refresh every %v", refreshIntv)
+	blkTplIntv := MustParseDuration(cfg.Proxy.BlockTemplateInterval)
 
 	checkIntv := MustParseDuration(cfg.UpstreamCheckInterval)
 	checkTimer := time.NewTimer(checkIntv)
@@ -103,8 +219,15 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 		for {
 			select {
 			case <-refreshTimer.C:
-				proxy.fetchBlockTemplate()
+				// polling for new blocks is a fallback while they are notified
+				if !proxy.blockNotified() || proxy.blockTemplateExpired(blkTplIntv) {
+					proxy.fetchBlockTemplate()
+				}
 				refreshTimer.Reset(refreshIntv)
+			case <-proxy.blockNotify:
+				proxy.fetchBlockTemplate()
+			case reply := <-proxy.longPollReplies:
+				proxy.applyLongPollReply(reply)
 			}
 		}
 	}()
@@ -147,13 +270,71 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 			for {
 				select {
 				case <-diffAdjustTimer.C:
-					proxy.UpdateAllSessionDiff()
+					proxy.checkIdleSessionDiff()
 					diffAdjustTimer.Reset(diffAdjustIntv)
 				}
 			}
 		}()
 	}
 
+	if cfg.Proxy.MergedMining.Enabled {
+		auxIntv := defaultAuxRefreshInterval
+		if len(cfg.Proxy.MergedMining.RefreshInterval) > 0 {
+			auxIntv = MustParseDuration(cfg.Proxy.MergedMining.RefreshInterval)
+		}
+		auxTimer := time.NewTimer(auxIntv)
+		Info.Printf("Set aux block refresh every %v", auxIntv)
+
+		go func() {
+			for {
+				select {
+				case <-auxTimer.C:
+					proxy.fetchAuxBlocks()
+					auxTimer.Reset(auxIntv)
+				}
+			}
+		}()
+	}
+
+	if cfg.Proxy.Ping.Enabled {
+		pingIntv := MustParseDuration(cfg.Proxy.Ping.Interval)
+		pingTimer := time.NewTimer(pingIntv)
+		Info.Printf("Ping miners every %v", pingIntv)
+
+		go func() {
+			for {
+				select {
+				case <-pingTimer.C:
+					proxy.pingSessions(proxy.pingTimeout)
+					pingTimer.Reset(pingIntv)
+				}
+			}
+		}()
+	}
+
+	if leaseIntv := proxy.sessionLeaseInterval(); leaseIntv > 0 {
+		leaseTimer := time.NewTimer(leaseIntv)
+		Info.Printf("Renew session leases every %v", leaseIntv)
+
+		go func() {
+			for {
+				select {
+				case <-leaseTimer.C:
+					proxy.refreshSessionLeases()
+					leaseTimer.Reset(leaseIntv)
+				}
+			}
+		}()
+	}
+
+	if cfg.Proxy.Admin.Enabled {
+		// the admin interface messages and disconnects miners
+		if len(cfg.Proxy.Admin.Token) == 0 {
+			Error.Fatalf("Admin interface on %v needs a token", cfg.Proxy.Admin.Listen)
+		}
+		go proxy.ListenAdmin()
+	}
+
 	return proxy
 }
 
@@ -217,27 +398,6 @@ func (s *ProxyServer) DumpAllSessionNames() map[string]struct{} {
 	return l
 }
 
-func (s *ProxyServer) UpdateAllSessionDiff() {
-	s.sessionsMu.Lock()
-	defer s.sessionsMu.Unlock()
-
-	for k, _ := range s.sessions {
-		if k.shareCountInv > s.config.Proxy.DiffAdjust.ExpectShareCount*2 {
-			// difficulty up
-			diff := TargetHexToDiff(k.target).Int64()
-			diff = int64(float64(diff) * 1.2)
-			k.targetNextJob = GetTargetHex(diff)
-			Info.Printf("Address: [%s], Name: : [%s], Target From [%s] Up to [%s]", k.login, k.id, k.target, k.targetNextJob)
-		} else if k.shareCountInv < s.config.Proxy.DiffAdjust.ExpectShareCount/2 {
-			// difficulty down
-			diff := TargetHexToDiff(k.target).Int64()
-			diff = int64(float64(diff) * 0.8)
-			k.target = GetTargetHex(diff)
-			Info.Printf("Address: [%s], Name: : [%s], Target From [%s] Down to [%s]", k.login, k.id, k.target, k.targetNextJob)
-		}
-	}
-}
-
 func (s *ProxyServer) remoteAddr(r *http.Request) string {
 	if s.config.Proxy.BehindReverseProxy {
 		ip := r.Header.Get("X-Forwarded-For")
@@ -259,7 +419,7 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
 	r.Body = http.MaxBytesReader(w, r.Body, s.config.Proxy.LimitBodySize)
 	defer r.Body.Close()
 
-	cs := &Session{ip: ip, enc: json.NewEncoder(w), shareCountInv: 0}
+	cs := &Session{ip: ip, enc: json.NewEncoder(w)}
 	dec := json.NewDecoder(r.Body)
 	for {
 		var req JSONRpcReq
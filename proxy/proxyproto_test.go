@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, body []byte) string {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, 0x20|cmd, fam, 0, 0)
+		binary.BigEndian.PutUint16(b[14:], uint16(len(body)))
+		return string(append(b, body...))
+	}
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x1f, 0x48}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(v6[32:], 12345)
+
+	tests := []struct {
+		header string
+		addr   string
+		ok     bool
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 12345 8008\r\n", "203.0.113.7:12345", true},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 12345 8008\r\n", "[2001:db8::7]:12345", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 2001:db8::7 10.0.0.1 12345 8008\r\n", "", false},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 12345\r\n", "", false},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 12345 8008\n", "", false},
+		{"PROXY " + strings.Repeat("x", proxyV1MaxLen) + "\r\n", "", false},
+		{v2(proxyV2CmdProxy, 0x11, append(v4, 0x04, 0, 1, 'x')), "203.0.113.7:12345", true},
+		{v2(proxyV2CmdProxy, 0x21, v6), "[2001:db8::7]:12345", true},
+		{v2(proxyV2CmdLocal, 0, nil), "", true},
+		{v2(proxyV2CmdProxy, 0x11, v4[:8]), "", false},
+		{v2(0x2, 0x11, v4), "", false},
+		{`{"id":1,"method":"mining.subscribe","params":[]}` + "\n", "", false},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.header + "rest"))
+		addr, err := readProxyHeader(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: unexpected error %v", tt.header, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if (addr == nil && len(tt.addr) > 0) || (addr != nil && addr.String() != tt.addr) {
+			t.Errorf("%q: expected address %q, got %v", tt.header, tt.addr, addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("%q: header must be consumed exactly, left %q", tt.header, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, trusted := range []string{"127.0.0.0/8", "192.0.2.0/24"} {
+		nets, err := parseTrustedProxies([]string{trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &proxyListener{Listener: server, trusted: nets}
+
+		client, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 8008\r\n{}\n"))
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if trusted == "127.0.0.0/8" && (ip != "203.0.113.7" || line != "{}\n") {
+			t.Errorf("Header of a trusted proxy must give the miner address, got %v %q", ip, line)
+		}
+		if trusted == "192.0.2.0/24" && (ip != "127.0.0.1" || !strings.HasPrefix(line, "PROXY")) {
+			t.Errorf("Header of an untrusted source must not be parsed, got %v %q", ip, line)
+		}
+		_ = client.Close()
+		_ = conn.Close()
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.1"}); err == nil {
+		t.Error("Trusted proxies must be CIDRs")
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// The recorder writes the stratum traffic of selected miners to a JSONL file
+// that can be fed back through the handlers with Replay. Template snapshots
+// are written with the jobs, so a replay sees the work the miner saw.
+
+const (
+	recordIn       = "in"
+	recordOut      = "out"
+	recordTemplate = "template"
+
+	defaultRecordMaxSize = 100
+	// lines kept per connection until its login is known
+	recordPendingLines = 64
+)
+
+type recordEntry struct {
+	// milliseconds
+	Time int64 `json:"ts"`
+	// connection of the line, unique within the process
+	Conn        uint64            `json:"conn,omitempty"`
+	Sid         string            `json:"sid,omitempty"`
+	Login       string            `json:"login,omitempty"`
+	Ip          string            `json:"ip,omitempty"`
+	Port        string            `json:"port,omitempty"`
+	ExtraNonce1 string            `json:"extraNonce1,omitempty"`
+	Dir         string            `json:"dir"`
+	Line        string            `json:"line,omitempty"`
+	JobId       string            `json:"job,omitempty"`
+	Template    *templateSnapshot `json:"template,omitempty"`
+}
+
+// templateSnapshot is the part of a block template shares are checked
+// against, with the job that was just added.
+type templateSnapshot struct {
+	Version  uint32           `json:"version"`
+	Height   uint32           `json:"height"`
+	PrevHash string           `json:"prevHash"`
+	NBits    uint32           `json:"nBits"`
+	Target   string           `json:"target"`
+	Clean    bool             `json:"clean"`
+	Job      BlockTemplateJob `json:"job"`
+}
+
+type recorder struct {
+	sync.Mutex
+	cfg *Record
+	// the template jobs are snapshot from
+	currentTemplate func() *BlockTemplate
+	logins          map[string]struct{}
+	ips             map[string]struct{}
+	file            *os.File
+	size            int64
+	maxSize         int64
+	lastJob         string
+	lastConn        uint64
+}
+
+// sessionRecord is the recording state of a connection.
+type sessionRecord struct {
+	recorder *recorder
+	conn     uint64
+	// selected by login or ip, undecided connections keep their lines pending
+	selected bool
+	decided  bool
+	pending  []recordEntry
+}
+
+func newRecorder(cfg *Record, currentTemplate func() *BlockTemplate) *recorder {
+	r := &recorder{cfg: cfg, currentTemplate: currentTemplate, logins: make(map[string]struct{}), ips: make(map[string]struct{})}
+	for _, login := range cfg.Logins {
+		r.logins[login] = struct{}{}
+	}
+	for _, ip := range cfg.IPs {
+		r.ips[ip] = struct{}{}
+	}
+	r.maxSize = defaultRecordMaxSize
+	if cfg.MaxSize > 0 {
+		r.maxSize = cfg.MaxSize
+	}
+	r.maxSize <<= 20
+	if err := r.open(); err != nil {
+		Error.Fatalf("Failed to open stratum record file %v: %v", cfg.File, err)
+	}
+	Info.Printf("Recording stratum traffic of logins %v and ips %v to %v", cfg.Logins, cfg.IPs, cfg.File)
+	return r
+}
+
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.file = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotate moves file to file.1, file.1 to file.2 and so on, keeping maxFiles old files.
+func (r *recorder) rotate() error {
+	_ = r.file.Close()
+	for i := r.cfg.MaxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.cfg.File, i), fmt.Sprintf("%s.%d", r.cfg.File, i+1))
+	}
+	if r.cfg.MaxFiles > 0 {
+		_ = os.Rename(r.cfg.File, r.cfg.File+".1")
+	} else {
+		_ = os.Remove(r.cfg.File)
+	}
+	// the new file starts with the current work for replays
+	r.lastJob = ""
+	return r.open()
+}
+
+func (r *recorder) write(e *recordEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	if r.size+int64(len(data)) > r.maxSize && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			Error.Printf("Failed to rotate stratum record file %v: %v", r.cfg.File, err)
+			return
+		}
+		if e.Dir != recordTemplate {
+			r.template(r.currentTemplate())
+		}
+	}
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	if err != nil {
+		Error.Printf("Failed to write stratum record file %v: %v", r.cfg.File, err)
+	}
+}
+
+// startSession gives a connection its recording state.
+func (r *recorder) startSession(cs *Session) {
+	rec := &sessionRecord{recorder: r, conn: atomic.AddUint64(&r.lastConn, 1)}
+	if _, ok := r.ips[cs.ip]; ok {
+		rec.selected = true
+		rec.decided = true
+	}
+	cs.rec = rec
+}
+
+// line records a line of cs. Lines before the session is authorized are held
+// back until its login tells whether it is recorded.
+func (r *recorder) line(cs *Session, dir string, line []byte) {
+	rec := cs.rec
+	t := r.currentTemplate()
+	r.Lock()
+	defer r.Unlock()
+	if rec.decided && !rec.selected {
+		return
+	}
+
+	e := recordEntry{
+		Time:        MakeTimestamp(),
+		Conn:        rec.conn,
+		Sid:         cs.sid,
+		Login:       cs.login,
+		Ip:          cs.ip,
+		ExtraNonce1: cs.extraNonce1,
+		Dir:         dir,
+		Line:        string(line),
+	}
+	if cs.port != nil && cs.port.cfg != nil {
+		e.Port = cs.port.cfg.Listen
+	}
+	if t != nil {
+		e.JobId = t.lastBlkTplId
+	}
+
+	if !rec.decided && cs.isAuth {
+		_, rec.selected = r.logins[cs.login]
+		rec.decided = true
+		if rec.selected {
+			r.template(t)
+			for i := range rec.pending {
+				r.write(&rec.pending[i])
+			}
+		}
+		rec.pending = nil
+	}
+	switch {
+	case rec.selected:
+		r.template(t)
+		r.write(&e)
+	case !rec.decided && len(rec.pending) < recordPendingLines:
+		rec.pending = append(rec.pending, e)
+	}
+}
+
+// template writes a snapshot of t if its current job was not written yet.
+func (r *recorder) template(t *BlockTemplate) {
+	if t == nil || t.lastBlkTplId == r.lastJob {
+		return
+	}
+	job, ok := t.BlockTplJobMap[t.lastBlkTplId]
+	if !ok {
+		return
+	}
+	r.lastJob = t.lastBlkTplId
+	r.write(&recordEntry{
+		Time:  MakeTimestamp(),
+		Dir:   recordTemplate,
+		JobId: t.lastBlkTplId,
+		Template: &templateSnapshot{
+			Version:  t.Version,
+			Height:   t.Height,
+			PrevHash: t.PrevHash,
+			NBits:    t.NBits,
+			Target:   t.Target,
+			Clean:    t.newBlkTpl,
+			Job:      job,
+		},
+	})
+}
+
+// record records a line of the session if its connection is recorded.
+func (cs *Session) record(dir string, line []byte) {
+	if cs.rec != nil {
+		cs.rec.recorder.line(cs, dir, line)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+func readRecord(t *testing.T, file string) []recordEntry {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []recordEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestRecorder(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record.jsonl")
+	tpl := &BlockTemplate{Height: 100, PrevHash: "00ff", lastBlkTplId: "j1",
+		BlockTplJobMap: map[string]BlockTemplateJob{"j1": {BlkTplJobId: "j1", CoinBase1: "cb1"}}}
+	r := newRecorder(&Record{File: file, Logins: []string{"x"}, IPs: []string{"10.0.0.9"}, MaxFiles: 1}, func() *BlockTemplate { return tpl })
+
+	cs := &Session{ip: "10.0.0.1", port: &stratumPort{cfg: &Stratum{Listen: "0.0.0.0:8008"}}}
+	other := &Session{ip: "10.0.0.2"}
+	byIp := &Session{ip: "10.0.0.9"}
+	for _, s := range []*Session{cs, other, byIp} {
+		r.startSession(s)
+	}
+
+	cs.record(recordIn, []byte(`{"id":1,"method":"mining.subscribe","params":[]}`))
+	other.record(recordIn, []byte(`{"id":1,"method":"mining.subscribe","params":[]}`))
+	cs.record(recordIn, []byte(`{"id":2,"method":"mining.authorize","params":["x.w"]}`))
+	cs.login, cs.isAuth = "x", true
+	other.login, other.isAuth = "y", true
+	cs.record(recordOut, []byte(`{"id":2,"result":true,"error":null}`))
+	other.record(recordOut, []byte(`{"id":2,"result":true,"error":null}`))
+	byIp.record(recordIn, []byte(`{"id":1,"method":"mining.subscribe","params":[]}`))
+
+	entries := readRecord(t, file)
+	if len(entries) != 5 {
+		t.Fatalf("Expected a template and 4 lines, got %+v", entries)
+	}
+	if entries[0].Dir != recordTemplate || entries[0].Template == nil || entries[0].Template.Job.CoinBase1 != "cb1" {
+		t.Errorf("Recording must start with the template, got %+v", entries[0])
+	}
+	if entries[1].Dir != recordIn || entries[2].Dir != recordIn || entries[3].Dir != recordOut || entries[1].Conn != cs.rec.conn {
+		t.Errorf("Lines before authorize must be kept in order, got %+v", entries[1:4])
+	}
+	if entries[3].Login != "x" || entries[3].Port != "0.0.0.0:8008" || entries[3].JobId != "j1" {
+		t.Errorf("Unexpected entry %+v", entries[3])
+	}
+	if entries[4].Conn != byIp.rec.conn {
+		t.Errorf("Connection selected by ip must be recorded, got %+v", entries[4])
+	}
+
+	r.maxSize = 1
+	cs.record(recordIn, []byte(`{"id":3,"method":"mining.submit","params":[]}`))
+	if _, err := os.Stat(file + ".1"); err != nil {
+		t.Error("Full record file must be rotated")
+	}
+	if entries = readRecord(t, file); len(entries) != 2 || entries[0].Dir != recordTemplate {
+		t.Errorf("Rotated file must start with the template, got %+v", entries)
+	}
+}
+
+func TestReplayState(t *testing.T) {
+	s := &ProxyServer{}
+	r := &replayer{s: s}
+	s.replay = r
+
+	r.applyTemplate("j1", &templateSnapshot{PrevHash: "00ff", Clean: true, Job: BlockTemplateJob{BlkTplJobId: "j1"}})
+	r.applyTemplate("j2", &templateSnapshot{PrevHash: "00ff", Job: BlockTemplateJob{BlkTplJobId: "j2"}})
+	tpl := s.currentBlockTemplate()
+	if tpl.lastBlkTplId != "j2" || len(tpl.BlockTplJobMap) != 2 {
+		t.Errorf("Jobs of the same block must be kept, got %v", tpl.BlockTplJobMap)
+	}
+	r.applyTemplate("j3", &templateSnapshot{PrevHash: "0100", Clean: true, Job: BlockTemplateJob{BlkTplJobId: "j3"}})
+	if tpl = s.currentBlockTemplate(); len(tpl.BlockTplJobMap) != 1 {
+		t.Errorf("A new block must drop the old jobs, got %v", tpl.BlockTplJobMap)
+	}
+
+	cs := &Session{}
+	r.applyOut(cs, `{"id":null,"method":"mining.set_difficulty","params":[2]}`)
+	r.applyOut(cs, `{"id":null,"method":"mining.notify","params":["j3","ph","cb1","cb2",[],"20000000","1d00ffff","66da656c",true]}`)
+	if sent, _ := cs.jobState("j3"); !sent {
+		t.Error("Recorded jobs must be tracked by the replayed session")
+	}
+	diff, _ := fromStratumDiff(2)
+	if cs.jobTarget("j3") != GetTargetHex(diff) {
+		t.Error("Recorded difficulty must apply to the next job")
+	}
+}
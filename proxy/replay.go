@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PowPool/btcpool/policy"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// replayer feeds a recording back through the stratum handlers. Recorded
+// inbound lines are handled like on the live connection, recorded jobs and
+// difficulties set the session state, and the replies of the handlers are
+// printed next to the recorded ones.
+type replayer struct {
+	s   *ProxyServer
+	out io.Writer
+	// time of the line being replayed
+	now      time.Time
+	ports    map[string]*stratumPort
+	port     *stratumPort
+	sessions map[uint64]*Session
+	conns    map[*Session]net.Conn
+}
+
+// Replay replays the recording in file against the templates saved in it and
+// prints the traffic to out. Shares are written to backend, blocks are not submitted.
+func Replay(cfg *Config, backend *storage.RedisClient, file string, out io.Writer) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// recorded miners are judged by the share replies, never banned on the replaying host
+	policyCfg := cfg.Proxy.Policy
+	policyCfg.Banning.Enabled = false
+	policyCfg.Banning.IPSet = ""
+	policyCfg.Limits.Enabled = false
+
+	s := &ProxyServer{
+		config:             cfg,
+		backend:            backend,
+		policy:             policy.Start(&policyCfg, backend),
+		target:             GetTargetHex(cfg.Proxy.Difficulty),
+		sessions:           make(map[*Session]struct{}),
+		hashrateExpiration: MustParseDuration(cfg.Proxy.HashrateExpiration),
+		nTimeRollWindow:    nTimeRollWindow(&cfg.Proxy),
+	}
+	s.initVersionMask(&cfg.Proxy)
+	r := &replayer{s: s, out: out, ports: make(map[string]*stratumPort), sessions: make(map[uint64]*Session), conns: make(map[*Session]net.Conn)}
+	s.replay = r
+
+	tags := 0
+	for i := range cfg.Proxy.Stratum {
+		tags += cfg.Proxy.Stratum[i].MaxConn
+	}
+	for i := range cfg.Proxy.Stratum {
+		p := s.newStratumPort(&cfg.Proxy.Stratum[i], tags)
+		r.ports[p.cfg.Listen] = p
+		s.ports = append(s.ports, p)
+	}
+	if len(s.ports) == 0 {
+		s.ports = append(s.ports, s.newStratumPort(&Stratum{Timeout: "10m", MaxConn: 1}, 1))
+	}
+	// lines of ports no longer configured are replayed on the first one
+	r.port = s.ports[0]
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("malformed record %q: %v", scanner.Text(), err)
+		}
+		r.now = time.UnixMilli(e.Time)
+		r.replay(&e)
+	}
+	for cs := range r.conns {
+		r.closeSession(cs)
+	}
+	return scanner.Err()
+}
+
+func (r *replayer) replay(e *recordEntry) {
+	switch e.Dir {
+	case recordTemplate:
+		if e.Template != nil {
+			r.applyTemplate(e.JobId, e.Template)
+		}
+	case recordIn:
+		cs := r.session(e)
+		r.print(e.Conn, ">", e.Line)
+		if len(e.ExtraNonce1) > 0 {
+			// replayed shares have to hash with the recorded extranonce1
+			cs.Lock()
+			cs.extraNonce1 = e.ExtraNonce1
+			cs.Unlock()
+		}
+		var req StratumReq
+		if err := json.Unmarshal([]byte(e.Line), &req); err != nil {
+			r.print(e.Conn, "x", fmt.Sprintf("malformed request: %v", err))
+			r.closeSession(cs)
+			return
+		}
+		if err := cs.handleTCPMessage(r.s, &req); err != nil {
+			r.print(e.Conn, "x", err.Error())
+			r.closeSession(cs)
+		}
+	case recordOut:
+		cs := r.session(e)
+		r.print(e.Conn, "<", e.Line)
+		r.applyOut(cs, e.Line)
+	}
+}
+
+// applyTemplate makes the snapshot the current template, jobs of the same
+// previous block are kept for shares of older jobs.
+func (r *replayer) applyTemplate(jobId string, snap *templateSnapshot) {
+	t := &BlockTemplate{
+		Version:      snap.Version,
+		Height:       snap.Height,
+		PrevHash:     snap.PrevHash,
+		NBits:        snap.NBits,
+		Target:       snap.Target,
+		Difficulty:   TargetHexToDiff(snap.Target),
+		TxDetailMap:  make(map[string]string),
+		newBlkTpl:    snap.Clean,
+		lastBlkTplId: jobId,
+	}
+	if prev := r.s.currentBlockTemplate(); prev != nil && prev.PrevHash == snap.PrevHash && !snap.Clean {
+		t.BlockTplJobMap = prev.BlockTplJobMap
+	} else {
+		t.BlockTplJobMap = make(map[string]BlockTemplateJob)
+	}
+	t.BlockTplJobMap[jobId] = snap.Job
+	r.s.blockTemplate.Store(t)
+	r.s.updateVersionMask(t)
+}
+
+// applyOut sets the session state a recorded message of the pool changed.
+func (r *replayer) applyOut(cs *Session, line string) {
+	var msg struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	switch msg.Method {
+	case "mining.set_difficulty":
+		var params []float64
+		if json.Unmarshal(msg.Params, &params) != nil || len(params) == 0 {
+			return
+		}
+		if diff, err := fromStratumDiff(params[0]); err == nil {
+			cs.targetNextJob = GetTargetHex(diff)
+		}
+	case "mining.notify":
+		var params []interface{}
+		if json.Unmarshal(msg.Params, &params) != nil || len(params) == 0 {
+			return
+		}
+		cs.trackJob(params)
+	}
+}
+
+func (r *replayer) session(e *recordEntry) *Session {
+	if cs, ok := r.sessions[e.Conn]; ok {
+		return cs
+	}
+	p, ok := r.ports[e.Port]
+	if !ok {
+		p = r.port
+	}
+	// the connection only takes deadlines, replies go to the output
+	server, client := net.Pipe()
+	cs := &Session{conn: server, ip: e.Ip, port: p, extraNonce2Size: p.extraNonce2Size}
+	cs.enc = json.NewEncoder(&replayWriter{r: r, conn: e.Conn})
+	r.sessions[e.Conn] = cs
+	r.conns[cs] = client
+	return cs
+}
+
+func (r *replayer) closeSession(cs *Session) {
+	r.s.removeSession(cs)
+	_ = cs.conn.Close()
+	_ = r.conns[cs].Close()
+	delete(r.conns, cs)
+	for id, v := range r.sessions {
+		if v == cs {
+			delete(r.sessions, id)
+		}
+	}
+}
+
+func (r *replayer) print(conn uint64, dir, line string) {
+	_, _ = fmt.Fprintf(r.out, "%s %d %s %s\n", r.now.UTC().Format("2006-01-02T15:04:05.000"), conn, dir, line)
+}
+
+// replayWriter prints what the handlers send to a replayed session.
+type replayWriter struct {
+	r    *replayer
+	conn uint64
+}
+
+func (w *replayWriter) Write(b []byte) (int, error) {
+	w.r.print(w.conn, "=", strings.TrimRight(string(b), "\n"))
+	return len(b), nil
+}
+
+// now is the time shares are checked at, the recording time in replays.
+func (s *ProxyServer) now() time.Time {
+	if s.replay != nil {
+		return s.replay.now
+	}
+	return time.Now()
+}
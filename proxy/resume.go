@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"regexp"
+	"time"
+
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Stratum session resumption. The state of every session is kept in redis
+// under its sid, so that a miner reconnecting with mining.subscribe and its
+// previous session id gets back extranonce1, difficulty and worker on any
+// cluster node. The extranonce1 stays leased to the sid meanwhile and is not
+// handed out to other sessions.
+
+var sidPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+func newSessionId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *ProxyServer) extraNonce1ForTag(tag int, size int) string {
+	b := make([]byte, size)
+	binary.BigEndian.PutUint16(b, s.config.Id)
+	for i := len(b) - 1; i >= 2; i-- {
+		b[i] = byte(tag)
+		tag >>= 8
+	}
+	return hex.EncodeToString(b)
+}
+
+func (cs *Session) extraNonceSize() int {
+	return len(cs.extraNonce1)/2 + cs.extraNonce2Size
+}
+
+// acquireTag swaps tag for another free session tag until its extranonce1 is
+// neither used by a resumed session nor leased to a resumable one.
+func (s *ProxyServer) acquireTag(p *stratumPort, tag int) int {
+	for i := 1; i < cap(s.stratumTags); i++ {
+		extraNonce1 := s.extraNonce1ForTag(tag, p.extraNonce1Size)
+		if !s.isExtraNonce1Active(extraNonce1) {
+			if p.sessionExpiry == 0 {
+				return tag
+			}
+			sid, err := s.backend.GetExtranonceLease(extraNonce1)
+			if err != nil || len(sid) == 0 {
+				return tag
+			}
+		}
+		s.stratumTags <- tag
+		tag = <-s.stratumTags
+	}
+	Error.Printf("All stratum session tags are leased, reusing %v", tag)
+	return tag
+}
+
+// resumeSession restores the state stored for sid, it returns false for unknown sessions.
+func (s *ProxyServer) resumeSession(cs *Session, sid string) bool {
+	if cs.port.sessionExpiry == 0 || !sidPattern.MatchString(sid) {
+		return false
+	}
+	state, err := s.backend.GetStratumSession(sid)
+	if err != nil {
+		Error.Printf("Failed to load stratum session %v: %v", sid, err)
+		return false
+	}
+	if state == nil {
+		return false
+	}
+
+	cs.sid = sid
+	cs.extraNonce1 = s.extraNonce1ForTag(cs.tag, cs.port.extraNonce1Size)
+	// the extranonce1 may only be reused if nobody else got it meanwhile
+	if owner, err := s.backend.GetExtranonceLease(state.ExtraNonce1); err == nil && owner == sid && !s.isSessionActive(sid) &&
+		!s.isExtraNonce1Active(state.ExtraNonce1) && len(state.ExtraNonce1) == 2*cs.port.extraNonce1Size {
+		cs.extraNonce1 = state.ExtraNonce1
+	}
+	if state.Difficulty > 0 && cs.suggestedDiff == 0 {
+		cs.target = GetTargetHex(state.Difficulty)
+		cs.targetNextJob = cs.target
+	}
+	login, ok := state.Login, len(state.Login) > 0
+	if ok && (len(state.Account) > 0 || s.accounts != nil && s.accounts.enforce) {
+		// the account decides the payout address, it may have changed meanwhile
+		login, ok = s.resumeAccount(state.Account, state.Login)
+	}
+	if ok && s.policy.ApplyLoginPolicy(login, cs.ip) {
+		cs.account = state.Account
+		cs.login = login
+		cs.id = state.Worker
+		cs.solo = state.Solo
+		cs.isAuth = true
+	}
+	Info.Printf("Resumed stratum session %v %v.%v@%v extranonce1 %v", sid, cs.login, cs.id, cs.ip, cs.extraNonce1)
+	return true
+}
+
+// resumeAccount returns the payout address of a resumed session of account,
+// false if the session has to authorize again.
+func (s *ProxyServer) resumeAccount(account, address string) (string, bool) {
+	if s.accounts == nil || len(account) == 0 {
+		return "", false
+	}
+	return s.accounts.payoutAddress(account, address)
+}
+
+func (s *ProxyServer) isSessionActive(sid string) bool {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	for cs := range s.sessions {
+		if cs.sid == sid {
+			return true
+		}
+	}
+	return false
+}
+
+// isExtraNonce1Active tells whether a live session uses extraNonce1. Resumed
+// sessions keep their extranonce1 while holding the tag of another one.
+func (s *ProxyServer) isExtraNonce1Active(extraNonce1 string) bool {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	for cs := range s.sessions {
+		cs.Lock()
+		active := cs.extraNonce1 == extraNonce1
+		cs.Unlock()
+		if active {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionLeaseInterval returns how often the leases of live sessions are
+// renewed, zero if no port resumes sessions.
+func (s *ProxyServer) sessionLeaseInterval() time.Duration {
+	var intv time.Duration
+	for _, p := range s.ports {
+		if p.sessionExpiry > 0 && (intv == 0 || p.sessionExpiry/3 < intv) {
+			intv = p.sessionExpiry / 3
+		}
+	}
+	return intv
+}
+
+// refreshSessionLeases stores the state of live sessions again, their
+// extranonce1 leases would otherwise lapse while they are still mining.
+func (s *ProxyServer) refreshSessionLeases() {
+	s.sessionsMu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for cs := range s.sessions {
+		sessions = append(sessions, cs)
+	}
+	s.sessionsMu.RUnlock()
+
+	for _, cs := range sessions {
+		if cs.port.sessionExpiry == 0 || len(cs.sid) == 0 {
+			continue
+		}
+		cs.Lock()
+		extraNonce1 := cs.extraNonce1
+		cs.Unlock()
+		if owner, err := s.backend.GetExtranonceLease(extraNonce1); err == nil && len(owner) > 0 && owner != cs.sid {
+			s.moveSession(cs)
+			continue
+		}
+		s.saveSession(cs)
+	}
+}
+
+// moveSession takes cs off an extranonce1 that was leased to another session
+// meanwhile, both would search the same coinbase space. The session goes back
+// to the extranonce1 of its own tag, or is closed if it can't follow.
+func (s *ProxyServer) moveSession(cs *Session) {
+	extraNonce1 := s.extraNonce1ForTag(cs.tag, cs.port.extraNonce1Size)
+	if owner, err := s.backend.GetExtranonceLease(extraNonce1); err == nil && (len(owner) == 0 || owner == cs.sid) &&
+		!s.isExtraNonce1Active(extraNonce1) && s.changeExtranonce(cs, extraNonce1) {
+		return
+	}
+	Error.Printf("Extranonce1 of %v.%v@%v is leased to another session, disconnecting", cs.login, cs.id, cs.ip)
+	// the lease is not ours to store anymore
+	cs.Lock()
+	cs.sid = ""
+	cs.Unlock()
+	s.removeSession(cs)
+	cs.close()
+}
+
+// saveSession stores the session state for later resumption.
+func (s *ProxyServer) saveSession(cs *Session) {
+	if cs.port.sessionExpiry == 0 || len(cs.sid) == 0 {
+		return
+	}
+	cs.Lock()
+	state := &storage.StratumSession{
+		ExtraNonce1: cs.extraNonce1,
+		Difficulty:  TargetHexToDiff(cs.targetNextJob).Int64(),
+		Login:       cs.login,
+		Account:     cs.account,
+		Worker:      cs.id,
+		Solo:        cs.solo,
+	}
+	cs.Unlock()
+	if err := s.backend.WriteStratumSession(cs.sid, state, cs.port.sessionExpiry); err != nil {
+		Error.Printf("Failed to store stratum session %v: %v", cs.sid, err)
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	. "github.com/PowPool/btcpool/util"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+)
+
+// Solo sessions mine blocks that pay their login in the coinbase, minus the
+// solo fee. They get jobs of their own: the coinbase of each template job is
+// built again for the session and its job id is derived from it. Solo shares
+// count for the hashrate but not for the pool round.
+
+const defaultSoloPrefix = "solo:"
+
+// soloJob is a job sent to a solo session.
+type soloJob struct {
+	// template job the coinbase was built for
+	tplJobId  string
+	coinBase1 string
+	coinBase2 string
+	fee       int64
+}
+
+func (s *ProxyServer) initSolo(cfg *Solo) {
+	if cfg.Enabled {
+		s.soloPrefix = cfg.Prefix
+		if len(s.soloPrefix) == 0 {
+			s.soloPrefix = defaultSoloPrefix
+		}
+	}
+	if cfg.Fee < 0 || cfg.Fee >= 100 {
+		Error.Fatalf("Solo fee must be within 0..100, got %v", cfg.Fee)
+	}
+	if cfg.Fee > 0 {
+		script, err := bitcoin.GetCoinBaseScript(cfg.FeeAddress)
+		if err != nil {
+			Error.Fatalf("Invalid solo feeAddress %v: %v", cfg.FeeAddress, err)
+		}
+		s.soloFee = cfg.Fee
+		s.soloFeeScript = script
+	}
+}
+
+// soloLogin strips the solo prefix from login, it returns whether there was one.
+func (s *ProxyServer) soloLogin(login string) (string, bool) {
+	if len(s.soloPrefix) == 0 || !strings.HasPrefix(login, s.soloPrefix) {
+		return login, false
+	}
+	return login[len(s.soloPrefix):], true
+}
+
+// soloJobParams turns the mining.notify params of a template job into those of
+// the solo job of cs, with a coinbase paying its login.
+func (s *ProxyServer) soloJobParams(cs *Session, t *BlockTemplate, params []interface{}) ([]interface{}, error) {
+	tplJobId, _ := params[0].(string)
+	h, ok := t.BlockTplJobMap[tplJobId]
+	if !ok {
+		return nil, fmt.Errorf("template job %v is gone", tplJobId)
+	}
+
+	fee := int64(float64(h.CoinBaseValue) * s.soloFee / 100)
+	coinBaseTx := bitcoin.CoinBaseTransaction{ExtraNonce1Size: bitcoin.EXTRANONCE1_SIZE, ExtraNonce2Size: cs.extraNonceSize() - bitcoin.EXTRANONCE1_SIZE}
+	if fee > 0 {
+		coinBaseTx.ExtraVouts = []bitcoin.MasterNodeVout{{Amount: fee, VoutScript: s.soloFeeScript}}
+	}
+	cs.Lock()
+	login := cs.login
+	cs.Unlock()
+	err := coinBaseTx.Initialize(login, h.BlkTplJobTime, t.Height, h.CoinBaseValue-fee, h.CoinBaseAuxFlags,
+		s.config.CoinBaseExtraData, h.DefaultWitnessCommitment)
+	if err != nil {
+		return nil, err
+	}
+	job := soloJob{
+		tplJobId:  tplJobId,
+		coinBase1: hex.EncodeToString(coinBaseTx.CoinBaseTx1),
+		coinBase2: hex.EncodeToString(coinBaseTx.CoinBaseTx2),
+		fee:       fee,
+	}
+	jobId := hex.EncodeToString(utility.Sha256(append(coinBaseTx.CoinBaseTx1, coinBaseTx.CoinBaseTx2...)))[0:16]
+
+	cs.Lock()
+	if cs.soloJobs == nil {
+		cs.soloJobs = make(map[string]soloJob)
+	}
+	// jobs of previous blocks are gone from the template
+	for id, j := range cs.soloJobs {
+		if _, ok := t.BlockTplJobMap[j.tplJobId]; !ok {
+			delete(cs.soloJobs, id)
+		}
+	}
+	cs.soloJobs[jobId] = job
+	cs.Unlock()
+
+	soloParams := append([]interface{}{}, params...)
+	soloParams[0], soloParams[2], soloParams[3] = jobId, job.coinBase1, job.coinBase2
+	return soloParams, nil
+}
+
+// pushJob sends the job of params to cs, solo sessions get their own coinbase.
+func (s *ProxyServer) pushJob(cs *Session, t *BlockTemplate, params []interface{}) error {
+	if cs.solo {
+		var err error
+		if params, err = s.soloJobParams(cs, t, params); err != nil {
+			return err
+		}
+	}
+	return cs.pushNewJob(params)
+}
+
+// soloJob returns the solo job jobId of cs, nil if there is none.
+func (cs *Session) soloJob(jobId string) *soloJob {
+	cs.Lock()
+	defer cs.Unlock()
+	if job, ok := cs.soloJobs[jobId]; ok {
+		return &job
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/mutalisk999/bitcoin-lib/src/transaction"
+)
+
+func TestSoloJobParams(t *testing.T) {
+	s := &ProxyServer{config: &Config{CoinBaseExtraData: "btcpool"}}
+	s.initSolo(&Solo{Enabled: true, Fee: 2, FeeAddress: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"})
+	if login, solo := s.soloLogin("solo:bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03"); !solo || login != "bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03" {
+		t.Errorf("Solo prefix must be stripped, got %v %v", login, solo)
+	}
+	if _, solo := s.soloLogin("bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03"); solo {
+		t.Error("Login without prefix must not mine solo")
+	}
+
+	tpl := &BlockTemplate{Height: 1827, BlockTplJobMap: map[string]BlockTemplateJob{
+		"j1": {BlkTplJobId: "j1", BlkTplJobTime: 1607055201, CoinBase1: "cb1", CoinBase2: "cb2", CoinBaseValue: 1000000,
+			DefaultWitnessCommitment: "6a24aa21a9ed2607916dfc80dc54aefa568f2161355625d23e063e38445c6887c01cfa995b95"},
+	}}
+	cs := &Session{login: "bc1qkyz0zhxe6aktl35uzp6rwkr2aht4wrnpvlvr03", solo: true, extraNonce1: "00010002", extraNonce2Size: 8}
+	params, err := s.soloJobParams(cs, tpl, []interface{}{"j1", "prevhash", "cb1", "cb2", []string{}, "20000000", "1d00ffff", "5fc9d061", true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobId := params[0].(string)
+	job := cs.soloJob(jobId)
+	if job == nil || job.tplJobId != "j1" || params[2] != job.coinBase1 || params[3] != job.coinBase2 || job.fee != 20000 {
+		t.Fatalf("Solo job must be registered with its coinbase, got %v %+v", params, job)
+	}
+
+	raw, _ := hex.DecodeString(job.coinBase1 + "000100020102030405060708" + job.coinBase2)
+	var trx transaction.Transaction
+	if err := trx.UnPack(io.Reader(bytes.NewBuffer(raw))); err != nil {
+		t.Fatal(err)
+	}
+	minerScript, _ := bitcoin.GetCoinBaseScript(cs.login)
+	if len(trx.Vout) != 3 || trx.Vout[0].Value != 980000 || !bytes.Equal(trx.Vout[0].ScriptPubKey.GetScriptBytes(), minerScript) {
+		t.Fatalf("Solo coinbase must pay the miner, got %+v", trx.Vout)
+	}
+	if trx.Vout[1].Value != 20000 || !bytes.Equal(trx.Vout[1].ScriptPubKey.GetScriptBytes(), s.soloFeeScript) {
+		t.Errorf("Solo coinbase must pay the fee, got %+v", trx.Vout[1])
+	}
+
+	delete(tpl.BlockTplJobMap, "j1")
+	tpl.BlockTplJobMap["j2"] = BlockTemplateJob{BlkTplJobId: "j2", CoinBaseValue: 1000000}
+	if _, err := s.soloJobParams(cs, tpl, []interface{}{"j2", "prevhash", "cb1", "cb2", []string{}, "20000000", "1d00ffff", "5fc9d061", true}); err != nil {
+		t.Fatal(err)
+	}
+	if cs.soloJob(jobId) != nil || len(cs.soloJobs) != 1 {
+		t.Error("Solo jobs of jobs gone from the template must be dropped")
+	}
+}
@@ -21,11 +21,8 @@ const (
 	Bip320Mask    uint32 = 0x1fffe000
 )
 
-func (s *ProxyServer) ListenTCP() {
-	timeout := MustParseDuration(s.config.Proxy.Stratum.Timeout)
-	s.timeout = timeout
-
-	addr, err := net.ResolveTCPAddr("tcp", s.config.Proxy.Stratum.Listen)
+func (s *ProxyServer) ListenTCP(p *stratumPort) {
+	addr, err := net.ResolveTCPAddr("tcp", p.cfg.Listen)
 	if err != nil {
 		Error.Fatalf("Error: %v", err)
 	}
@@ -35,48 +32,60 @@ func (s *ProxyServer) ListenTCP() {
 	}
 	defer server.Close()
 
-	Info.Printf("Stratum listening on %s", s.config.Proxy.Stratum.Listen)
-	var accept = make(chan int, s.config.Proxy.Stratum.MaxConn)
+	Info.Printf("Stratum listening on %s", p.cfg.Listen)
+	s.serveStratum(p, p.listener(server))
+}
 
-	tag := 0
-	for i := 0; i < s.config.Proxy.Stratum.MaxConn; i++ {
-		accept <- i
+func (s *ProxyServer) serveStratum(p *stratumPort, server net.Listener) {
+	if !s.addListener(server) {
+		return
 	}
-
 	for {
-		conn, err := server.AcceptTCP()
+		conn, err := server.Accept()
 		if err != nil {
+			if s.isDraining() {
+				return
+			}
 			continue
 		}
-		Info.Println("Accept Stratum TCP Connection from: ", conn.RemoteAddr().String())
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.SetKeepAlive(true)
+		}
+		// the tag is taken here so that a full port stops accepting,
+		// the remote address may still wait for a PROXY protocol header
+		go s.acceptStratum(p, conn, <-s.stratumTags)
+	}
+}
 
-		_ = conn.SetKeepAlive(true)
+func (s *ProxyServer) acceptStratum(p *stratumPort, conn net.Conn, tag int) {
+	defer func() { s.stratumTags <- tag }()
 
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	Info.Println("Accept Stratum TCP Connection from: ", conn.RemoteAddr().String())
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
-		if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
-			_ = conn.Close()
-			continue
-		}
+	if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
+		_ = conn.Close()
+		return
+	}
+	tag = s.acquireTag(p, tag)
 
-		tag = <-accept
-		cs := &Session{conn: conn, ip: ip, shareCountInv: 0, tag: uint16(tag), isAuth: false}
+	cs := &Session{conn: conn, ip: ip, port: p, tag: tag, isAuth: false, extraNonce2Size: p.extraNonce2Size}
+	if s.recorder != nil {
+		s.recorder.startSession(cs)
+	}
 
-		go func(cs *Session, tag int) {
-			err = s.handleTCPClient(cs)
-			if err != nil {
-				s.removeSession(cs)
-				_ = conn.Close()
-			}
-			accept <- tag
-		}(cs, tag)
+	err := s.handleTCPClient(cs)
+	if err != nil {
+		s.removeSession(cs)
+		cs.close()
 	}
+	s.saveSession(cs)
 }
 
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
-	cs.enc = json.NewEncoder(cs.conn)
+	cs.out = newSessionWriter(cs.conn, cs.port.timeout)
 	connBuf := bufio.NewReaderSize(cs.conn, MaxReqSize)
-	s.setDeadline(cs.conn)
+	s.setDeadline(cs)
 
 	for {
 		data, isPrefix, err := connBuf.ReadLine()
@@ -87,7 +96,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 		} else if err == io.EOF {
 			Info.Printf("Client %s disconnected", cs.ip)
 			s.removeSession(cs)
-			_ = cs.conn.Close()
+			cs.close()
 			break
 		} else if err != nil {
 			Error.Printf("Error reading from socket: %v", err)
@@ -96,6 +105,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 		}
 
 		if len(data) > 1 {
+			cs.record(recordIn, data)
 			var req StratumReq
 			err = json.Unmarshal(data, &req)
 			if err != nil {
@@ -104,7 +114,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 				return err
 			}
 
-			s.setDeadline(cs.conn)
+			s.setDeadline(cs)
 			err = cs.handleTCPMessage(s, &req)
 			if err != nil {
 				Error.Printf("handleTCPMessage: %v", err)
@@ -119,6 +129,11 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 	Debug.Printf("handleTCPMessage, req.Method: %v", req.Method)
 	Debug.Printf("handleTCPMessage, req.Params: %v", string(req.Params))
 
+	if len(req.Method) == 0 && (req.Result != nil || req.Error != nil) {
+		cs.handleCallReply(req)
+		return nil
+	}
+
 	// Handle RPC methods
 	switch req.Method {
 
@@ -133,13 +148,12 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 			Info.Println("mining.subscribe:", params[0])
 		}
 
-		/*
-			if len(params) > 1 && params[1] != "" {
-				cs.sid = params[1]
-			}
-		*/
+		sid := ""
+		if len(params) > 1 {
+			sid = params[1]
+		}
 
-		reply, errReply := s.handleSubscribeRPC(cs)
+		reply, errReply := s.handleSubscribeRPC(cs, sid)
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
@@ -181,6 +195,7 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		if err != nil {
 			return err
 		}
+		s.applyMinerDiff(cs)
 
 		return err
 
@@ -195,12 +210,33 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		Debug.Printf("mining.submit, Param: %v", params)
 
 		reply, errReply := s.handleTCPSubmitRPC(cs, params)
+		if isShareRejection(errReply) {
+			return cs.sendTCPRejection(req.Id, errReply)
+		}
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
-		return cs.sendTCPResult(req.Id, reply, "2.0")
+		if err = cs.sendTCPResult(req.Id, reply, "2.0"); err != nil {
+			return err
+		}
+		if reply {
+			s.applyVarDiff(cs)
+		}
+		return nil
+
+	case "mining.suggest_difficulty", "mining.suggest_target":
+		diff, errReply := s.parseSuggestedDiff(cs, req.Method, req.Params)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		if err := cs.sendTCPResult(req.Id, true, ""); err != nil {
+			return err
+		}
+		s.applySuggestedDiff(cs, diff)
+		return nil
 
 	case "mining.extranonce.subscribe":
+		cs.extranonceSubscribed = true
 		return cs.sendTCPResult(req.Id, true, "")
 
 	case "mining.configure":
@@ -221,8 +257,12 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
-		cs.versionMask = Bip320Mask
-		return cs.sendTCPResult(req.Id, reply, "")
+		if err = cs.sendTCPResult(req.Id, reply, ""); err != nil {
+			return err
+		}
+		// a minimum difficulty takes effect right away on subscribed sessions
+		s.applyMinerDiff(cs)
+		return nil
 
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
@@ -237,7 +277,7 @@ func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}, version
 	message := JSONRpcResp{Id: id, Version: version, Error: nil, Result: result}
 	m, _ := json.Marshal(&message)
 	Debug.Printf("sendTCPResult: %s", string(m))
-	return cs.enc.Encode(&message)
+	return cs.send(&message)
 }
 
 func (cs *Session) setDifficulty() error {
@@ -256,22 +296,32 @@ func (cs *Session) setDifficulty() error {
 	message := JSONPushMessage{Id: nil, Method: "mining.set_difficulty", Params: []interface{}{setDiff}}
 	m, _ := json.Marshal(&message)
 	Debug.Printf("diff:%v,genesisWork:%v,mining.set_difficulty:%s", diff, genesisWork, string(m))
-	return cs.enc.Encode(&message)
+	return cs.send(&message)
 }
 
 func (cs *Session) setVersionMask() error {
 	cs.Lock()
 	defer cs.Unlock()
 
-	if cs.versionMask == 0 {
+	if cs.requestedVersionMask == 0 {
 		return nil
 	}
-	versionMask := []string{Bip320MaskStr}
+	versionMask := []string{fmt.Sprintf("%08x", cs.versionMask)}
 	message := JSONPushMessage{Id: nil, Method: "mining.set_version_mask", Params: versionMask}
 	m, _ := json.Marshal(&message)
 	Debug.Printf("mining.set_version_mask, message: %s", string(m))
-	return cs.enc.Encode(&message)
+	return cs.send(&message)
+
+}
 
+func (cs *Session) setExtranonce() error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	message := JSONPushMessage{Id: nil, Method: "mining.set_extranonce", Params: []interface{}{cs.extraNonce1, cs.extraNonce2Size}}
+	m, _ := json.Marshal(&message)
+	Debug.Printf("mining.set_extranonce, message: %s", string(m))
+	return cs.send(&message)
 }
 
 func (cs *Session) pushNewJob(params []interface{}) error {
@@ -280,10 +330,40 @@ func (cs *Session) pushNewJob(params []interface{}) error {
 
 	//params := []interface{}{"000000aa", "ad3c695df5a484eed6d8555676b6bb5a59110446a45d74bf517ea0f6a0b07634", "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff2b034e2501046d65da6600", "182f6d696e7420627920736f6c6f6672616374616c2e696f2f00000000020000000000000000266a24aa21a9ede6581639a17e19736e14311d7cceaabfc1674398460cf53c290a59e2ff850fc7678e4995000000001976a91429e5947f66884ee245f7e571332064eafa4515b888ac00000000", []string{"8dd83b1886475b56a1c793ec34d185f187d5fde44f45009223cad1fe0789823d", "4575a258aaf19ea3324bd65ca9e6edf8c24669af3524b90f39f47d2f91255c32", "46321f21d8085b86e10177445c37c5146d74344a8793c44b293875ed935c2060", "b9c57828bc1d0fd7316d37ee3c4a9c53bb17f4e425b72948de66bd111e9dc6b0", "5a14eb9972c9042e639f6672f28061f66eb1db0d5571bc6b3ebe7af58e774603", "d3b4a7247375f5caf0ab5ee676e2bba5af82dfccceb7e9eaa199b4849412b32b", "d8425319cf07c5d85d3fd55cf1cb02e0e9bbf03b461617f190abed951b3a665e", "cfcb27b9f3806dcb42130145398bc5cca8edda70ea4b416891895b89fada0c6e", "bd8d6ad49fe48ab26eadcd1c5364a6d3a09ce1b6c93329202c5972a6244a082d", "55090461df54a8f3e4e2c28c528a360a81c72c7801cd2a34b1777a0c4e3cc4b2", "eb71f02da145dfa6eeaafcba8a9db63aa7a9d8c27acea4ced4fb124b04dd508b", "e6160561c914d5aa238ba57362688726a48360b5bc944f83d6e6b0fb2362d877"}, "20000004", "1900e1bf", "66da656c", true}
 
+	clean := cs.trackJob(params)
 	message := JSONPushMessage{Id: nil, Method: "mining.notify", Version: "2.0", Params: params}
 	//m, _ := json.Marshal(&message)
 	//Debug.Printf("pushNewJob-->mining.notify: %s", string(m))
-	return cs.enc.Encode(&message)
+	return cs.sendMessage(&message, true, clean)
+}
+
+// trackJob remembers the target of a job sent with params, cs must be locked.
+func (cs *Session) trackJob(params []interface{}) bool {
+	// the difficulty announced before this job applies to it
+	jobId, _ := params[0].(string)
+	prevHash, _ := params[1].(string)
+	clean, _ := params[len(params)-1].(bool)
+	prev, resent := cs.jobTargets[jobId]
+	// only a new block ends earlier jobs, clean re-sends on the same block keep them valid
+	if clean && prevHash != cs.jobPrevHash {
+		if cs.jobTargets != nil {
+			cs.staleJobs = cs.jobTargets
+		}
+		cs.jobTargets = nil
+		cs.prevExtraNonce1 = ""
+	}
+	cs.jobPrevHash = prevHash
+	if cs.jobTargets == nil {
+		cs.jobTargets = make(map[string]string)
+	}
+	cs.target = cs.targetNextJob
+	if resent && TargetHexToDiff(prev).Cmp(TargetHexToDiff(cs.target)) < 0 {
+		// job resent after a retarget, shares of both difficulties may arrive
+		cs.jobTargets[jobId] = prev
+	} else {
+		cs.jobTargets[jobId] = cs.target
+	}
+	return clean
 }
 
 func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
@@ -291,15 +371,24 @@ func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
 	defer cs.Unlock()
 
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	err := cs.enc.Encode(&message)
+	err := cs.send(&message)
 	if err != nil {
 		return err
 	}
 	return errors.New(reply.Message)
 }
 
-func (s *ProxyServer) setDeadline(conn *net.TCPConn) {
-	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+// sendTCPRejection answers a rejected share, unlike sendTCPError the session stays open.
+func (cs *Session) sendTCPRejection(id json.RawMessage, reply *ErrorReply) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
+	return cs.send(&message)
+}
+
+func (s *ProxyServer) setDeadline(cs *Session) {
+	_ = cs.conn.SetDeadline(time.Now().Add(cs.port.timeout))
 }
 
 func (s *ProxyServer) registerSession(cs *Session) {
@@ -314,10 +403,11 @@ func (s *ProxyServer) removeSession(cs *Session) {
 	delete(s.sessions, cs)
 }
 
-func (s *ProxyServer) broadcastNewJobs() {
-	t := s.currentBlockTemplate()
-	if t == nil || len(t.PrevHash) == 0 || s.isSick() {
-		return
+// jobNotifyParams returns the mining.notify params of the latest job of t for sessions
+// with extraNonceSize bytes of extra nonces, nil if there is none.
+func (s *ProxyServer) jobNotifyParams(t *BlockTemplate, extraNonceSize int, clean bool) []interface{} {
+	if t == nil || len(t.PrevHash) == 0 {
+		return nil
 	}
 	var params []interface{}
 
@@ -325,18 +415,22 @@ func (s *ProxyServer) broadcastNewJobs() {
 	var prevHash bigint.Uint256
 	err := prevHash.SetHex(t.PrevHash)
 	if err != nil {
-		return
+		return nil
 	}
 
 	prevHashHex := prevHash.GetHex()
 	prevHashHexStratum, err := TargetHash256StratumFormat(prevHashHex)
 	if err != nil {
-		return
+		return nil
 	}
 
 	tplJob, ok := t.BlockTplJobMap[t.lastBlkTplId]
 	if !ok {
-		return
+		return nil
+	}
+	coinBase1, ok := tplJob.coinBase1(extraNonceSize)
+	if !ok {
+		return nil
 	}
 
 	//t.Version = t.Version | Bip320Mask
@@ -347,7 +441,7 @@ func (s *ProxyServer) broadcastNewJobs() {
 	for _, hashHex := range tplJob.MerkleBranch {
 		hashHexStratum, err := Hash256StratumFormat(hashHex)
 		if err != nil {
-			return
+			return nil
 		}
 		MerkleBranchStratum = append(MerkleBranchStratum, hashHexStratum)
 	}
@@ -356,40 +450,89 @@ func (s *ProxyServer) broadcastNewJobs() {
 	//maskVersion := t.Version | defaultVersionMask
 	maskVersion := t.Version
 
-	params = append(append(append(append(append(params, t.lastBlkTplId), prevHashHexStratum), tplJob.CoinBase1), tplJob.CoinBase2), MerkleBranchStratum)
+	params = append(append(append(append(append(params, t.lastBlkTplId), prevHashHexStratum), coinBase1), tplJob.CoinBase2), MerkleBranchStratum)
 	params = append(append(append(params, fmt.Sprintf("%08x", maskVersion)), fmt.Sprintf("%08x", t.NBits)), fmt.Sprintf("%08x", tplJob.BlkTplJobTime))
-	params = append(params, t.newBlkTpl)
+	params = append(params, clean)
+	return params
+}
 
-	s.sessionsMu.RLock()
-	defer s.sessionsMu.RUnlock()
+func (s *ProxyServer) broadcastNewJobs() {
+	t := s.currentBlockTemplate()
+	if t == nil || s.isSick() {
+		return
+	}
+	// the mask has to change before miners roll the new version
+	s.updateVersionMask(t)
+	// the params only differ in coinbase1 for other extra nonce sizes
+	paramsBySize := make(map[int][]interface{})
+	for _, size := range s.extraNonceSizes() {
+		if params := s.jobNotifyParams(t, size, t.newBlkTpl); params != nil {
+			paramsBySize[size] = params
+		}
+	}
+	if len(paramsBySize) == 0 {
+		return
+	}
 
-	count := len(s.sessions)
-	Info.Printf("Broadcasting new job to %v stratum miners", count)
+	s.sessionsMu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for m := range s.sessions {
+		sessions = append(sessions, m)
+	}
+	s.sessionsMu.RUnlock()
 
+	Info.Printf("Broadcasting new job to %v stratum miners", len(sessions))
 	start := time.Now()
-	bcast := make(chan int, 1024)
-	n := 0
 
-	for m := range s.sessions {
-		if !m.isAuth {
+	// jobs are only queued, the session writers send them
+	for _, cs := range sessions {
+		params, ok := paramsBySize[cs.extraNonceSize()]
+		if !cs.isAuth || !ok {
 			continue
 		}
+		if err := s.pushJob(cs, t, params); err != nil {
+			Error.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
+			s.removeSession(cs)
+			_ = cs.conn.Close()
+			continue
+		}
+		s.setDeadline(cs)
+	}
+	Info.Printf("Jobs broadcast finished %s", time.Since(start))
+}
 
-		n++
-		bcast <- n
+func (cs *Session) currentTarget() string {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.target
+}
 
-		go func(s *ProxyServer, cs *Session) {
+// jobState tells whether jobId was sent to the session and, if not, whether it
+// was ended by the first clean job of a new block.
+func (cs *Session) jobState(jobId string) (sent bool, stale bool) {
+	cs.Lock()
+	defer cs.Unlock()
+	if _, ok := cs.jobTargets[jobId]; ok {
+		return true, false
+	}
+	_, stale = cs.staleJobs[jobId]
+	return false, stale
+}
 
-			err := cs.pushNewJob(params)
+// previousExtraNonce1 returns the extraNonce1 work sent before the last
+// mining.set_extranonce may still use, or an empty string.
+func (cs *Session) previousExtraNonce1() string {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.prevExtraNonce1
+}
 
-			<-bcast
-			if err != nil {
-				Error.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
-				s.removeSession(cs)
-			} else {
-				s.setDeadline(cs.conn)
-			}
-		}(s, m)
+// jobTarget returns the target jobId was sent with, or the current one for unknown jobs.
+func (cs *Session) jobTarget(jobId string) string {
+	cs.Lock()
+	defer cs.Unlock()
+	if target, ok := cs.jobTargets[jobId]; ok {
+		return target
 	}
-	Info.Printf("Jobs broadcast finished %s", time.Since(start))
+	return cs.target
 }
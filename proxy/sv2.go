@@ -0,0 +1,784 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/mutalisk999/bitcoin-lib/src/base58"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/transaction"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"github.com/mutalisk999/txid_merkle_tree"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/noise"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+type Sv2Conn struct {
+	sync.Mutex
+	conn *net.TCPConn
+	ip   string
+	recv *noise.CipherState
+	send *noise.CipherState
+	out  *sessionWriter
+
+	// guarded by chMu
+	chMu          sync.Mutex
+	setupDone     bool
+	channels      map[uint32]*Sv2Channel
+	nextChannelId uint32
+}
+
+type Sv2Channel struct {
+	id       uint32
+	extended bool
+	cs       *Session
+
+	// sv2 job id -> block template job id
+	jobs      map[uint32]string
+	nextJobId uint32
+}
+
+// Sv2Job is one block template job prepared for the binary protocol.
+type Sv2Job struct {
+	tplJobId     string
+	version      uint32
+	prevHash     []byte
+	nBits        uint32
+	nTime        uint32
+	clean        bool
+	coinBase1    string
+	coinBase2    string
+	merkleBranch []string
+	merklePath   [][]byte
+}
+
+func (s *ProxyServer) ListenSv2() {
+	cfg := &s.config.Proxy.StratumV2
+	s.sv2Timeout = MustParseDuration(cfg.Timeout)
+	// v2 channels get the pool wide difficulty and extra nonce sizes
+	s.sv2Port = &stratumPort{
+		target:          s.target,
+		extraNonce1Size: bitcoin.EXTRANONCE1_SIZE,
+		extraNonce2Size: bitcoin.EXTRANONCE2_SIZE,
+		timeout:         s.sv2Timeout,
+	}
+	s.sv2CertValidity = MustParseDuration(cfg.CertValidity)
+
+	secret, err := hex.DecodeString(cfg.AuthoritySecretKey)
+	if err != nil || len(secret) != 32 {
+		Error.Fatalf("Invalid stratum v2 authoritySecretKey")
+	}
+	s.sv2Authority, _ = btcec.PrivKeyFromBytes(secret)
+	s.sv2StaticKey, err = btcec.NewPrivateKey()
+	if err != nil {
+		Error.Fatalf("Error: %v", err)
+	}
+
+	// extra nonce tags of v2 channels follow the v1 ones
+	first := cap(s.stratumTags)
+	if first+cfg.MaxConn > 0x10000 {
+		Error.Fatalf("Stratum maxConn + stratumV2 maxConn must not exceed %d", 0x10000)
+	}
+	s.sv2Tags = make(chan int, cfg.MaxConn)
+	for i := 0; i < cfg.MaxConn; i++ {
+		s.sv2Tags <- first + i
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Listen)
+	if err != nil {
+		Error.Fatalf("Error: %v", err)
+	}
+	server, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		Error.Fatalf("Error: %v", err)
+	}
+	defer server.Close()
+
+	Info.Printf("Stratum V2 listening on %s, authority public key %s", cfg.Listen, Sv2AuthorityKeyString(s.sv2Authority.PubKey()))
+
+	if !s.addListener(server) {
+		return
+	}
+	for {
+		conn, err := server.AcceptTCP()
+		if err != nil {
+			if s.isDraining() {
+				return
+			}
+			continue
+		}
+		Info.Println("Accept Stratum V2 TCP Connection from: ", conn.RemoteAddr().String())
+
+		_ = conn.SetKeepAlive(true)
+
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+		if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
+			_ = conn.Close()
+			continue
+		}
+
+		sc := &Sv2Conn{conn: conn, ip: ip, channels: make(map[uint32]*Sv2Channel)}
+		go func(sc *Sv2Conn) {
+			err := s.handleSv2Client(sc)
+			if err != nil && err != io.EOF {
+				Error.Printf("Stratum V2 client %s: %v", sc.ip, err)
+			}
+			s.removeSv2Conn(sc)
+			sc.close()
+		}(sc)
+	}
+}
+
+// Sv2AuthorityKeyString formats the authority public key the way sv2 miners expect it in their configuration.
+func Sv2AuthorityKeyString(pub *btcec.PublicKey) string {
+	payload := append([]byte{0x01, 0x00}, schnorr.SerializePubKey(pub)...)
+	check := utility.Sha256(utility.Sha256(payload))[0:4]
+	return base58.Encode(append(payload, check...))
+}
+
+func (s *ProxyServer) handleSv2Client(sc *Sv2Conn) error {
+	_ = sc.conn.SetDeadline(time.Now().Add(s.sv2Timeout))
+
+	act1 := make([]byte, noise.Act1Size)
+	if _, err := io.ReadFull(sc.conn, act1); err != nil {
+		return err
+	}
+	cert, err := noise.NewCertificate(s.sv2Authority, s.sv2StaticKey.PubKey(), s.sv2CertValidity)
+	if err != nil {
+		return err
+	}
+	act2, recv, send, err := noise.NewResponder(s.sv2StaticKey, cert).Respond(act1)
+	if err != nil {
+		s.policy.ApplyMalformedPolicy(sc.ip)
+		return err
+	}
+	if _, err = sc.conn.Write(act2); err != nil {
+		return err
+	}
+	sc.recv, sc.send = recv, send
+	sc.out = newSessionWriter(sc.conn, s.sv2Timeout)
+	sc.out.seal = sc.seal
+	s.registerSv2Conn(sc)
+
+	for {
+		frame, err := sc.readFrame()
+		if err == errSv2Flood {
+			Error.Printf("Socket flood detected from %s", sc.ip)
+			s.policy.BanClient(sc.ip)
+			return err
+		} else if err != nil {
+			return err
+		}
+		_ = sc.conn.SetDeadline(time.Now().Add(s.sv2Timeout))
+
+		if err = s.handleSv2Message(sc, frame); err != nil {
+			return err
+		}
+	}
+}
+
+var errSv2Flood = errors.New("sv2: frame too large")
+
+func (sc *Sv2Conn) readFrame() (*Sv2Frame, error) {
+	encHeader := make([]byte, Sv2HeaderSize+noise.MacSize)
+	if _, err := io.ReadFull(sc.conn, encHeader); err != nil {
+		return nil, err
+	}
+	header, err := sc.recv.Decrypt(nil, encHeader)
+	if err != nil {
+		return nil, err
+	}
+	ext, msgType, length := decodeSv2Header(header)
+	if length > Sv2MaxFrameSize {
+		return nil, errSv2Flood
+	}
+
+	payload := make([]byte, 0, length)
+	for remain := length; remain > 0; {
+		n := remain
+		if n > Sv2MaxChunkSize-noise.MacSize {
+			n = Sv2MaxChunkSize - noise.MacSize
+		}
+		chunk := make([]byte, n+noise.MacSize)
+		if _, err = io.ReadFull(sc.conn, chunk); err != nil {
+			return nil, err
+		}
+		plain, err := sc.recv.Decrypt(nil, chunk)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, plain...)
+		remain -= n
+	}
+	return &Sv2Frame{ExtensionType: ext, MsgType: msgType, Payload: payload}, nil
+}
+
+func (sc *Sv2Conn) writeMessage(msgType uint8, payload []byte) error {
+	return sc.queue(outMessage{data: sv2Frame(msgType, payload)})
+}
+
+func sv2Frame(msgType uint8, payload []byte) []byte {
+	return append(encodeSv2Header(msgType, len(payload)), payload...)
+}
+
+// queue queues the plain frames of msg, or encrypts and writes them right away
+// for connections without a writer.
+func (sc *Sv2Conn) queue(msg outMessage) error {
+	if sc.out != nil {
+		return sc.out.enqueue(msg)
+	}
+	sc.Lock()
+	defer sc.Unlock()
+
+	out, err := sc.seal(msg.data)
+	if err != nil {
+		return err
+	}
+	_, err = sc.conn.Write(out)
+	return err
+}
+
+// seal encrypts plain frames, the header and each payload chunk separately.
+// Frames must be sealed in the order they are written.
+func (sc *Sv2Conn) seal(data []byte) ([]byte, error) {
+	var out []byte
+	for len(data) >= Sv2HeaderSize {
+		_, _, length := decodeSv2Header(data)
+		header, err := sc.send.Encrypt(nil, data[:Sv2HeaderSize])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, header...)
+		payload := data[Sv2HeaderSize : Sv2HeaderSize+length]
+		data = data[Sv2HeaderSize+length:]
+		for len(payload) > 0 {
+			n := len(payload)
+			if n > Sv2MaxChunkSize-noise.MacSize {
+				n = Sv2MaxChunkSize - noise.MacSize
+			}
+			chunk, err := sc.send.Encrypt(nil, payload[:n])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, chunk...)
+			payload = payload[n:]
+		}
+	}
+	return out, nil
+}
+
+// close flushes the queued frames and closes the connection.
+func (sc *Sv2Conn) close() {
+	if sc.out != nil {
+		sc.out.close()
+	}
+	_ = sc.conn.Close()
+}
+
+func (s *ProxyServer) handleSv2Message(sc *Sv2Conn, frame *Sv2Frame) error {
+	Debug.Printf("handleSv2Message, msgType: 0x%02x, from: %s", frame.MsgType, sc.ip)
+
+	sc.chMu.Lock()
+	setupDone := sc.setupDone
+	sc.chMu.Unlock()
+
+	if frame.ExtensionType&^Sv2ChannelBit != 0 {
+		// extensions are not negotiated, ignore them
+		return nil
+	}
+	if !setupDone && frame.MsgType != Sv2MsgSetupConnection {
+		s.policy.ApplyMalformedPolicy(sc.ip)
+		return errors.New("sv2: SetupConnection expected")
+	}
+
+	switch frame.MsgType {
+	case Sv2MsgSetupConnection:
+		var m Sv2SetupConnection
+		if err := m.decode(frame.Payload); err != nil {
+			s.policy.ApplyMalformedPolicy(sc.ip)
+			return err
+		}
+		return s.handleSv2Setup(sc, &m)
+
+	case Sv2MsgOpenStandardMiningChannel, Sv2MsgOpenExtendedMiningChannel:
+		extended := frame.MsgType == Sv2MsgOpenExtendedMiningChannel
+		var m Sv2OpenMiningChannel
+		if err := m.decode(frame.Payload, extended); err != nil {
+			s.policy.ApplyMalformedPolicy(sc.ip)
+			return err
+		}
+		return s.handleSv2OpenChannel(sc, &m, extended)
+
+	case Sv2MsgSubmitSharesStandard, Sv2MsgSubmitSharesExtended:
+		extended := frame.MsgType == Sv2MsgSubmitSharesExtended
+		var m Sv2SubmitShares
+		if err := m.decode(frame.Payload, extended); err != nil {
+			s.policy.ApplyMalformedPolicy(sc.ip)
+			return err
+		}
+		return s.handleSv2Submit(sc, &m, extended)
+
+	case Sv2MsgUpdateChannel:
+		var m Sv2UpdateChannel
+		if err := m.decode(frame.Payload); err != nil {
+			s.policy.ApplyMalformedPolicy(sc.ip)
+			return err
+		}
+		return s.handleSv2UpdateChannel(sc, &m)
+
+	case Sv2MsgCloseChannel:
+		var m Sv2CloseChannel
+		if err := m.decode(frame.Payload); err != nil {
+			s.policy.ApplyMalformedPolicy(sc.ip)
+			return err
+		}
+		Info.Printf("Stratum V2 channel %d closed by %s: %s", m.ChannelId, sc.ip, m.ReasonCode)
+		s.closeSv2Channel(sc, m.ChannelId)
+		return nil
+
+	default:
+		Error.Printf("Unknown stratum v2 message type 0x%02x from %s", frame.MsgType, sc.ip)
+		s.policy.ApplyMalformedPolicy(sc.ip)
+		return nil
+	}
+}
+
+func (s *ProxyServer) handleSv2Setup(sc *Sv2Conn, m *Sv2SetupConnection) error {
+	fail := func(code string) error {
+		w := &sv2Writer{}
+		w.u32(0)
+		w.str0255(code)
+		_ = sc.writeMessage(Sv2MsgSetupConnectionError, w.buf)
+		return errors.New("sv2: " + code)
+	}
+
+	if m.Protocol != Sv2ProtocolMining {
+		return fail("unsupported-protocol")
+	}
+	if m.MinVersion > Sv2ProtocolVer || m.MaxVersion < Sv2ProtocolVer {
+		return fail("protocol-version-mismatch")
+	}
+	if m.Flags&Sv2FlagRequiresWorkSelection != 0 {
+		return fail("unsupported-feature-flags")
+	}
+	Info.Printf("Stratum V2 setup from %s, vendor: %s, hardware: %s, firmware: %s",
+		sc.ip, m.Vendor, m.HardwareVersion, m.Firmware)
+
+	sc.chMu.Lock()
+	sc.setupDone = true
+	sc.chMu.Unlock()
+
+	w := &sv2Writer{}
+	w.u16(Sv2ProtocolVer)
+	w.u32(0)
+	return sc.writeMessage(Sv2MsgSetupConnectionSuccess, w.buf)
+}
+
+func (s *ProxyServer) handleSv2OpenChannel(sc *Sv2Conn, m *Sv2OpenMiningChannel, extended bool) error {
+	fail := func(code string) error {
+		w := &sv2Writer{}
+		w.u32(m.RequestId)
+		w.str0255(code)
+		return sc.writeMessage(Sv2MsgOpenMiningChannelError, w.buf)
+	}
+
+	if extended && m.MinExtranonceSize > bitcoin.EXTRANONCE2_SIZE {
+		return fail("min-extranonce-size-too-large")
+	}
+
+	var tag int
+	select {
+	case tag = <-s.sv2Tags:
+	default:
+		return fail("max-channels-reached")
+	}
+
+	cs := &Session{ip: sc.ip, port: s.sv2Port, tag: tag, extraNonce2Size: bitcoin.EXTRANONCE2_SIZE}
+	s.initSv2Session(cs, m.MaxTarget)
+	// OpenMiningChannel has no password, accounts with one are refused
+	if _, errReply := s.handleAuthorizeRPC(cs, []string{m.UserIdentity}); errReply != nil {
+		if errReply == errPasswordRequired {
+			Info.Printf("Stratum V2 account %v@%v refused, accounts with a password only log in over stratum v1", m.UserIdentity, sc.ip)
+		}
+		s.sv2Tags <- tag
+		return fail("unknown-user")
+	}
+
+	sc.chMu.Lock()
+	sc.nextChannelId++
+	ch := &Sv2Channel{id: sc.nextChannelId, extended: extended, cs: cs, jobs: make(map[uint32]string)}
+	sc.channels[ch.id] = ch
+	sc.chMu.Unlock()
+
+	extraNonce1, _ := hex.DecodeString(cs.extraNonce1)
+	w := &sv2Writer{}
+	w.u32(m.RequestId)
+	w.u32(ch.id)
+	w.u256(sv2Target(cs.target))
+	if extended {
+		w.u16(bitcoin.EXTRANONCE2_SIZE)
+		w.b0255(extraNonce1)
+		if err := sc.writeMessage(Sv2MsgOpenExtendedMiningChannelOk, w.buf); err != nil {
+			return err
+		}
+	} else {
+		// standard channels have no extranonce space of their own
+		w.b0255(append(extraNonce1, make([]byte, bitcoin.EXTRANONCE2_SIZE)...))
+		w.u32(0)
+		if err := sc.writeMessage(Sv2MsgOpenStandardMiningChannelOk, w.buf); err != nil {
+			return err
+		}
+	}
+	Info.Printf("Stratum V2 channel %d opened for %v.%v@%v, extended: %v", ch.id, cs.login, cs.id, cs.ip, extended)
+
+	job := s.currentSv2Job()
+	if job == nil {
+		return nil
+	}
+	first := *job
+	first.clean = true
+	return sc.pushJob(ch, &first)
+}
+
+// initSv2Session sets up the difficulty and extra nonce of a v2 channel, the
+// channel target never exceeds the maximum target requested by the miner.
+func (s *ProxyServer) initSv2Session(cs *Session, maxTarget []byte) {
+	diff := TargetHexToDiff(cs.port.target)
+	if minDiff := sv2TargetToDiff(maxTarget); minDiff.Cmp(diff) > 0 {
+		diff = minDiff
+	}
+	cs.target = GetTargetHex(diff.Int64())
+	cs.targetNextJob = cs.target
+	cs.sid = fmt.Sprintf("sv2-%d-%d", s.config.Id, cs.tag)
+	cs.extraNonce1 = fmt.Sprintf("%08x", uint32(s.config.Id)<<16|uint32(cs.tag))
+}
+
+func (s *ProxyServer) handleSv2UpdateChannel(sc *Sv2Conn, m *Sv2UpdateChannel) error {
+	sc.chMu.Lock()
+	ch, ok := sc.channels[m.ChannelId]
+	sc.chMu.Unlock()
+	if !ok {
+		w := &sv2Writer{}
+		w.u32(m.ChannelId)
+		w.str0255("invalid-channel-id")
+		return sc.writeMessage(Sv2MsgUpdateChannelError, w.buf)
+	}
+
+	minDiff := sv2TargetToDiff(m.MaxTarget)
+	if minDiff.Cmp(TargetHexToDiff(ch.cs.target)) <= 0 {
+		return nil
+	}
+	ch.cs.target = GetTargetHex(minDiff.Int64())
+	ch.cs.targetNextJob = ch.cs.target
+
+	w := &sv2Writer{}
+	w.u32(ch.id)
+	w.u256(sv2Target(ch.cs.target))
+	return sc.writeMessage(Sv2MsgSetTarget, w.buf)
+}
+
+// sv2RejectCodes are the SubmitShares.Error codes of the share rejections.
+var sv2RejectCodes = map[*ErrorReply]string{
+	errInvalidShare:       "invalid-share",
+	errJobNotFound:        "invalid-job-id",
+	errStaleJob:           "stale-share",
+	errDuplicateShare:     "duplicate-share",
+	errLowDifficulty:      "difficulty-too-low",
+	errInvalidNTime:       "invalid-timestamp",
+	errInvalidVersionBits: "invalid-version",
+}
+
+func (s *ProxyServer) handleSv2Submit(sc *Sv2Conn, m *Sv2SubmitShares, extended bool) error {
+	fail := func(code string) error {
+		w := &sv2Writer{}
+		w.u32(m.ChannelId)
+		w.u32(m.SequenceNumber)
+		w.str0255(code)
+		return sc.writeMessage(Sv2MsgSubmitSharesError, w.buf)
+	}
+
+	sc.chMu.Lock()
+	ch, ok := sc.channels[m.ChannelId]
+	var tplJobId string
+	if ok {
+		tplJobId, ok = ch.jobs[m.JobId]
+		if !ok {
+			sc.chMu.Unlock()
+			s.writeRejectedShare(ch.cs, TargetHexToDiff(ch.cs.currentTarget()).Int64(), storage.RejectUnknownJob)
+			return fail("invalid-job-id")
+		}
+	}
+	sc.chMu.Unlock()
+	if !ok || ch.extended != extended {
+		return fail("invalid-channel-id")
+	}
+
+	eNonce2 := make([]byte, bitcoin.EXTRANONCE2_SIZE)
+	if extended {
+		if len(m.Extranonce) != bitcoin.EXTRANONCE2_SIZE {
+			s.policy.ApplyMalformedPolicy(sc.ip)
+			s.writeRejectedShare(ch.cs, TargetHexToDiff(ch.cs.currentTarget()).Int64(), storage.RejectMalformed)
+			return fail("invalid-extranonce")
+		}
+		eNonce2 = m.Extranonce
+	}
+
+	t := s.currentBlockTemplate()
+	if t == nil {
+		return fail("stale-share")
+	}
+	// the v2 version field is the whole header version, only the rolled bits are forwarded
+	versionMask := s.poolVersionMask()
+	if (m.Version^t.Version)&^versionMask != 0 {
+		s.writeRejectedShare(ch.cs, TargetHexToDiff(ch.cs.currentTarget()).Int64(), storage.RejectBadVersionBits)
+		return fail("invalid-version")
+	}
+	ch.cs.Lock()
+	ch.cs.versionMask = versionMask
+	ch.cs.Unlock()
+	params := []string{ch.cs.login, tplJobId, hex.EncodeToString(eNonce2),
+		fmt.Sprintf("%08x", m.NTime), fmt.Sprintf("%08x", m.Nonce), fmt.Sprintf("%08x", m.Version&versionMask)}
+
+	_, errReply := s.handleSubmitRPC(ch.cs, params)
+	if errReply != nil && !isShareRejection(errReply) {
+		// the peer is above the invalid share limit
+		return errors.New(errReply.Message)
+	}
+	if errReply != nil {
+		return fail(sv2RejectCodes[errReply])
+	}
+
+	w := &sv2Writer{}
+	w.u32(ch.id)
+	w.u32(m.SequenceNumber)
+	w.u32(1)
+	w.u64(TargetHexToDiff(ch.cs.target).Uint64())
+	return sc.writeMessage(Sv2MsgSubmitSharesSuccess, w.buf)
+}
+
+func (s *ProxyServer) closeSv2Channel(sc *Sv2Conn, channelId uint32) {
+	sc.chMu.Lock()
+	ch, ok := sc.channels[channelId]
+	delete(sc.channels, channelId)
+	sc.chMu.Unlock()
+	if ok {
+		s.sv2Tags <- ch.cs.tag
+	}
+}
+
+func (s *ProxyServer) registerSv2Conn(sc *Sv2Conn) {
+	s.sv2Mu.Lock()
+	defer s.sv2Mu.Unlock()
+	s.sv2Conns[sc] = struct{}{}
+}
+
+func (s *ProxyServer) removeSv2Conn(sc *Sv2Conn) {
+	s.sv2Mu.Lock()
+	_, ok := s.sv2Conns[sc]
+	delete(s.sv2Conns, sc)
+	s.sv2Mu.Unlock()
+	if !ok {
+		return
+	}
+
+	sc.chMu.Lock()
+	ids := make([]uint32, 0, len(sc.channels))
+	for id := range sc.channels {
+		ids = append(ids, id)
+	}
+	sc.chMu.Unlock()
+	for _, id := range ids {
+		s.closeSv2Channel(sc, id)
+	}
+}
+
+// currentSv2Job converts the latest block template job for the binary protocol.
+func (s *ProxyServer) currentSv2Job() *Sv2Job {
+	t := s.currentBlockTemplate()
+	if t == nil || len(t.PrevHash) == 0 || s.isSick() {
+		return nil
+	}
+	tplJob, ok := t.BlockTplJobMap[t.lastBlkTplId]
+	if !ok {
+		return nil
+	}
+
+	var prevHash bigint.Uint256
+	if err := prevHash.SetHex(t.PrevHash); err != nil {
+		return nil
+	}
+	job := &Sv2Job{
+		tplJobId:     t.lastBlkTplId,
+		version:      t.Version,
+		prevHash:     prevHash.GetData(),
+		nBits:        t.NBits,
+		nTime:        tplJob.BlkTplJobTime,
+		clean:        t.newBlkTpl,
+		coinBase1:    tplJob.CoinBase1,
+		coinBase2:    tplJob.CoinBase2,
+		merkleBranch: tplJob.MerkleBranch,
+	}
+	for _, hashHex := range tplJob.MerkleBranch {
+		var h bigint.Uint256
+		if err := h.SetHex(hashHex); err != nil {
+			return nil
+		}
+		job.merklePath = append(job.merklePath, h.GetData())
+	}
+	return job
+}
+
+func (s *ProxyServer) broadcastSv2Jobs() {
+	job := s.currentSv2Job()
+	if job == nil {
+		return
+	}
+
+	s.sv2Mu.RLock()
+	conns := make([]*Sv2Conn, 0, len(s.sv2Conns))
+	for sc := range s.sv2Conns {
+		conns = append(conns, sc)
+	}
+	s.sv2Mu.RUnlock()
+
+	Info.Printf("Broadcasting new job to %v stratum v2 connections", len(conns))
+	for _, sc := range conns {
+		sc.chMu.Lock()
+		channels := make([]*Sv2Channel, 0, len(sc.channels))
+		for _, ch := range sc.channels {
+			channels = append(channels, ch)
+		}
+		sc.chMu.Unlock()
+
+		for _, ch := range channels {
+			if err := sc.pushJob(ch, job); err != nil {
+				Error.Printf("Job transmit error to %v@%v: %v", ch.cs.login, ch.cs.ip, err)
+				_ = sc.conn.Close()
+				break
+			}
+		}
+		_ = sc.conn.SetDeadline(time.Now().Add(s.sv2Timeout))
+	}
+}
+
+// pushJob queues job for the channel. Jobs on a new previous block hash are sent
+// as future jobs and activated right away with SetNewPrevHash, both frames are
+// queued as one message so that a newer job drops them together.
+func (sc *Sv2Conn) pushJob(ch *Sv2Channel, job *Sv2Job) error {
+	sc.chMu.Lock()
+	if job.clean {
+		ch.jobs = make(map[uint32]string)
+	}
+	ch.nextJobId++
+	jobId := ch.nextJobId
+	ch.jobs[jobId] = job.tplJobId
+	sc.chMu.Unlock()
+
+	var minNTime *uint32
+	if !job.clean {
+		minNTime = &job.nTime
+	}
+
+	msg := outMessage{job: true, clean: job.clean, channel: ch.id}
+	w := &sv2Writer{}
+	w.u32(ch.id)
+	w.u32(jobId)
+	w.optU32(minNTime)
+	w.u32(job.version)
+	if ch.extended {
+		w.bool(true)
+		w.seq0255U256(job.merklePath)
+		cb1, _ := hex.DecodeString(job.coinBase1)
+		cb2, _ := hex.DecodeString(job.coinBase2)
+		w.b064k(cb1)
+		w.b064k(cb2)
+		msg.data = sv2Frame(Sv2MsgNewExtendedMiningJob, w.buf)
+	} else {
+		eNonce2 := hex.EncodeToString(make([]byte, bitcoin.EXTRANONCE2_SIZE))
+		merkleRoot, err := coinBaseMerkleRoot(job.coinBase1, ch.cs.extraNonce1, eNonce2, job.coinBase2, job.merkleBranch)
+		if err != nil {
+			return err
+		}
+		w.b0255(merkleRoot)
+		msg.data = sv2Frame(Sv2MsgNewMiningJob, w.buf)
+	}
+
+	if job.clean {
+		w = &sv2Writer{}
+		w.u32(ch.id)
+		w.u32(jobId)
+		w.u256(job.prevHash)
+		w.u32(job.nTime)
+		w.u32(job.nBits)
+		msg.data = append(msg.data, sv2Frame(Sv2MsgSetNewPrevHash, w.buf)...)
+	}
+	return sc.queue(msg)
+}
+
+// coinBaseMerkleRoot returns the merkle root in header byte order.
+func coinBaseMerkleRoot(coinBase1, extraNonce1, extraNonce2, coinBase2 string, merkleBranch []string) ([]byte, error) {
+	cbBytes, err := hex.DecodeString(coinBase1 + extraNonce1 + extraNonce2 + coinBase2)
+	if err != nil {
+		return nil, err
+	}
+	var cbTrx transaction.Transaction
+	if err = cbTrx.UnPack(bytes.NewBuffer(cbBytes)); err != nil {
+		return nil, err
+	}
+	cbTrxId, err := cbTrx.CalcTrxId()
+	if err != nil {
+		return nil, err
+	}
+	merkleRootHex, err := txid_merkle_tree.GetMerkleRootHexFromCoinBaseAndMerkleBranch(cbTrxId.GetHex(), merkleBranch)
+	if err != nil {
+		return nil, err
+	}
+	var root bigint.Uint256
+	if err = root.SetHex(merkleRootHex); err != nil {
+		return nil, err
+	}
+	return root.GetData(), nil
+}
+
+// sv2Target converts a target hex string to the little-endian U256 used on the wire.
+func sv2Target(targetHex string) []byte {
+	target := new(big.Int).SetBytes(common.FromHex(targetHex))
+	// difficulty 1 yields 2^256, which does not fit into an U256
+	if target.BitLen() > 256 {
+		target.SetBytes(bytes.Repeat([]byte{0xff}, 32))
+	}
+	be := target.FillBytes(make([]byte, 32))
+	le := make([]byte, 32)
+	for i := range be {
+		le[i] = be[31-i]
+	}
+	return le
+}
+
+// sv2TargetToDiff returns the difficulty of a little-endian U256 target, zero for an empty target.
+func sv2TargetToDiff(le []byte) *big.Int {
+	be := make([]byte, len(le))
+	for i := range le {
+		be[i] = le[len(le)-1-i]
+	}
+	target := new(big.Int).SetBytes(be)
+	if target.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	return TargetHexToDiff(hexutil.Encode(target.Bytes()))
+}
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Stratum V2 binary encoding, see the "Protocol Overview" and "Mining Protocol"
+// chapters of the sv2 specification. All integers are little-endian.
+
+const (
+	Sv2HeaderSize   = 6
+	Sv2ChannelBit   = 0x8000
+	Sv2MaxChunkSize = 65535
+	Sv2MaxFrameSize = 1 << 16
+
+	Sv2ProtocolMining = 0
+	Sv2ProtocolVer    = 2
+)
+
+// Common and Mining protocol message types
+const (
+	Sv2MsgSetupConnection             = 0x00
+	Sv2MsgSetupConnectionSuccess      = 0x01
+	Sv2MsgSetupConnectionError        = 0x02
+	Sv2MsgOpenStandardMiningChannel   = 0x10
+	Sv2MsgOpenStandardMiningChannelOk = 0x11
+	Sv2MsgOpenMiningChannelError      = 0x12
+	Sv2MsgOpenExtendedMiningChannel   = 0x13
+	Sv2MsgOpenExtendedMiningChannelOk = 0x14
+	Sv2MsgNewMiningJob                = 0x15
+	Sv2MsgUpdateChannel               = 0x16
+	Sv2MsgUpdateChannelError          = 0x17
+	Sv2MsgCloseChannel                = 0x18
+	Sv2MsgSetExtranoncePrefix         = 0x19
+	Sv2MsgSubmitSharesStandard        = 0x1a
+	Sv2MsgSubmitSharesExtended        = 0x1b
+	Sv2MsgSubmitSharesSuccess         = 0x1c
+	Sv2MsgSubmitSharesError           = 0x1d
+	Sv2MsgNewExtendedMiningJob        = 0x1f
+	Sv2MsgSetNewPrevHash              = 0x20
+	Sv2MsgSetTarget                   = 0x21
+	Sv2MsgReconnect                   = 0x25
+)
+
+// SetupConnection flags of the Mining protocol
+const (
+	Sv2FlagRequiresStandardJobs  = 0x1
+	Sv2FlagRequiresWorkSelection = 0x2
+	Sv2FlagRequiresVersionRoll   = 0x4
+)
+
+var errSv2Short = errors.New("sv2: message too short")
+
+type Sv2Frame struct {
+	ExtensionType uint16
+	MsgType       uint8
+	Payload       []byte
+}
+
+// sv2ChannelMsg tells whether msgType carries a channel id, which sets the
+// channel_msg bit in the frame header.
+func sv2ChannelMsg(msgType uint8) bool {
+	switch msgType {
+	case Sv2MsgNewMiningJob, Sv2MsgUpdateChannel, Sv2MsgUpdateChannelError, Sv2MsgCloseChannel,
+		Sv2MsgSetExtranoncePrefix, Sv2MsgSubmitSharesStandard, Sv2MsgSubmitSharesExtended,
+		Sv2MsgSubmitSharesSuccess, Sv2MsgSubmitSharesError, Sv2MsgNewExtendedMiningJob,
+		Sv2MsgSetNewPrevHash, Sv2MsgSetTarget:
+		return true
+	}
+	return false
+}
+
+func encodeSv2Header(msgType uint8, length int) []byte {
+	h := make([]byte, Sv2HeaderSize)
+	var ext uint16
+	if sv2ChannelMsg(msgType) {
+		ext |= Sv2ChannelBit
+	}
+	binary.LittleEndian.PutUint16(h[0:], ext)
+	h[2] = msgType
+	h[3] = byte(length)
+	h[4] = byte(length >> 8)
+	h[5] = byte(length >> 16)
+	return h
+}
+
+func decodeSv2Header(h []byte) (uint16, uint8, int) {
+	ext := binary.LittleEndian.Uint16(h[0:])
+	length := int(h[3]) | int(h[4])<<8 | int(h[5])<<16
+	return ext, h[2], length
+}
+
+type sv2Writer struct {
+	buf []byte
+}
+
+func (w *sv2Writer) u8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *sv2Writer) bool(v bool) {
+	if v {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+}
+
+func (w *sv2Writer) u16(v uint16) {
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, v)
+}
+
+func (w *sv2Writer) u32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *sv2Writer) u64(v uint64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+}
+
+func (w *sv2Writer) u256(v []byte) {
+	var b [32]byte
+	copy(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *sv2Writer) str0255(v string) {
+	w.b0255([]byte(v))
+}
+
+func (w *sv2Writer) b0255(v []byte) {
+	if len(v) > 255 {
+		v = v[:255]
+	}
+	w.u8(uint8(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *sv2Writer) b064k(v []byte) {
+	w.u16(uint16(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *sv2Writer) optU32(v *uint32) {
+	if v == nil {
+		w.u8(0)
+		return
+	}
+	w.u8(1)
+	w.u32(*v)
+}
+
+func (w *sv2Writer) seq0255U256(v [][]byte) {
+	w.u8(uint8(len(v)))
+	for _, b := range v {
+		w.u256(b)
+	}
+}
+
+type sv2Reader struct {
+	buf []byte
+	err error
+}
+
+func (r *sv2Reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errSv2Short
+		r.buf = nil
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *sv2Reader) u8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *sv2Reader) u16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *sv2Reader) u32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *sv2Reader) f32() float32 {
+	return math.Float32frombits(r.u32())
+}
+
+func (r *sv2Reader) u256() []byte {
+	return r.next(32)
+}
+
+func (r *sv2Reader) b0255() []byte {
+	return r.next(int(r.u8()))
+}
+
+func (r *sv2Reader) str0255() string {
+	return string(r.b0255())
+}
+
+type Sv2SetupConnection struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceId        string
+}
+
+func (m *Sv2SetupConnection) decode(b []byte) error {
+	r := &sv2Reader{buf: b}
+	m.Protocol = r.u8()
+	m.MinVersion = r.u16()
+	m.MaxVersion = r.u16()
+	m.Flags = r.u32()
+	m.EndpointHost = r.str0255()
+	m.EndpointPort = r.u16()
+	m.Vendor = r.str0255()
+	m.HardwareVersion = r.str0255()
+	m.Firmware = r.str0255()
+	m.DeviceId = r.str0255()
+	return r.err
+}
+
+type Sv2OpenMiningChannel struct {
+	RequestId       uint32
+	UserIdentity    string
+	NominalHashRate float32
+	MaxTarget       []byte
+	// extended channels only
+	MinExtranonceSize uint16
+}
+
+func (m *Sv2OpenMiningChannel) decode(b []byte, extended bool) error {
+	r := &sv2Reader{buf: b}
+	m.RequestId = r.u32()
+	m.UserIdentity = r.str0255()
+	m.NominalHashRate = r.f32()
+	m.MaxTarget = r.u256()
+	if extended {
+		m.MinExtranonceSize = r.u16()
+	}
+	return r.err
+}
+
+type Sv2SubmitShares struct {
+	ChannelId      uint32
+	SequenceNumber uint32
+	JobId          uint32
+	Nonce          uint32
+	NTime          uint32
+	Version        uint32
+	// extended channels only
+	Extranonce []byte
+}
+
+func (m *Sv2SubmitShares) decode(b []byte, extended bool) error {
+	r := &sv2Reader{buf: b}
+	m.ChannelId = r.u32()
+	m.SequenceNumber = r.u32()
+	m.JobId = r.u32()
+	m.Nonce = r.u32()
+	m.NTime = r.u32()
+	m.Version = r.u32()
+	if extended {
+		m.Extranonce = r.b0255()
+	}
+	return r.err
+}
+
+type Sv2UpdateChannel struct {
+	ChannelId       uint32
+	NominalHashRate float32
+	MaxTarget       []byte
+}
+
+func (m *Sv2UpdateChannel) decode(b []byte) error {
+	r := &sv2Reader{buf: b}
+	m.ChannelId = r.u32()
+	m.NominalHashRate = r.f32()
+	m.MaxTarget = r.u256()
+	return r.err
+}
+
+type Sv2CloseChannel struct {
+	ChannelId  uint32
+	ReasonCode string
+}
+
+func (m *Sv2CloseChannel) decode(b []byte) error {
+	r := &sv2Reader{buf: b}
+	m.ChannelId = r.u32()
+	m.ReasonCode = r.str0255()
+	return r.err
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+
+	"github.com/PowPool/btcpool/noise"
+	. "github.com/PowPool/btcpool/util"
+)
+
+func TestSv2TargetRoundTrip(t *testing.T) {
+	for _, diff := range []int64{1, 1000, 90000000, 1 << 40} {
+		le := sv2Target(GetTargetHex(diff))
+		if len(le) != 32 {
+			t.Fatalf("Target must be 32 bytes, got %v", len(le))
+		}
+		if got := sv2TargetToDiff(le).Int64(); got != diff {
+			t.Errorf("Difficulty must survive the round trip: %v vs %v", diff, got)
+		}
+	}
+	if sv2TargetToDiff(make([]byte, 32)).Sign() != 0 {
+		t.Error("Empty target must have zero difficulty")
+	}
+}
+
+func TestSv2RejectCodes(t *testing.T) {
+	codes := make(map[string]bool)
+	for errReply := range rejectReasons {
+		code := sv2RejectCodes[errReply]
+		if len(code) == 0 || codes[code] {
+			t.Errorf("%v must have its own SubmitShares.Error code, got %q", errReply.Message, code)
+		}
+		codes[code] = true
+	}
+}
+
+func TestSv2Header(t *testing.T) {
+	h := encodeSv2Header(Sv2MsgSubmitSharesStandard, 0x123456)
+	ext, msgType, length := decodeSv2Header(h)
+	if ext != Sv2ChannelBit || msgType != Sv2MsgSubmitSharesStandard || length != 0x123456 {
+		t.Errorf("Unexpected header %x: %x %x %x", h, ext, msgType, length)
+	}
+	h = encodeSv2Header(Sv2MsgSetupConnection, 1)
+	if ext, _, _ = decodeSv2Header(h); ext != 0 {
+		t.Error("SetupConnection must not set the channel bit")
+	}
+}
+
+func TestSv2EncryptedFrames(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	authority, _ := btcec.NewPrivateKey()
+	static, _ := btcec.NewPrivateKey()
+	cert, _ := noise.NewCertificate(authority, static.PubKey(), time.Hour)
+
+	done := make(chan *Sv2Frame, 1)
+	go func() {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			done <- nil
+			return
+		}
+		act1 := make([]byte, noise.Act1Size)
+		_, _ = io.ReadFull(conn, act1)
+		act2, recv, send, _ := noise.NewResponder(static, cert).Respond(act1)
+		_, _ = conn.Write(act2)
+		sc := &Sv2Conn{conn: conn, recv: recv, send: send}
+		frame, _ := sc.readFrame()
+		done <- frame
+	}()
+
+	conn, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	initiator := noise.NewInitiator(authority.PubKey())
+	act1, _ := initiator.Act1()
+	_, _ = conn.Write(act1)
+	act2 := make([]byte, noise.Act2Size)
+	if _, err = io.ReadFull(conn, act2); err != nil {
+		t.Fatal(err)
+	}
+	send, recv, err := initiator.Act2(act2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// large enough to be split into two encrypted chunks
+	payload := bytes.Repeat([]byte{0xab}, Sv2MaxChunkSize)
+	sc := &Sv2Conn{conn: conn, recv: recv, send: send}
+	if err = sc.writeMessage(Sv2MsgNewExtendedMiningJob, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := <-done
+	if frame == nil {
+		t.Fatal("Server must decode the frame")
+	}
+	if frame.MsgType != Sv2MsgNewExtendedMiningJob || !bytes.Equal(frame.Payload, payload) {
+		t.Error("Decoded frame must match the encoded one")
+	}
+}
+
+func TestSv2JobsQueued(t *testing.T) {
+	sc := &Sv2Conn{out: testWriter()}
+	ch1 := &Sv2Channel{id: 1, extended: true, jobs: make(map[uint32]string)}
+	ch2 := &Sv2Channel{id: 2, extended: true, jobs: make(map[uint32]string)}
+	clean := &Sv2Job{tplJobId: "1", prevHash: make([]byte, 32), clean: true}
+	job := &Sv2Job{tplJobId: "2", prevHash: make([]byte, 32)}
+
+	_ = sc.pushJob(ch1, clean)
+	_ = sc.pushJob(ch2, clean)
+	_ = sc.pushJob(ch1, job)
+	_ = sc.pushJob(ch1, job)
+
+	queue := sc.out.queue
+	if len(queue) != 3 || queue[0].channel != 1 || queue[1].channel != 2 || queue[2].channel != 1 || queue[2].clean {
+		t.Fatalf("A job must only supersede queued jobs of its channel, got %+v", queue)
+	}
+	_, msgType, length := decodeSv2Header(queue[0].data)
+	if msgType != Sv2MsgNewExtendedMiningJob {
+		t.Errorf("Clean job must start with the job, got 0x%02x", msgType)
+	}
+	if _, msgType, _ = decodeSv2Header(queue[0].data[Sv2HeaderSize+length:]); msgType != Sv2MsgSetNewPrevHash {
+		t.Errorf("Clean job must be queued with its SetNewPrevHash, got 0x%02x", msgType)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// tlsCerts holds the current TLS configuration of the stratum+ssl listener,
+// swapped atomically so that certificates can be renewed without a restart.
+type tlsCerts struct {
+	cfg    *StratumTLS
+	config atomic.Value
+}
+
+func newTLSCerts(cfg *StratumTLS) (*tlsCerts, error) {
+	if cfg.RequireClientCert && len(cfg.ClientCAFile) == 0 {
+		return nil, errors.New("requireClientCert needs clientCAFile")
+	}
+	c := &tlsCerts{cfg: cfg}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *tlsCerts) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(c.cfg.ClientCAFile) > 0 {
+		caPem, err := os.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return errors.New("no certificates found in " + c.cfg.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.cfg.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	c.config.Store(config)
+	return nil
+}
+
+func (c *tlsCerts) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return c.config.Load().(*tls.Config), nil
+}
+
+// watchReload reloads the certificates on SIGHUP, a failed reload keeps the previous ones.
+func (c *tlsCerts) watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := c.reload(); err != nil {
+			Error.Printf("Failed to reload stratum TLS certificates: %v", err)
+			continue
+		}
+		Info.Printf("Reloaded stratum TLS certificates from %s", c.cfg.CertFile)
+	}
+}
+
+func (s *ProxyServer) ListenTLS(p *stratumPort) {
+	certs, err := newTLSCerts(&p.cfg.TLS)
+	if err != nil {
+		Error.Fatalf("Error: %v", err)
+	}
+	go certs.watchReload()
+
+	addr, err := net.ResolveTCPAddr("tcp", p.cfg.Listen)
+	if err != nil {
+		Error.Fatalf("Error: %v", err)
+	}
+	server, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		Error.Fatalf("Error: %v", err)
+	}
+	defer server.Close()
+
+	Info.Printf("Stratum TLS listening on %s", p.cfg.Listen)
+	s.serveStratum(p, tls.NewListener(p.listener(server), &tls.Config{GetConfigForClient: certs.getConfigForClient}))
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSCertsReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "pool-a")
+	certs, err := newTLSCerts(&StratumTLS{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := certs.getConfigForClient(nil)
+	if first.ClientAuth != tls.NoClientCert {
+		t.Error("Client certificates must not be requested without clientCAFile")
+	}
+
+	writeTestCert(t, dir, "pool-a")
+	if err = certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := certs.getConfigForClient(nil)
+	if first == second {
+		t.Error("Reload must swap the TLS config")
+	}
+
+	_ = os.WriteFile(certFile, []byte("garbage"), 0600)
+	if err = certs.reload(); err == nil {
+		t.Error("Reload of a broken certificate must fail")
+	}
+	if current, _ := certs.getConfigForClient(nil); current != second {
+		t.Error("Failed reload must keep the previous config")
+	}
+}
+
+func TestTLSCertsClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "pool")
+	caFile, _ := writeTestCert(t, dir, "ca")
+
+	if _, err := newTLSCerts(&StratumTLS{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true}); err == nil {
+		t.Error("requireClientCert without clientCAFile must be rejected")
+	}
+
+	certs, err := newTLSCerts(&StratumTLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := certs.getConfigForClient(nil); c.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("Unexpected client auth %v", c.ClientAuth)
+	}
+
+	certs, _ = newTLSCerts(&StratumTLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, RequireClientCert: true})
+	if c, _ := certs.getConfigForClient(nil); c.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Unexpected client auth %v", c.ClientAuth)
+	}
+}
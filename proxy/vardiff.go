@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// maxRetargetFactor bounds how far a single retarget moves the difficulty, a
+// burst of lucky shares or a short stall must not swing it by orders of magnitude.
+const maxRetargetFactor = 4
+
+// varDiffOptions are the parsed diffAdjust settings, shared by all sessions.
+type varDiffOptions struct {
+	minDiff      int64
+	maxDiff      int64
+	targetTime   time.Duration
+	retargetTime time.Duration
+	variance     float64
+}
+
+func newVarDiffOptions(cfg *DiffAdjust) *varDiffOptions {
+	o := &varDiffOptions{
+		minDiff:      cfg.MinDiff,
+		maxDiff:      cfg.MaxDiff,
+		targetTime:   MustParseDuration(cfg.TargetTime),
+		retargetTime: MustParseDuration(cfg.RetargetTime),
+		variance:     cfg.VariancePercent / 100,
+	}
+	if o.minDiff <= 0 {
+		o.minDiff = 1
+	}
+	if o.targetTime <= 0 || o.retargetTime <= 0 {
+		Error.Fatal("diffAdjust targetTime and retargetTime must be positive")
+	}
+	return o
+}
+
+// VarDiff retargets the difficulty of a single session so that it submits
+// one share every targetTime on average.
+type VarDiff struct {
+	sync.Mutex
+	minDiff      int64
+	maxDiff      int64
+	targetTime   time.Duration
+	retargetTime time.Duration
+	variance     float64
+
+	lastRetarget time.Time
+	lastShare    time.Time
+	shares       int64
+}
+
+func newVarDiff(o *varDiffOptions, now time.Time) *VarDiff {
+	return &VarDiff{
+		minDiff:      o.minDiff,
+		maxDiff:      o.maxDiff,
+		targetTime:   o.targetTime,
+		retargetTime: o.retargetTime,
+		variance:     o.variance,
+		lastRetarget: now,
+	}
+}
+
+func (v *VarDiff) clamp(diff int64) int64 {
+	if diff < v.minDiff {
+		diff = v.minDiff
+	}
+	if v.maxDiff > 0 && diff > v.maxDiff {
+		diff = v.maxDiff
+	}
+	return diff
+}
+
+// Limit narrows the difficulty bounds of the session, zero keeps a bound.
+func (v *VarDiff) Limit(minDiff, maxDiff int64) {
+	v.Lock()
+	defer v.Unlock()
+	if minDiff > v.minDiff && (v.maxDiff == 0 || minDiff <= v.maxDiff) {
+		v.minDiff = minDiff
+	}
+	if maxDiff > 0 && maxDiff >= v.minDiff && (v.maxDiff == 0 || maxDiff < v.maxDiff) {
+		v.maxDiff = maxDiff
+	}
+}
+
+// retarget computes the difficulty for the share rate observed since the last
+// retarget. It returns false if the rate is within the allowed variance.
+func (v *VarDiff) retarget(now time.Time, curDiff int64, shares int64) (int64, bool) {
+	elapsed := now.Sub(v.lastRetarget)
+	v.lastRetarget = now
+	v.shares = 0
+
+	if shares == 0 {
+		shares = 1
+	}
+	avg := float64(elapsed) / float64(shares)
+	target := float64(v.targetTime)
+	if avg >= target*(1-v.variance) && avg <= target*(1+v.variance) {
+		return curDiff, false
+	}
+	factor := target / avg
+	if factor > maxRetargetFactor {
+		factor = maxRetargetFactor
+	} else if factor < 1.0/maxRetargetFactor {
+		factor = 1.0 / maxRetargetFactor
+	}
+	newDiff := v.clamp(int64(float64(curDiff) * factor))
+	return newDiff, newDiff != curDiff
+}
+
+// Submit records an accepted share at curDiff and returns the new difficulty
+// once enough time passed, or as soon as the session floods shares.
+func (v *VarDiff) Submit(now time.Time, curDiff int64) (int64, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.lastShare = now
+	v.shares++
+
+	expected := int64(v.retargetTime / v.targetTime)
+	if now.Sub(v.lastRetarget) < v.retargetTime && v.shares < 2*expected+2 {
+		return curDiff, false
+	}
+	return v.retarget(now, curDiff, v.shares)
+}
+
+// Reset starts a new retarget window, e.g. after the difficulty was set from outside.
+func (v *VarDiff) Reset(now time.Time) {
+	v.Lock()
+	defer v.Unlock()
+	v.lastRetarget = now
+	v.shares = 0
+}
+
+// Idle lowers the difficulty of a session that stopped submitting shares.
+func (v *VarDiff) Idle(now time.Time, curDiff int64) (int64, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	if now.Sub(v.lastRetarget) < v.retargetTime || v.shares > 0 {
+		return curDiff, false
+	}
+	return v.retarget(now, curDiff, 0)
+}
+
+// retargetSession announces the difficulty and re-sends the current job, so
+// that the new difficulty takes effect right away. The job is not clean, work
+// in flight on it stays valid at the easier of both difficulties.
+func (s *ProxyServer) retargetSession(cs *Session, diff int64) {
+	Info.Printf("Retarget %v.%v@%v from %v to %v", cs.login, cs.id, cs.ip, TargetHexToDiff(cs.currentTarget()), diff)
+	cs.Lock()
+	cs.targetNextJob = GetTargetHex(diff)
+	cs.Unlock()
+
+	err := cs.setDifficulty()
+	t := s.currentBlockTemplate()
+	if params := s.jobNotifyParams(t, cs.extraNonceSize(), false); err == nil && params != nil {
+		err = s.pushJob(cs, t, params)
+	}
+	if err != nil {
+		Error.Printf("Retarget error to %v@%v: %v", cs.login, cs.ip, err)
+		s.removeSession(cs)
+		cs.close()
+		return
+	}
+	s.setDeadline(cs)
+	s.saveSession(cs)
+}
+
+func (s *ProxyServer) applyVarDiff(cs *Session) {
+	if cs.vardiff == nil {
+		return
+	}
+	if diff, ok := cs.vardiff.Submit(time.Now(), TargetHexToDiff(cs.currentTarget()).Int64()); ok {
+		s.retargetSession(cs, diff)
+	}
+}
+
+// checkIdleSessionDiff lowers the difficulty of sessions without shares since their last retarget.
+func (s *ProxyServer) checkIdleSessionDiff() {
+	type retarget struct {
+		cs   *Session
+		diff int64
+	}
+	var idle []retarget
+	now := time.Now()
+
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		if !cs.isAuth || cs.vardiff == nil {
+			continue
+		}
+		if diff, ok := cs.vardiff.Idle(now, TargetHexToDiff(cs.currentTarget()).Int64()); ok {
+			idle = append(idle, retarget{cs, diff})
+		}
+	}
+	s.sessionsMu.RUnlock()
+
+	for _, r := range idle {
+		s.retargetSession(r.cs, r.diff)
+	}
+}
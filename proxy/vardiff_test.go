@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func testVarDiff(now time.Time) *VarDiff {
+	return newVarDiff(&varDiffOptions{
+		minDiff:      1000,
+		maxDiff:      1000000,
+		targetTime:   10 * time.Second,
+		retargetTime: 90 * time.Second,
+		variance:     0.3,
+	}, now)
+}
+
+func TestVarDiffRaisesDifficulty(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := testVarDiff(now)
+
+	// one share per second is ten times too fast
+	var diff int64
+	var ok bool
+	for i := 1; i <= 20 && !ok; i++ {
+		diff, ok = v.Submit(now.Add(time.Duration(i)*time.Second), 10000)
+	}
+	if !ok {
+		t.Fatal("Flooding session must be retargeted before retargetTime")
+	}
+	if diff != 40000 {
+		t.Errorf("Difficulty must scale with the share rate up to the retarget factor, got %v", diff)
+	}
+
+	// one share every five seconds is twice too fast
+	v, ok = testVarDiff(now), false
+	for i := 1; i <= 18 && !ok; i++ {
+		diff, ok = v.Submit(now.Add(time.Duration(5*i)*time.Second), 10000)
+	}
+	if !ok || diff != 20000 {
+		t.Errorf("Difficulty must scale with the share rate, got %v %v", diff, ok)
+	}
+}
+
+func TestVarDiffKeepsDifficultyWithinVariance(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := testVarDiff(now)
+
+	for i := 1; i <= 9; i++ {
+		if diff, ok := v.Submit(now.Add(time.Duration(i)*11*time.Second), 10000); ok {
+			t.Fatalf("Difficulty must not change within variance, got %v", diff)
+		}
+	}
+}
+
+func TestVarDiffClamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := testVarDiff(now)
+
+	var diff int64
+	var ok bool
+	for i := 1; i <= 100 && !ok; i++ {
+		diff, ok = v.Submit(now.Add(time.Duration(i)*time.Millisecond), 500000)
+	}
+	if !ok || diff != 1000000 {
+		t.Errorf("Difficulty must be clamped to maxDiff, got %v", diff)
+	}
+
+	if diff, ok = v.Idle(now.Add(time.Hour), 2000); !ok || diff != 1000 {
+		t.Errorf("Difficulty must be clamped to minDiff, got %v", diff)
+	}
+}
+
+func TestVarDiffIdle(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := testVarDiff(now)
+
+	if _, ok := v.Idle(now.Add(30*time.Second), 10000); ok {
+		t.Error("Idle must wait for retargetTime")
+	}
+	diff, ok := v.Idle(now.Add(100*time.Second), 10000)
+	if !ok || diff != 2500 {
+		t.Errorf("Idle session must be lowered, got %v", diff)
+	}
+
+	v.Submit(now.Add(150*time.Second), diff)
+	if _, ok = v.Idle(now.Add(300*time.Second), diff); ok {
+		t.Error("Session with shares must not be treated as idle")
+	}
+}
+
+func TestVarDiffLimit(t *testing.T) {
+	v := testVarDiff(time.Unix(1700000000, 0))
+
+	v.Limit(5000, 2000000)
+	if v.minDiff != 5000 || v.maxDiff != 1000000 {
+		t.Errorf("Limit must only narrow the bounds, got %v..%v", v.minDiff, v.maxDiff)
+	}
+	v.Limit(0, 20000)
+	if v.minDiff != 5000 || v.maxDiff != 20000 {
+		t.Errorf("Zero must keep minDiff, got %v..%v", v.minDiff, v.maxDiff)
+	}
+	if diff := v.clamp(100000); diff != 20000 {
+		t.Errorf("Difficulty must be clamped to the session maxDiff, got %v", diff)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// BIP310 version rolling. The pool mask is the configured mask without the
+// bits the current template version sets, so that rolling never clears a
+// deployment signal. Every session rolls the intersection of the pool mask
+// and the mask it requested with mining.configure.
+
+func (s *ProxyServer) initVersionMask(cfg *Proxy) {
+	s.versionRollingMask = Bip320Mask
+	if len(cfg.VersionMask) > 0 {
+		mask, err := strconv.ParseUint(cfg.VersionMask, 16, 32)
+		if err != nil {
+			Error.Fatalf("Invalid stratum versionMask %v: %v", cfg.VersionMask, err)
+		}
+		s.versionRollingMask = uint32(mask)
+	}
+	atomic.StoreUint32(&s.versionMask, s.versionRollingMask)
+}
+
+func (s *ProxyServer) poolVersionMask() uint32 {
+	return atomic.LoadUint32(&s.versionMask)
+}
+
+// negotiateVersionRolling answers the version-rolling extension of mining.configure.
+func (s *ProxyServer) negotiateVersionRolling(cs *Session, options map[string]interface{}) (map[string]interface{}, *ErrorReply) {
+	requested := uint32(0xffffffff)
+	if obj, ok := options["version-rolling.mask"]; ok {
+		maskStr, ok := obj.(string)
+		if !ok {
+			return nil, &ErrorReply{Code: 27, Message: "Illegal params"}
+		}
+		mask, err := strconv.ParseUint(maskStr, 16, 32)
+		if err != nil {
+			return nil, &ErrorReply{Code: 27, Message: "Illegal params"}
+		}
+		requested = uint32(mask)
+	}
+	minBitCount := 0
+	if obj, ok := options["version-rolling.min-bit-count"]; ok {
+		count, ok := obj.(float64)
+		if !ok || count < 0 || count > 32 {
+			return nil, &ErrorReply{Code: 27, Message: "Illegal params"}
+		}
+		minBitCount = int(count)
+	}
+
+	mask := s.poolVersionMask() & requested
+	if bits.OnesCount32(mask) < minBitCount {
+		Info.Printf("Version rolling mask %08x of %v can't provide %v bits", mask, cs.ip, minBitCount)
+		return map[string]interface{}{"version-rolling": false}, nil
+	}
+	cs.Lock()
+	cs.requestedVersionMask = requested
+	cs.versionMinBitCount = minBitCount
+	cs.versionMask = mask
+	cs.Unlock()
+
+	return map[string]interface{}{
+		"version-rolling":      true,
+		"version-rolling.mask": fmt.Sprintf("%08x", mask),
+	}, nil
+}
+
+// updateVersionMask recomputes the pool mask for the template version and
+// sends mining.set_version_mask to the sessions whose mask changed.
+func (s *ProxyServer) updateVersionMask(t *BlockTemplate) {
+	mask := s.versionRollingMask &^ t.Version
+	if atomic.SwapUint32(&s.versionMask, mask) == mask {
+		return
+	}
+	Info.Printf("Pool version rolling mask changed to %08x", mask)
+
+	var changed []*Session
+	s.sessionsMu.RLock()
+	for cs := range s.sessions {
+		cs.Lock()
+		if cs.requestedVersionMask != 0 && cs.versionMask != mask&cs.requestedVersionMask {
+			cs.versionMask = mask & cs.requestedVersionMask
+			if bits.OnesCount32(cs.versionMask) < cs.versionMinBitCount {
+				Info.Printf("Version rolling mask %08x of %v.%v@%v is below %v bits", cs.versionMask, cs.login, cs.id, cs.ip, cs.versionMinBitCount)
+			}
+			changed = append(changed, cs)
+		}
+		cs.Unlock()
+	}
+	s.sessionsMu.RUnlock()
+
+	for _, cs := range changed {
+		if err := cs.setVersionMask(); err != nil {
+			Error.Printf("set versionMask error to %v@%v: %v", cs.login, cs.ip, err)
+			s.removeSession(cs)
+			cs.close()
+		}
+	}
+}
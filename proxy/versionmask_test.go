@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestNegotiateVersionRolling(t *testing.T) {
+	s := &ProxyServer{}
+	s.initVersionMask(&Proxy{})
+
+	cs := &Session{}
+	reply, errReply := s.negotiateVersionRolling(cs, map[string]interface{}{
+		"version-rolling.mask":          "00fff000",
+		"version-rolling.min-bit-count": float64(2),
+	})
+	if errReply != nil {
+		t.Fatal(errReply)
+	}
+	if reply["version-rolling"] != true || reply["version-rolling.mask"] != "00ffe000" || cs.versionMask != 0x00ffe000 {
+		t.Errorf("Mask must be the intersection of the pool and miner masks, got %v", reply)
+	}
+
+	cs = &Session{}
+	reply, _ = s.negotiateVersionRolling(cs, map[string]interface{}{
+		"version-rolling.mask":          "00006000",
+		"version-rolling.min-bit-count": float64(4),
+	})
+	if reply["version-rolling"] != false || cs.versionMask != 0 {
+		t.Errorf("Version rolling must be refused below min-bit-count, got %v", reply)
+	}
+
+	if _, errReply = s.negotiateVersionRolling(cs, map[string]interface{}{"version-rolling.mask": "xyz"}); errReply == nil {
+		t.Error("Malformed mask must be rejected")
+	}
+}
+
+func TestUpdateVersionMask(t *testing.T) {
+	s := &ProxyServer{sessions: make(map[*Session]struct{})}
+	s.initVersionMask(&Proxy{VersionMask: "1fffe000"})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	cs := &Session{conn: server, enc: json.NewEncoder(server)}
+	if _, errReply := s.negotiateVersionRolling(cs, map[string]interface{}{"version-rolling.mask": "ffffffff"}); errReply != nil {
+		t.Fatal(errReply)
+	}
+	s.sessions[cs] = struct{}{}
+	// a session without version rolling is left alone
+	s.sessions[&Session{}] = struct{}{}
+
+	go s.updateVersionMask(&BlockTemplate{Version: 0x20100000})
+	var msg JSONPushMessage
+	if err := json.NewDecoder(client).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	params, ok := msg.Params.([]interface{})
+	if msg.Method != "mining.set_version_mask" || !ok || len(params) != 1 || params[0] != "1fefe000" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+	if s.poolVersionMask() != 0x1fefe000 {
+		t.Errorf("Signalled bits must be removed from the pool mask, got %08x", s.poolVersionMask())
+	}
+}
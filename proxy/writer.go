@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Outbound messages of a stratum session are queued and written by a writer
+// goroutine of their own, so that a slow miner only delays itself. Queued jobs
+// are dropped once a newer job supersedes them; a session that can't keep up
+// even then, or whose writes make no progress for the stratum timeout, is
+// disconnected.
+
+const sessionQueueSize = 32
+
+var errSessionBackpressure = errors.New("session write queue is full")
+var errSessionClosed = errors.New("session is closed")
+
+type outMessage struct {
+	data  []byte
+	job   bool
+	clean bool
+	// jobs only supersede jobs of their own stratum v2 channel
+	channel uint32
+}
+
+type sessionWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	// seal, if set, encrypts each message right before it is written
+	seal func([]byte) ([]byte, error)
+
+	mu sync.Mutex
+	// the time the queue became non-empty or the last write finished
+	progress time.Time
+	queue    []outMessage
+	closed   bool
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+func newSessionWriter(conn net.Conn, timeout time.Duration) *sessionWriter {
+	w := &sessionWriter{
+		conn:    conn,
+		timeout: timeout,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *sessionWriter) enqueue(msg outMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errSessionClosed
+	}
+	now := time.Now()
+	if len(w.queue) == 0 {
+		w.progress = now
+	} else if now.Sub(w.progress) > w.timeout {
+		return errSessionBackpressure
+	}
+	if msg.job {
+		w.dropJobs(msg)
+	}
+	if len(w.queue) >= sessionQueueSize && !w.dropOldestJob() {
+		return errSessionBackpressure
+	}
+	w.queue = append(w.queue, msg)
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dropJobs removes the queued jobs superseded by job. Only a clean job
+// supersedes clean jobs, the miner must not miss their clean flag.
+func (w *sessionWriter) dropJobs(job outMessage) {
+	queue := w.queue[:0]
+	for _, m := range w.queue {
+		if m.job && m.channel == job.channel && (job.clean || !m.clean) {
+			continue
+		}
+		queue = append(queue, m)
+	}
+	w.queue = queue
+}
+
+func (w *sessionWriter) dropOldestJob() bool {
+	for i, m := range w.queue {
+		if m.job {
+			w.queue = append(w.queue[:i], w.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *sessionWriter) run() {
+	defer close(w.done)
+	for range w.wake {
+		for {
+			w.mu.Lock()
+			queue := w.queue
+			w.queue = nil
+			closed := w.closed
+			w.mu.Unlock()
+			if len(queue) == 0 {
+				if closed {
+					return
+				}
+				break
+			}
+
+			for _, m := range queue {
+				data, err := m.data, error(nil)
+				if w.seal != nil {
+					data, err = w.seal(data)
+				}
+				if err == nil {
+					_ = w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+					_, err = w.conn.Write(data)
+				}
+				if err != nil {
+					w.mu.Lock()
+					w.closed = true
+					w.queue = nil
+					w.mu.Unlock()
+					// the reader fails on the closed connection and removes the session
+					_ = w.conn.Close()
+					return
+				}
+			}
+			w.mu.Lock()
+			w.progress = time.Now()
+			w.mu.Unlock()
+		}
+	}
+}
+
+// close stops accepting messages and waits until the queued ones are written.
+func (w *sessionWriter) close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(w.timeout):
+	}
+}
+
+// send queues a message, or writes it right away for sessions without a writer.
+func (cs *Session) send(message interface{}) error {
+	return cs.sendMessage(message, false, false)
+}
+
+func (cs *Session) sendMessage(message interface{}, job, clean bool) error {
+	if cs.out == nil && cs.rec == nil {
+		return cs.enc.Encode(message)
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	cs.record(recordOut, data)
+	if cs.out == nil {
+		return cs.enc.Encode(message)
+	}
+	return cs.out.enqueue(outMessage{data: append(data, '\n'), job: job, clean: clean})
+}
+
+// close flushes the queued messages and closes the connection.
+func (cs *Session) close() {
+	if cs.out != nil {
+		cs.out.close()
+	}
+	_ = cs.conn.Close()
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func testWriter() *sessionWriter {
+	// no writer goroutine, the queue only fills
+	return &sessionWriter{timeout: time.Minute, wake: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+func TestSessionWriterDropsSupersededJobs(t *testing.T) {
+	w := testWriter()
+	_ = w.enqueue(outMessage{data: []byte("clean1"), job: true, clean: true})
+	_ = w.enqueue(outMessage{data: []byte("job2"), job: true})
+	_ = w.enqueue(outMessage{data: []byte("result")})
+	_ = w.enqueue(outMessage{data: []byte("job3"), job: true})
+
+	if len(w.queue) != 3 || string(w.queue[0].data) != "clean1" || string(w.queue[1].data) != "result" || string(w.queue[2].data) != "job3" {
+		t.Errorf("A job must only supersede queued jobs without the clean flag, got %q", queueData(w))
+	}
+
+	_ = w.enqueue(outMessage{data: []byte("clean4"), job: true, clean: true})
+	if len(w.queue) != 2 || string(w.queue[0].data) != "result" || string(w.queue[1].data) != "clean4" {
+		t.Errorf("A clean job must supersede all queued jobs, got %q", queueData(w))
+	}
+}
+
+func TestSessionWriterBackpressure(t *testing.T) {
+	w := testWriter()
+	for i := 0; i < sessionQueueSize; i++ {
+		if err := w.enqueue(outMessage{data: []byte("result")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.enqueue(outMessage{data: []byte("result")}); err != errSessionBackpressure {
+		t.Errorf("Full queue must refuse messages, got %v", err)
+	}
+
+	w = testWriter()
+	_ = w.enqueue(outMessage{data: []byte("result")})
+	w.progress = time.Now().Add(-2 * time.Minute)
+	if err := w.enqueue(outMessage{data: []byte("job"), job: true}); err != errSessionBackpressure {
+		t.Errorf("Writer without progress must refuse messages, got %v", err)
+	}
+}
+
+func TestSessionWriterWritesInOrder(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	w := newSessionWriter(server, time.Second)
+
+	for _, line := range []string{"a\n", "b\n", "c\n"} {
+		if err := w.enqueue(outMessage{data: []byte(line)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(client)
+	for _, want := range []string{"a\n", "b\n", "c\n"} {
+		if got, err := r.ReadString('\n'); err != nil || got != want {
+			t.Fatalf("Expected %q, got %q %v", want, got, err)
+		}
+	}
+
+	w.close()
+	if err := w.enqueue(outMessage{data: []byte("d\n")}); err != errSessionClosed {
+		t.Errorf("Closed writer must refuse messages, got %v", err)
+	}
+}
+
+func queueData(w *sessionWriter) []string {
+	var data []string
+	for _, m := range w.queue {
+		data = append(data, string(m.data))
+	}
+	return data
+}
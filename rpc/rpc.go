@@ -28,6 +28,14 @@ type GetBlockReply struct {
 	Transactions []Tx    `json:"tx"`
 }
 
+type GetBlockHeaderReply struct {
+	Hash       string `json:"hash"`
+	Height     uint32 `json:"height"`
+	Time       uint32 `json:"time"`
+	MedianTime uint32 `json:"mediantime"`
+	Bits       string `json:"bits"`
+}
+
 type CoinBaseAux struct {
 	Flags string `json:"flags"`
 }
@@ -51,10 +59,24 @@ type GetBlockTemplateReplyPart struct {
 	CoinBaseAux              CoinBaseAux           `json:"coinbaseaux"`
 	CoinBaseValue            int64                 `json:"coinbasevalue"`
 	CurTime                  uint32                `json:"curtime"`
+	MinTime                  uint32                `json:"mintime"`
+	MaxTime                  uint32                `json:"maxtime"`
 	Bits                     string                `json:"bits"`
 	Target                   string                `json:"target"`
 	Height                   uint32                `json:"height"`
 	DefaultWitnessCommitment string                `json:"default_witness_commitment"`
+	// LongPollId identifies the template to BIP22 longpoll requests
+	LongPollId string `json:"longpollid"`
+}
+
+// AuxBlockReply is a block of an aux chain to merge mine, from createauxblock.
+type AuxBlockReply struct {
+	Hash              string `json:"hash"`
+	ChainId           uint32 `json:"chainid"`
+	PreviousBlockHash string `json:"previousblockhash"`
+	CoinBaseValue     int64  `json:"coinbasevalue"`
+	Bits              string `json:"bits"`
+	Height            int64  `json:"height"`
 }
 
 const receiptStatusSuccessful = "0x1"
@@ -121,8 +143,20 @@ func (r *RPCClient) GetPrevBlockHash() (string, error) {
 }
 
 func (r *RPCClient) GetPendingBlock() (*GetBlockTemplateReplyPart, error) {
-	param := make(map[string][]string)
+	return r.getBlockTemplate("")
+}
+
+// GetPendingBlockLongPoll waits until the node has a template newer than the one of longPollId.
+func (r *RPCClient) GetPendingBlockLongPoll(longPollId string) (*GetBlockTemplateReplyPart, error) {
+	return r.getBlockTemplate(longPollId)
+}
+
+func (r *RPCClient) getBlockTemplate(longPollId string) (*GetBlockTemplateReplyPart, error) {
+	param := make(map[string]interface{})
 	param["rules"] = []string{"segwit"}
+	if len(longPollId) > 0 {
+		param["longpollid"] = longPollId
+	}
 	rpcResp, err := r.doPost(r.Url, "getblocktemplate", []interface{}{param})
 	if err != nil {
 		return nil, err
@@ -150,6 +184,19 @@ func (r *RPCClient) GetBlockByHash(hash string) (*GetBlockReply, error) {
 	return r.getBlockBy("getblock", params)
 }
 
+func (r *RPCClient) GetBlockHeader(hash string) (*GetBlockHeaderReply, error) {
+	rpcResp, err := r.doPost(r.Url, "getblockheader", []interface{}{hash, true})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result != nil {
+		var reply *GetBlockHeaderReply
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
+	}
+	return nil, nil
+}
+
 func (r *RPCClient) getBlockBy(method string, params []interface{}) (*GetBlockReply, error) {
 	rpcResp, err := r.doPost(r.Url, method, params)
 	if err != nil {
@@ -176,6 +223,32 @@ func (r *RPCClient) SubmitBlock(params []interface{}) error {
 	return nil
 }
 
+func (r *RPCClient) CreateAuxBlock(address string) (*AuxBlockReply, error) {
+	rpcResp, err := r.doPost(r.Url, "createauxblock", []string{address})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result != nil {
+		var reply *AuxBlockReply
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
+	}
+	return nil, nil
+}
+
+// SubmitAuxBlock submits the AuxPoW proof of the aux block hash, it returns whether the block was accepted.
+func (r *RPCClient) SubmitAuxBlock(hash, auxPow string) (bool, error) {
+	rpcResp, err := r.doPost(r.Url, "submitauxblock", []string{hash, auxPow})
+	if err != nil {
+		return false, err
+	}
+	var accepted bool
+	if rpcResp.Result != nil {
+		err = json.Unmarshal(*rpcResp.Result, &accepted)
+	}
+	return accepted, err
+}
+
 func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
 	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
 	data, err := json.Marshal(jsonReq)
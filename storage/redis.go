@@ -45,10 +45,57 @@ type BlockData struct {
 	ImmatureReward string   `json:"-"`
 	RewardString   string   `json:"reward"`
 	RoundHeight    int64    `json:"-"`
-	candidateKey   string
-	immatureKey    string
+	// Solo is the finder of a solo block, its coinbase paid the reward but SoloFee
+	Solo         string `json:"solo,omitempty"`
+	SoloFee      int64  `json:"-"`
+	candidateKey string
+	immatureKey  string
 }
 
+// StratumSession is the state a reconnecting stratum miner gets back.
+type StratumSession struct {
+	ExtraNonce1 string
+	Difficulty  int64
+	Login       string
+	// account the miner logged in with, Login is the payout address it resolved to
+	Account string
+	Worker  string
+	Solo    bool
+}
+
+// Account is a login that is not an address. Its shares are credited to one of
+// its payout addresses, the first one unless the miner chose another.
+type Account struct {
+	Name string
+	// bcrypt or argon2id hash, miners of accounts without one need no password
+	PasswordHash string
+	Addresses    []string
+}
+
+// WorkerInfo is what a worker reported about itself with mining.configure.
+type WorkerInfo struct {
+	ConnectionUrl string `json:"connectionUrl,omitempty"`
+	HwVersion     string `json:"hwVersion,omitempty"`
+	SwVersion     string `json:"swVersion,omitempty"`
+	HwId          string `json:"hwId,omitempty"`
+	MinDiff       int64  `json:"minDiff,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`
+}
+
+// RejectReason tells why a share was rejected, workers count the rejects of
+// the hashrate window per reason.
+type RejectReason string
+
+const (
+	RejectStale          RejectReason = "stale"
+	RejectDuplicate      RejectReason = "duplicate"
+	RejectLowDifficulty  RejectReason = "low-difficulty"
+	RejectBadNTime       RejectReason = "bad-ntime"
+	RejectBadVersionBits RejectReason = "bad-version-bits"
+	RejectMalformed      RejectReason = "malformed"
+	RejectUnknownJob     RejectReason = "unknown-job"
+)
+
 type HashRateStatsData struct {
 	SharesCount uint64 `json:"sharesCount"`
 	TotalWorks  uint64 `json:"totalWorks"`
@@ -71,7 +118,7 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
-	return join(
+	key := join(
 		b.UncleHeight,
 		b.Orphan,
 		b.Nonce,
@@ -82,6 +129,10 @@ func (b *BlockData) key() string {
 		b.CoinBaseValue,
 		b.BlkTotalFee,
 		b.Reward)
+	if len(b.Solo) > 0 {
+		key = join(key, b.Solo, b.SoloFee)
+	}
+	return key
 }
 
 type Miner struct {
@@ -93,7 +144,9 @@ type Miner struct {
 
 type Worker struct {
 	Miner
-	TotalHR int64 `json:"hr2"`
+	TotalHR int64                  `json:"hr2"`
+	Info    *WorkerInfo            `json:"info,omitempty"`
+	Rejects map[RejectReason]int64 `json:"rejects,omitempty"`
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
@@ -177,6 +230,101 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	return v, nil
 }
 
+// WriteStratumSession stores the session state under sid and leases its extranonce1 to sid.
+func (r *RedisClient) WriteStratumSession(sid string, state *StratumSession, expire time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HMSet(r.formatKey("sessions", sid), "extraNonce1", state.ExtraNonce1,
+			"difficulty", strconv.FormatInt(state.Difficulty, 10), "login", state.Login, "account", state.Account,
+			"worker", state.Worker, "solo", strconv.FormatBool(state.Solo))
+		tx.Expire(r.formatKey("sessions", sid), expire)
+		tx.Set(r.formatKey("extranonces", state.ExtraNonce1), sid, expire)
+		return nil
+	})
+	return err
+}
+
+// GetStratumSession returns nil if there is no state for sid.
+func (r *RedisClient) GetStratumSession(sid string) (*StratumSession, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("sessions", sid))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	m := cmd.Val()
+	if len(m) == 0 {
+		return nil, nil
+	}
+	diff, _ := strconv.ParseInt(m["difficulty"], 10, 64)
+	solo, _ := strconv.ParseBool(m["solo"])
+	return &StratumSession{ExtraNonce1: m["extraNonce1"], Difficulty: diff, Login: m["login"], Account: m["account"],
+		Worker: m["worker"], Solo: solo}, nil
+}
+
+// GetExtranonceLease returns the session id extraNonce1 is leased to, empty if it is free.
+func (r *RedisClient) GetExtranonceLease(extraNonce1 string) (string, error) {
+	sid, err := r.client.Get(r.formatKey("extranonces", extraNonce1)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return sid, err
+}
+
+// WriteWorkerInfo stores the information reported by worker id of login.
+func (r *RedisClient) WriteWorkerInfo(login, id string, info *WorkerInfo, expire time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HMSet(r.formatKey("workers", login, id), "connectionUrl", info.ConnectionUrl, "hwVersion", info.HwVersion,
+			"swVersion", info.SwVersion, "hwId", info.HwId, "minDiff", strconv.FormatInt(info.MinDiff, 10), "tenant", info.Tenant)
+		tx.Expire(r.formatKey("workers", login, id), expire)
+		return nil
+	})
+	return err
+}
+
+// GetWorkerInfo returns nil if worker id of login reported nothing.
+func (r *RedisClient) GetWorkerInfo(login, id string) (*WorkerInfo, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("workers", login, id))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return parseWorkerInfo(cmd.Val()), nil
+}
+
+func parseWorkerInfo(m map[string]string) *WorkerInfo {
+	if len(m) == 0 {
+		return nil
+	}
+	minDiff, _ := strconv.ParseInt(m["minDiff"], 10, 64)
+	return &WorkerInfo{ConnectionUrl: m["connectionUrl"], HwVersion: m["hwVersion"], SwVersion: m["swVersion"],
+		HwId: m["hwId"], MinDiff: minDiff, Tenant: m["tenant"]}
+}
+
+// WriteAccount creates or replaces an account.
+func (r *RedisClient) WriteAccount(a *Account) error {
+	return r.client.HMSet(r.formatKey("accounts", a.Name), "password", a.PasswordHash, "addresses", strings.Join(a.Addresses, ",")).Err()
+}
+
+// GetAccount returns nil if there is no account name.
+func (r *RedisClient) GetAccount(name string) (*Account, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("accounts", name))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	m := cmd.Val()
+	if len(m) == 0 {
+		return nil, nil
+	}
+	a := &Account{Name: name, PasswordHash: m["password"]}
+	if len(m["addresses"]) > 0 {
+		a.Addresses = strings.Split(m["addresses"], ",")
+	}
+	return a, nil
+}
+
 func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
 	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-3))
 	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
@@ -206,20 +354,73 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
 	return false, err
 }
 
-func (r *RedisClient) WriteInvalidShare(ms, ts int64, login, id string, diff int64) error {
-	cmd := r.client.ZAdd(r.formatKey("invalidhashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	if cmd.Err() != nil {
-		return cmd.Err()
+// WriteSoloShare records a share of a solo miner, it counts for the hashrate
+// but not for the pool round.
+func (r *RedisClient) WriteSoloShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	exist, err := r.checkPoWExist(height, params)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	if exist {
+		return true, nil
+	}
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		ms := MakeTimestamp()
+		ts := ms / 1000
+
+		r.writeHashrate(tx, ms, ts, login, id, diff, window)
+		return nil
+	})
+	return false, err
 }
 
-func (r *RedisClient) WriteRejectShare(ms, ts int64, login, id string, diff int64) error {
-	cmd := r.client.ZAdd(r.formatKey("rejecthashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
+func (r *RedisClient) WriteInvalidShare(ms, ts int64, login, id string, diff int64, reason RejectReason, expire time.Duration) error {
+	return r.writeRejectedShare("invalidhashrate", ms, ts, login, id, diff, reason, expire)
+}
+
+func (r *RedisClient) WriteRejectShare(ms, ts int64, login, id string, diff int64, reason RejectReason, expire time.Duration) error {
+	return r.writeRejectedShare("rejecthashrate", ms, ts, login, id, diff, reason, expire)
+}
+
+func (r *RedisClient) writeRejectedShare(key string, ms, ts int64, login, id string, diff int64, reason RejectReason, expire time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.ZAdd(r.formatKey(key), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
+		tx.ZAdd(r.formatKey("rejectshares", login, id), redis.Z{Score: float64(ts), Member: join(string(reason), ms)})
+		tx.ZRemRangeByScore(r.formatKey("rejectshares", login, id), "-inf", fmt.Sprint("(", ts-int64(expire/time.Second)))
+		tx.Expire(r.formatKey("rejectshares", login, id), expire)
+		return nil
+	})
+	return err
+}
+
+// GetRejectStats returns the shares of worker id of login rejected within the last window by reason.
+func (r *RedisClient) GetRejectStats(login, id string, window time.Duration) (map[RejectReason]int64, error) {
+	cmd := r.client.ZRangeByScore(r.formatKey("rejectshares", login, id), rejectWindow(window))
 	if cmd.Err() != nil {
-		return cmd.Err()
+		return nil, cmd.Err()
 	}
-	return nil
+	return parseRejectStats(cmd.Val()), nil
+}
+
+func rejectWindow(window time.Duration) redis.ZRangeByScore {
+	now := MakeTimestamp() / 1000
+	return redis.ZRangeByScore{Min: fmt.Sprint(now - int64(window/time.Second)), Max: "+inf"}
+}
+
+func parseRejectStats(members []string) map[RejectReason]int64 {
+	stats := make(map[RejectReason]int64)
+	for _, member := range members {
+		reason := member[:strings.LastIndex(member, ":")]
+		stats[RejectReason(reason)]++
+	}
+	return stats
 }
 
 func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64,
@@ -263,8 +464,83 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
 	}
 }
 
+// WriteSoloBlock records a block of a solo miner as a candidate of its own,
+// the pool round goes on. Its round only holds the finder.
+func (r *RedisClient) WriteSoloBlock(login, id string, params []string, diff, roundDiff int64, height uint64,
+	coinBaseValue int64, blkTotalFee int64, soloFee int64, window time.Duration) (bool, error) {
+	exist, err := r.checkPoWExist(height, params)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		return true, nil
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ms := MakeTimestamp()
+	ts := ms / 1000
+
+	_, err = tx.Exec(func() error {
+		r.writeHashrate(tx, ms, ts, login, id, diff, window)
+		tx.ZIncrBy(r.formatKey("finders"), 1, login)
+		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
+		tx.HIncrBy(r.formatRound(int64(height), params[0]), login, diff)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	hashHex := strings.Join(params, ":")
+	s := join(hashHex, ts, roundDiff, diff, coinBaseValue, blkTotalFee, login, soloFee)
+	cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+	return false, cmd.Err()
+}
+
+// WriteAuxBlock records a block of an aux chain as a candidate, the client
+// must have the prefix of the aux chain. Its round is a copy of the pool round
+// shares when the block was found, hash is the aux block hash the unlocker
+// looks the block up with.
+func (r *RedisClient) WriteAuxBlock(login string, params []string, roundDiff int64, height uint64,
+	coinBaseValue int64, hash string, shares map[string]int64) (bool, error) {
+	exist, err := r.checkPoWExist(height, params)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		return true, nil
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ts := MakeTimestamp() / 1000
+	totalShares := int64(0)
+
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+		tx.ZIncrBy(r.formatKey("finders"), 1, login)
+		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
+		for miner, n := range shares {
+			tx.HIncrBy(r.formatRound(int64(height), params[0]), miner, n)
+			totalShares += n
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	hashHex := strings.Join(params, ":")
+	s := join(hashHex, ts, roundDiff, totalShares, coinBaseValue, int64(0), hash)
+	cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+	return false, cmd.Err()
+}
+
 func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
 	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+	r.writeHashrate(tx, ms, ts, login, id, diff, expire)
+}
+
+func (r *RedisClient) writeHashrate(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
 	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
 	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
 	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
@@ -330,8 +606,17 @@ func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
 }
 
 func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	return r.getShares(r.formatRound(height, nonce))
+}
+
+// GetCurrentRoundShares returns the shares of the round in progress.
+func (r *RedisClient) GetCurrentRoundShares() (map[string]int64, error) {
+	return r.getShares(r.formatKey("shares", "roundCurrent"))
+}
+
+func (r *RedisClient) getShares(key string) (map[string]int64, error) {
 	result := make(map[string]int64)
-	cmd := r.client.HGetAllMap(r.formatRound(height, nonce))
+	cmd := r.client.HGetAllMap(key)
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
@@ -483,15 +768,21 @@ func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[stri
 	tx := r.client.Multi()
 	defer tx.Close()
 
+	// the coinbase of a solo block paid its rewards, they are logged but never enter the balances
+	solo := len(block.Solo) > 0
 	_, err := tx.Exec(func() error {
 		r.writeImmatureBlock(tx, block)
 		total := int64(0)
 		for login, amount := range roundRewards {
 			total += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", amount)
+			if !solo {
+				tx.HIncrBy(r.formatKey("miners", login), "immature", amount)
+			}
 			tx.HSetNX(r.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
 		}
-		tx.HIncrBy(r.formatKey("finances"), "immature", total)
+		if !solo {
+			tx.HIncrBy(r.formatKey("finances"), "immature", total)
+		}
 		return nil
 	})
 	return err
@@ -509,6 +800,8 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 
 	ts := MakeTimestamp() / 1000
 	value := join(block.Hash, ts, block.Reward)
+	// solo rewards were paid by the coinbase, they are counted as paid instead of credited
+	solo := len(block.Solo) > 0
 
 	_, err = tx.Exec(func() error {
 		r.writeMaturedBlock(tx, block)
@@ -517,6 +810,9 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 		// Decrement immature balances
 		totalImmature := int64(0)
 		for login, amountString := range immatureCredits.Val() {
+			if solo {
+				break
+			}
 			amount, _ := strconv.ParseInt(amountString, 10, 64)
 			totalImmature += amount
 			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
@@ -525,9 +821,13 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 		// Increment balances
 		total := int64(0)
 		for login, amount := range roundRewards {
-			total += amount
 			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
-			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+			if solo {
+				tx.HIncrBy(r.formatKey("miners", login), "soloPaid", amount)
+			} else {
+				total += amount
+				tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+			}
 			tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
 		}
 		tx.Del(creditKey)
@@ -554,9 +854,12 @@ func (r *RedisClient) WriteOrphan(block *BlockData) error {
 	_, err = tx.Exec(func() error {
 		r.writeMaturedBlock(tx, block)
 
-		// Decrement immature balances
+		// Decrement immature balances, solo blocks never had any
 		totalImmature := int64(0)
 		for login, amountString := range immatureCredits.Val() {
+			if len(block.Solo) > 0 {
+				break
+			}
 			amount, _ := strconv.ParseInt(amountString, 10, 64)
 			totalImmature += amount
 			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
@@ -770,8 +1073,25 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	currentHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
+	rejects := make(map[RejectReason]int64)
 	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
 
+	// reported information and rejects of all workers in one round trip
+	infoCmds := make(map[string]*redis.StringStringMapCmd, len(workers))
+	rejectCmds := make(map[string]*redis.StringSliceCmd, len(workers))
+	if len(workers) > 0 {
+		_, err = tx.Exec(func() error {
+			for id := range workers {
+				infoCmds[id] = tx.HGetAllMap(r.formatKey("workers", login, id))
+				rejectCmds[id] = tx.ZRangeByScore(r.formatKey("rejectshares", login, id), rejectWindow(lWindow))
+			}
+			return nil
+		})
+		if err != nil {
+			Error.Printf("Failed to fetch worker details of %v: %v", login, err)
+		}
+	}
+
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
 		if timeOnline < 600 {
@@ -799,6 +1119,15 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
+		if cmd := infoCmds[id]; cmd.Err() == nil {
+			worker.Info = parseWorkerInfo(cmd.Val())
+		}
+		if cmd := rejectCmds[id]; cmd.Err() == nil {
+			worker.Rejects = parseRejectStats(cmd.Val())
+		}
+		for reason, n := range worker.Rejects {
+			rejects[reason] += n
+		}
 		workers[id] = worker
 	}
 	stats["workers"] = workers
@@ -807,6 +1136,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
+	stats["rejects"] = rejects
 	return stats, nil
 }
 
@@ -867,7 +1197,7 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, v := range raw.Val() {
-		// "nonce:eNonce1:eNonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee"
+		// "nonce:eNonce1:eNonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee[:solo:soloFee|:auxHash]"
 		block := BlockData{}
 		block.Height = int64(v.Score)
 		block.RoundHeight = block.Height
@@ -882,6 +1212,13 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 		block.CoinBaseValue = big.NewInt(coinBaseValue)
 		blkTotalFee, _ := strconv.ParseInt(fields[7], 10, 64)
 		block.BlkTotalFee = big.NewInt(blkTotalFee)
+		if len(fields) > 9 {
+			block.Solo = fields[8]
+			block.SoloFee, _ = strconv.ParseInt(fields[9], 10, 64)
+		} else if len(fields) > 8 {
+			// aux blocks are known by hash
+			block.Hash = fields[8]
+		}
 		block.candidateKey = v.Member.(string)
 		result = append(result, &block)
 	}
@@ -911,6 +1248,10 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 
 			block.RewardString = fields[9]
 			block.ImmatureReward = fields[9]
+			if len(fields) > 11 {
+				block.Solo = fields[10]
+				block.SoloFee, _ = strconv.ParseInt(fields[11], 10, 64)
+			}
 			block.immatureKey = v.Member.(string)
 			result = append(result, &block)
 		}
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"gopkg.in/redis.v3"
 )
@@ -327,3 +328,147 @@ func reset() {
 		r.client.Del(k)
 	}
 }
+
+func TestStratumSession(t *testing.T) {
+	reset()
+
+	state, err := r.GetStratumSession("s1")
+	if err != nil || state != nil {
+		t.Error("Unknown session must not exist")
+	}
+
+	r.WriteStratumSession("s1", &StratumSession{ExtraNonce1: "00010002", Difficulty: 65536, Login: "x", Account: "a", Worker: "w"}, time.Minute)
+	state, _ = r.GetStratumSession("s1")
+	if state == nil || state.ExtraNonce1 != "00010002" || state.Difficulty != 65536 || state.Login != "x" || state.Account != "a" || state.Worker != "w" {
+		t.Errorf("Unexpected session state %+v", state)
+	}
+	if sid, _ := r.GetExtranonceLease("00010002"); sid != "s1" {
+		t.Error("Extranonce1 must be leased to the session")
+	}
+	if sid, _ := r.GetExtranonceLease("00010003"); sid != "" {
+		t.Error("Extranonce1 must be free")
+	}
+}
+
+func TestWorkerInfo(t *testing.T) {
+	reset()
+
+	info, err := r.GetWorkerInfo("x", "w")
+	if err != nil || info != nil {
+		t.Error("Unknown worker must not have info")
+	}
+
+	r.WriteWorkerInfo("x", "w", &WorkerInfo{ConnectionUrl: "stratum+tcp://pool:3333", HwVersion: "S19", SwVersion: "1.2", MinDiff: 4096, Tenant: "rental"}, time.Minute)
+	info, _ = r.GetWorkerInfo("x", "w")
+	if info == nil || info.ConnectionUrl != "stratum+tcp://pool:3333" || info.HwVersion != "S19" || info.SwVersion != "1.2" || info.MinDiff != 4096 || info.Tenant != "rental" {
+		t.Errorf("Unexpected worker info %+v", info)
+	}
+}
+
+func TestRejectStats(t *testing.T) {
+	reset()
+
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	ts := ms / 1000
+	r.WriteInvalidShare(ms-600000, ts-600, "x", "w", 100, RejectUnknownJob, time.Hour)
+	r.WriteInvalidShare(ms, ts, "x", "w", 100, RejectStale, time.Hour)
+	r.WriteInvalidShare(ms+1, ts, "x", "w", 100, RejectStale, time.Hour)
+	r.WriteRejectShare(ms+2, ts, "x", "w", 100, RejectLowDifficulty, time.Hour)
+	r.WriteInvalidShare(ms+3, ts, "x", "w2", 100, RejectBadNTime, time.Hour)
+
+	stats, err := r.GetRejectStats("x", "w", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[RejectStale] != 2 || stats[RejectLowDifficulty] != 1 {
+		t.Errorf("Rejects outside the window must not be counted, got %v", stats)
+	}
+	if stats, _ = r.GetRejectStats("x", "w", time.Hour); stats[RejectUnknownJob] != 1 {
+		t.Errorf("Unexpected reject stats %v", stats)
+	}
+	if n := r.client.ZCard(r.formatKey("invalidhashrate")).Val(); n != 4 {
+		t.Errorf("Invalid shares must still be recorded, got %v", n)
+	}
+	if n := r.client.ZCard(r.formatKey("rejecthashrate")).Val(); n != 1 {
+		t.Errorf("Rejected shares must still be recorded, got %v", n)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	reset()
+
+	a := &Account{Name: "hosting1", PasswordHash: "$2a$10$hash", Addresses: []string{"addr1", "addr2"}}
+	if err := r.WriteAccount(a); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.GetAccount("hosting1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.PasswordHash != a.PasswordHash || len(got.Addresses) != 2 || got.Addresses[1] != "addr2" {
+		t.Errorf("Unexpected account %+v", got)
+	}
+	if got, err := r.GetAccount("unknown"); got != nil || err != nil {
+		t.Errorf("Unknown account must be nil, got %+v %v", got, err)
+	}
+}
+
+func TestSoloBlock(t *testing.T) {
+	reset()
+
+	r.WriteShare("pool", "w", []string{"0x0", "0x0", "0x1"}, 100, 1000, time.Minute)
+	r.WriteSoloShare("solo", "w", []string{"0x0", "0x0", "0x2"}, 100, 1000, time.Minute)
+	if n := r.client.HGet(r.formatKey("shares", "roundCurrent"), "solo").Val(); n != "" {
+		t.Errorf("Solo shares must not count for the pool round, got %v", n)
+	}
+
+	exist, err := r.WriteSoloBlock("solo", "w", []string{"0x3", "0x0", "0x3"}, 100, 1000000, 1000, 625000000, 1000, 6250000, time.Minute)
+	if exist || err != nil {
+		t.Fatal(exist, err)
+	}
+	if n := r.client.HGet(r.formatKey("shares", "roundCurrent"), "pool").Val(); n != "100" {
+		t.Errorf("Solo block must not end the pool round, got %v", n)
+	}
+	candidates, err := r.GetCandidates(1000)
+	if err != nil || len(candidates) != 1 {
+		t.Fatal(candidates, err)
+	}
+	if c := candidates[0]; c.Solo != "solo" || c.SoloFee != 6250000 || c.TotalShares != 100 {
+		t.Errorf("Unexpected solo candidate %+v", c)
+	}
+	shares, _ := r.GetRoundShares(1000, "0x3")
+	if len(shares) != 1 || shares["solo"] != 100 {
+		t.Errorf("Solo round must only hold the finder, got %v", shares)
+	}
+}
+
+func TestAuxBlock(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "w", []string{"0x0", "0x0", "0x1"}, 100, 1000, time.Minute)
+	r.WriteShare("y", "w", []string{"0x0", "0x0", "0x2"}, 300, 1000, time.Minute)
+	shares, err := r.GetCurrentRoundShares()
+	if err != nil || shares["x"] != 100 || shares["y"] != 300 {
+		t.Fatal(shares, err)
+	}
+
+	// the aux chain is recorded under the prefix of the test client
+	exist, err := r.WriteAuxBlock("x", []string{"0x3", "0x0", "0x3"}, 5000, 80000, 312500000, "00000000000000000001aa", shares)
+	if exist || err != nil {
+		t.Fatal(exist, err)
+	}
+	candidates, err := r.GetCandidates(80000)
+	if err != nil || len(candidates) != 1 {
+		t.Fatal(candidates, err)
+	}
+	if c := candidates[0]; c.Hash != "00000000000000000001aa" || c.TotalShares != 400 || len(c.Solo) > 0 {
+		t.Errorf("Unexpected aux candidate %+v", c)
+	}
+	round, _ := r.GetRoundShares(80000, "0x3")
+	if !reflect.DeepEqual(round, shares) {
+		t.Errorf("Aux round must copy the pool round, got %v", round)
+	}
+	if n := r.client.HGet(r.formatKey("shares", "roundCurrent"), "x").Val(); n != "100" {
+		t.Errorf("Aux block must not end the pool round, got %v", n)
+	}
+}
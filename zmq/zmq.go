@@ -0,0 +1,227 @@
+package zmq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Minimal ZMTP 3.0 over TCP with the NULL security mechanism, enough to
+// subscribe to the block notifications of a node:
+//
+//	greeting: signature, version 3.0, mechanism NULL
+//	READY command with the socket type
+//	messages of one or more frames, a subscription is a single frame 0x01 + topic
+
+const (
+	GreetingSize = 64
+
+	// MaxFrameSize bounds frames read from the peer, a raw block fits in it
+	MaxFrameSize = 32 << 20
+
+	flagMore    = 0x01
+	flagLong    = 0x02
+	flagCommand = 0x04
+)
+
+var (
+	ErrInvalidGreeting = errors.New("zmq: invalid greeting")
+	ErrFrameTooLarge   = errors.New("zmq: frame too large")
+)
+
+// Conn is a ZMTP connection after the handshake.
+type Conn struct {
+	conn net.Conn
+	// socket type of the peer
+	PeerType string
+}
+
+// NewConn runs the handshake on conn as a socket of socketType, e.g. SUB or PUB.
+func NewConn(conn net.Conn, socketType string) (*Conn, error) {
+	greeting := make([]byte, GreetingSize)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	copy(greeting[12:32], "NULL")
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+	peer := make([]byte, GreetingSize)
+	if _, err := io.ReadFull(conn, peer); err != nil {
+		return nil, err
+	}
+	if peer[0] != 0xff || peer[9]&0x01 == 0 || peer[10] < 3 || string(bytes.TrimRight(peer[12:32], "\x00")) != "NULL" {
+		return nil, ErrInvalidGreeting
+	}
+
+	c := &Conn{conn: conn}
+	if err := c.writeFrame(flagCommand, readyCommand(socketType)); err != nil {
+		return nil, err
+	}
+	flags, body, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagCommand == 0 {
+		return nil, errors.New("zmq: expected READY command")
+	}
+	name, props, err := parseCommand(body)
+	if err != nil {
+		return nil, err
+	}
+	if name == "ERROR" {
+		return nil, fmt.Errorf("zmq: peer error %q", props)
+	}
+	if name != "READY" {
+		return nil, fmt.Errorf("zmq: expected READY command, got %s", name)
+	}
+	metadata, err := parseMetadata(props)
+	if err != nil {
+		return nil, err
+	}
+	c.PeerType = metadata["Socket-Type"]
+	return c, nil
+}
+
+// Dial connects to a publisher at addr, tcp://host:port, and subscribes to topics.
+func Dial(addr string, timeout time.Duration, topics ...string) (*Conn, error) {
+	hostPort, ok := strings.CutPrefix(addr, "tcp://")
+	if !ok {
+		return nil, fmt.Errorf("zmq: unsupported endpoint %s", addr)
+	}
+	conn, err := net.DialTimeout("tcp", hostPort, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c, err := NewConn(conn, "SUB")
+	if err == nil && c.PeerType != "PUB" && c.PeerType != "XPUB" {
+		err = fmt.Errorf("zmq: cannot subscribe to a %s socket", c.PeerType)
+	}
+	for _, topic := range topics {
+		if err != nil {
+			break
+		}
+		err = c.Subscribe(topic)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// Subscribe asks the publisher for the messages whose first frame starts with topic.
+func (c *Conn) Subscribe(topic string) error {
+	return c.writeFrame(0, append([]byte{0x01}, topic...))
+}
+
+// ReadMessage returns the frames of the next message, commands are skipped.
+func (c *Conn) ReadMessage() ([][]byte, error) {
+	var frames [][]byte
+	for {
+		flags, body, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&flagCommand != 0 {
+			continue
+		}
+		frames = append(frames, body)
+		if flags&flagMore == 0 {
+			return frames, nil
+		}
+	}
+}
+
+// WriteMessage sends frames as one message.
+func (c *Conn) WriteMessage(frames ...[]byte) error {
+	for i, frame := range frames {
+		var flags byte
+		if i < len(frames)-1 {
+			flags = flagMore
+		}
+		if err := c.writeFrame(flags, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) writeFrame(flags byte, body []byte) error {
+	var header []byte
+	if len(body) > 0xff {
+		header = binary.BigEndian.AppendUint64([]byte{flags | flagLong}, uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	_, err := c.conn.Write(append(header, body...))
+	return err
+}
+
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(c.conn, header[:2]); err != nil {
+		return 0, nil, err
+	}
+	flags := header[0]
+	size := uint64(header[1])
+	if flags&flagLong != 0 {
+		if _, err := io.ReadFull(c.conn, header[2:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(header[1:])
+	}
+	if size > MaxFrameSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+func readyCommand(socketType string) []byte {
+	body := append([]byte{5}, "READY"...)
+	body = append(body, byte(len("Socket-Type")))
+	body = append(body, "Socket-Type"...)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(socketType)))
+	return append(body, socketType...)
+}
+
+func parseCommand(body []byte) (string, []byte, error) {
+	if len(body) == 0 || len(body) < 1+int(body[0]) {
+		return "", nil, errors.New("zmq: invalid command")
+	}
+	return string(body[1 : 1+body[0]]), body[1+body[0]:], nil
+}
+
+func parseMetadata(b []byte) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for len(b) > 0 {
+		n := int(b[0])
+		if len(b) < 1+n+4 {
+			return nil, errors.New("zmq: invalid metadata")
+		}
+		name := string(b[1 : 1+n])
+		size := binary.BigEndian.Uint32(b[1+n:])
+		b = b[1+n+4:]
+		if uint64(len(b)) < uint64(size) {
+			return nil, errors.New("zmq: invalid metadata")
+		}
+		metadata[name] = string(b[:size])
+		b = b[size:]
+	}
+	return metadata, nil
+}
@@ -0,0 +1,73 @@
+package zmq
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	subscribed := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		pub, err := NewConn(conn, "PUB")
+		if err != nil {
+			conn.Close()
+			return
+		}
+		msg, err := pub.ReadMessage()
+		if err != nil {
+			return
+		}
+		subscribed <- msg[0]
+		rawBlock := bytes.Repeat([]byte{0x01}, 300)
+		_ = pub.WriteMessage([]byte("rawblock"), rawBlock, []byte{1, 0, 0, 0})
+	}()
+
+	sub, err := Dial("tcp://"+ln.Addr().String(), time.Second, "rawblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if sub.PeerType != "PUB" {
+		t.Errorf("Unexpected peer socket type %v", sub.PeerType)
+	}
+	if s := <-subscribed; string(s) != "\x01rawblock" {
+		t.Errorf("Unexpected subscription %q", s)
+	}
+	msg, err := sub.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) != 3 || string(msg[0]) != "rawblock" || len(msg[1]) != 300 {
+		t.Errorf("Unexpected message %q", msg)
+	}
+
+	if _, err := Dial("ipc:///tmp/bitcoind", time.Second); err == nil {
+		t.Error("Only tcp endpoints must be accepted")
+	}
+}
+
+func TestInvalidGreeting(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = io.ReadFull(server, make([]byte, GreetingSize))
+		_, _ = server.Write(make([]byte, GreetingSize))
+		server.Close()
+	}()
+	if _, err := NewConn(client, "SUB"); err != ErrInvalidGreeting {
+		t.Errorf("Expected %v, got %v", ErrInvalidGreeting, err)
+	}
+}